@@ -0,0 +1,242 @@
+package main
+
+import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"github.com/lhzd863/nsq-0.2.16/nsqd"
+	"github.com/lhzd863/nsq-0.2.16/util"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// runtimeConfigFlags are the options that are applied when the config file is
+// reloaded (via SIGHUP or /config), changes to any others require a restart.
+//
+// NOTE: changes to the queue limits only apply to topics/channels created afterwards
+var runtimeConfigFlags = map[string]bool{
+	"msg-timeout":         true,
+	"mem-queue-size":      true,
+	"max-bytes-per-file":  true,
+	"sync-every":          true,
+	"verbose":             true,
+	"statsd-address":      true,
+	"statsd-interval":     true,
+	"lookupd-tcp-address": true,
+	"log-level":           true,
+}
+
+// loadConfigFile parses a JSON config file, an object keyed by flag name, ie.
+//
+//     {"mem-queue-size": 10000, "lookupd-tcp-address": ["a:4160", "b:4160"]}
+func loadConfigFile(fileName string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	config := make(map[string]interface{})
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range config {
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown option %s", name)
+		}
+		_, err := configFlagValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s - %s", name, err.Error())
+		}
+	}
+
+	return config, nil
+}
+
+// configFlagValues converts a config value to the value(s) to set its flag to
+func configFlagValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			itemValues, err := configFlagValues(item)
+			if err != nil || len(itemValues) != 1 {
+				return nil, errors.New("arrays may only contain strings, numbers or booleans")
+			}
+			values = append(values, itemValues[0])
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", value)
+}
+
+// configFlagString returns what the flag's String() would be once set to values
+func configFlagString(name string, values []string) string {
+	if _, ok := flag.Lookup(name).Value.(*util.StringArray); ok {
+		return fmt.Sprint(values)
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// applyConfig sets the flags in config, except those given on the command line
+func applyConfig(config map[string]interface{}) error {
+	for name, value := range config {
+		if commandLineFlags[name] {
+			continue
+		}
+
+		values, err := configFlagValues(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s - %s", name, err.Error())
+		}
+
+		if sa, ok := flag.Lookup(name).Value.(*util.StringArray); ok {
+			// replace (rather than append to) a previous list
+			*sa = util.StringArray{}
+		}
+
+		for _, v := range values {
+			err = flag.Set(name, v)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s - %s", name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// flagConfig implements nsqd.ConfigReloader for the command line flags and config file
+//
+// The flags are global, the lock serializes the reloads (via SIGHUP and /config) with
+// each other and with reading the current config
+type flagConfig struct {
+	sync.Mutex
+	daemon *nsqd.NSQd
+}
+
+// Config returns the current value of every option (keyed by flag name)
+func (c *flagConfig) Config() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	config := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if sa, ok := f.Value.(*util.StringArray); ok {
+			config[f.Name] = []string(*sa)
+			return
+		}
+		config[f.Name] = f.Value.String()
+	})
+	return config
+}
+
+// ReloadConfig re-reads the config file and applies the options that can be
+// changed at runtime.
+//
+// It returns the names of the options that were applied and of the options
+// that changed but require a restart to take effect.  Options removed from
+// the config file keep their current values.
+func (c *flagConfig) ReloadConfig() ([]string, []string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if *configFile == "" {
+		return nil, nil, errors.New("no config file")
+	}
+
+	config, err := loadConfigFile(*configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	applied := make([]string, 0)
+	restartRequired := make([]string, 0)
+	changed := make(map[string]interface{})
+	for name, value := range config {
+		if commandLineFlags[name] {
+			continue
+		}
+
+		values, _ := configFlagValues(value)
+		if configFlagString(name, values) == flag.Lookup(name).Value.String() {
+			continue
+		}
+
+		if !runtimeConfigFlags[name] {
+			restartRequired = append(restartRequired, name)
+			continue
+		}
+
+		changed[name] = value
+		applied = append(applied, name)
+	}
+	sort.Strings(applied)
+	sort.Strings(restartRequired)
+
+	err = validateRuntimeConfig(changed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = applyConfig(changed)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = c.daemon.SetRuntimeOptions(optionsFromFlags())
+	if err != nil {
+		return nil, nil, err
+	}
+	if logger != nil {
+		level, _ := nsq.ParseLogLevel(*logLevel)
+		logger.SetLevel(level)
+	}
+
+	nsq.NewLogEntry(nil).Infof("reloaded config %s - applied %v, restart required %v", *configFile, applied, restartRequired)
+
+	return applied, restartRequired, nil
+}
+
+// validateRuntimeConfig checks the values of the options that are applied at runtime
+// (so that an invalid config file is rejected as a whole)
+func validateRuntimeConfig(config map[string]interface{}) error {
+	for _, name := range []string{"msg-timeout", "mem-queue-size", "max-bytes-per-file", "sync-every", "statsd-interval"} {
+		value, ok := config[name]
+		if !ok {
+			continue
+		}
+
+		values, _ := configFlagValues(value)
+		if len(values) != 1 {
+			return fmt.Errorf("invalid value for %s", name)
+		}
+		i, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil || i <= 0 {
+			return fmt.Errorf("invalid value for %s - must be a positive integer", name)
+		}
+	}
+	if value, ok := config["log-level"]; ok {
+		values, _ := configFlagValues(value)
+		if len(values) != 1 {
+			return errors.New("invalid value for log-level")
+		}
+		_, err := nsq.ParseLogLevel(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid value for log-level - %s", err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"github.com/lhzd863/nsq-0.2.16/nsqd"
+	"github.com/lhzd863/nsq-0.2.16/util"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	fileName := path.Join(os.TempDir(), "nsqd_test_config.json")
+	defer os.Remove(fileName)
+
+	*configFile = fileName
+	defer func() {
+		*configFile = ""
+		*msgTimeoutMs = 60000
+		*memQueueSize = 10000
+	}()
+
+	daemon := nsqd.New(optionsFromFlags())
+	defer daemon.Stop()
+	reloader := &flagConfig{daemon: daemon}
+
+	config := `{"msg-timeout": 1234, "mem-queue-size": 50, "tcp-address": "127.0.0.1:9999"}`
+	err := ioutil.WriteFile(fileName, []byte(config), 0600)
+	assert.Equal(t, err, nil)
+
+	applied, restartRequired, err := reloader.ReloadConfig()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, applied, []string{"mem-queue-size", "msg-timeout"})
+	assert.Equal(t, restartRequired, []string{"tcp-address"})
+	assert.Equal(t, daemon.GetOptions().MsgTimeout, 1234*time.Millisecond)
+	assert.Equal(t, daemon.GetOptions().MemQueueSize, int64(50))
+
+	// nothing changed
+	applied, restartRequired, err = reloader.ReloadConfig()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(applied), 0)
+	assert.Equal(t, restartRequired, []string{"tcp-address"})
+
+	// invalid config files are rejected as a whole
+	config = `{"msg-timeout": 5000, "mem-queue-size": -1}`
+	err = ioutil.WriteFile(fileName, []byte(config), 0600)
+	assert.Equal(t, err, nil)
+	_, _, err = reloader.ReloadConfig()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, daemon.GetOptions().MsgTimeout, 1234*time.Millisecond)
+
+	config = `{"not-an-option": 1}`
+	err = ioutil.WriteFile(fileName, []byte(config), 0600)
+	assert.Equal(t, err, nil)
+	_, _, err = reloader.ReloadConfig()
+	assert.NotEqual(t, err, nil)
+}
+
+func TestReloadConfigConcurrent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	fileName := path.Join(os.TempDir(), "nsqd_test_concurrent_config.json")
+	defer os.Remove(fileName)
+
+	*configFile = fileName
+	defer func() {
+		*configFile = ""
+		lookupdTCPAddrs = util.StringArray{}
+	}()
+
+	daemon := nsqd.New(optionsFromFlags())
+	defer daemon.Stop()
+	reloader := &flagConfig{daemon: daemon}
+
+	// the config is read while it is reloaded, it is never seen half applied
+	configs := []string{
+		`{"lookupd-tcp-address": ["127.0.0.1:1", "127.0.0.1:2"]}`,
+		`{"lookupd-tcp-address": ["127.0.0.1:3", "127.0.0.1:4"]}`,
+	}
+	exitChan := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-exitChan:
+					return
+				default:
+				}
+				addrs := reloader.Config()["lookupd-tcp-address"].([]string)
+				if len(addrs) != 0 && len(addrs) != 2 {
+					t.Errorf("unexpected lookupd-tcp-address %v", addrs)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		err := ioutil.WriteFile(fileName, []byte(configs[i%2]), 0600)
+		assert.Equal(t, err, nil)
+		_, _, err = reloader.ReloadConfig()
+		assert.Equal(t, err, nil)
+	}
+	close(exitChan)
+	wg.Wait()
+	assert.Equal(t, daemon.GetOptions().LookupdTCPAddresses, []string{"127.0.0.1:3", "127.0.0.1:4"})
+}
+
+func TestReloadLogLevel(t *testing.T) {
+	fileName := path.Join(os.TempDir(), "nsqd_test_log_config.json")
+	defer os.Remove(fileName)
+
+	*configFile = fileName
+	logger, _ = nsq.NewLogger(ioutil.Discard, nsq.LogLevelInfo, nsq.LogFormatText)
+	defer func() {
+		*configFile = ""
+		*logLevel = "info"
+		logger = nil
+	}()
+
+	daemon := nsqd.New(optionsFromFlags())
+	defer daemon.Stop()
+	reloader := &flagConfig{daemon: daemon}
+
+	err := ioutil.WriteFile(fileName, []byte(`{"log-level": "error"}`), 0600)
+	assert.Equal(t, err, nil)
+	applied, _, err := reloader.ReloadConfig()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, applied, []string{"log-level"})
+	assert.Equal(t, logger.Level(), nsq.LogLevelError)
+
+	err = ioutil.WriteFile(fileName, []byte(`{"log-level": "loud"}`), 0600)
+	assert.Equal(t, err, nil)
+	_, _, err = reloader.ReloadConfig()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, logger.Level(), nsq.LogLevelError)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"github.com/lhzd863/nsq-0.2.16/nsqd"
+	"github.com/lhzd863/nsq-0.2.16/util"
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	showVersion     = flag.Bool("version", false, "print version string")
+	httpAddress     = flag.String("http-address", "0.0.0.0:4151", "<addr>:<port> to listen on for HTTP clients")
+	tcpAddress      = flag.String("tcp-address", "0.0.0.0:4150", "<addr>:<port> to listen on for TCP clients")
+	memQueueSize    = flag.Int64("mem-queue-size", 10000, "number of messages to keep in memory (per topic)")
+	maxBytesPerFile = flag.Int64("max-bytes-per-file", 104857600, "number of bytes per diskqueue file before rolling")
+	syncEvery       = flag.Int64("sync-every", 2500, "number of messages between diskqueue syncs")
+	msgTimeoutMs    = flag.Int64("msg-timeout", 60000, "time (ms) to wait before auto-requeing a message")
+	dataPath        = flag.String("data-path", "", "path to store disk-backed messages")
+	workerId        = flag.Int64("worker-id", 0, "unique identifier (int) for this worker (will default to a hash of hostname)")
+	verbose         = flag.Bool("verbose", false, "enable verbose logging (debug messages are logged at the info level)")
+	dedupWindowMs   = flag.Int64("dedup-window", 300000, "time (ms) to remember publish dedup keys for (0 to disable)")
+	dedupMaxKeys    = flag.Int("dedup-max-keys", 100000, "maximum number of publish dedup keys to remember (per topic)")
+	maxMsgSize      = flag.Int64("max-msg-size", 1048576, "maximum size of a single message in bytes (for HPUB and binary/JSON /mput batches)")
+	maxBodySize     = flag.Int64("max-body-size", 5242880, "maximum size of a binary/JSON /mput body in bytes")
+	statsdAddress   = flag.String("statsd-address", "", "UDP <addr>:<port> of a statsd daemon for writing stats")
+	statsdInterval  = flag.Int("statsd-interval", 30, "seconds between pushing to statsd")
+	configFile      = flag.String("config", "", "path to a (JSON) config file, keys are flag names")
+	logLevel        = flag.String("log-level", "info", "log level (debug, info, warn or error)")
+	logFormat       = flag.String("log-format", "text", "log format (text or json)")
+	lookupdTCPAddrs = util.StringArray{}
+)
+
+// the flags that were set on the command line
+var commandLineFlags = make(map[string]bool)
+
+// the daemon's Logger, its level is changed when the config file is reloaded
+var logger *nsq.StdLogger
+
+func init() {
+	flag.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
+}
+
+func main() {
+	flag.Parse()
+
+	// flags given on the command line take precedence over the config file
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+
+	if *configFile != "" {
+		config, err := loadConfigFile(*configFile)
+		if err != nil {
+			log.Fatalf("FATAL: failed to load config file %s - %s", *configFile, err.Error())
+		}
+		err = applyConfig(config)
+		if err != nil {
+			log.Fatalf("FATAL: invalid config file %s - %s", *configFile, err.Error())
+		}
+	}
+
+	if *showVersion {
+		fmt.Printf("nsqd v%s\n", util.BINARY_VERSION)
+		return
+	}
+
+	var err error
+	logger, err = util.SetupLogging(*logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	if *workerId == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		h := md5.New()
+		io.WriteString(h, hostname)
+		*workerId = int64(crc32.ChecksumIEEE(h.Sum(nil)) % 1024)
+	}
+
+	nsq.NewLogEntry(nil).Infof("nsqd v%s", util.BINARY_VERSION)
+	nsq.NewLogEntry(nil).Infof("worker id %d", *workerId)
+
+	exitChan := make(chan int)
+	signalChan := make(chan os.Signal, 1)
+	go func() {
+		<-signalChan
+		exitChan <- 1
+	}()
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	daemon := nsqd.New(optionsFromFlags())
+	reloader := &flagConfig{daemon: daemon}
+	daemon.SetConfigReloader(reloader)
+
+	// SIGHUP reloads the config file
+	hupChan := make(chan os.Signal, 1)
+	go func() {
+		for _ = range hupChan {
+			_, _, err := reloader.ReloadConfig()
+			if err != nil {
+				nsq.NewLogEntry(nil).Errorf("failed to reload config - %s", err.Error())
+			}
+		}
+	}()
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	daemon.LoadMetadata()
+	err = daemon.Start()
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+	<-exitChan
+	daemon.Stop()
+}
+
+// optionsFromFlags returns the nsqd.Options for the current flag values
+func optionsFromFlags() *nsqd.Options {
+	options := nsqd.NewOptions()
+	options.TCPAddress = *tcpAddress
+	options.HTTPAddress = *httpAddress
+	options.LookupdTCPAddresses = lookupdTCPAddrs
+	options.WorkerId = *workerId
+	options.DataPath = *dataPath
+	options.MemQueueSize = *memQueueSize
+	options.MaxBytesPerFile = *maxBytesPerFile
+	options.SyncEvery = *syncEvery
+	options.MsgTimeout = time.Duration(*msgTimeoutMs) * time.Millisecond
+	options.Verbose = *verbose
+	options.DedupWindow = time.Duration(*dedupWindowMs) * time.Millisecond
+	options.DedupMaxKeys = *dedupMaxKeys
+	options.MaxMsgSize = *maxMsgSize
+	options.MaxBodySize = *maxBodySize
+	options.StatsdAddress = *statsdAddress
+	options.StatsdInterval = time.Duration(*statsdInterval) * time.Second
+	return options
+}
@@ -13,6 +13,7 @@ import (
 	"os/signal"
 	"path"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -38,81 +39,57 @@ func init() {
 }
 
 type FileLogger struct {
+	sync.Mutex
 	out        *os.File
 	gzipWriter *gzip.Writer
 	filename   string
-	logChan    chan *Message
 }
 
-type Message struct {
-	*nsq.Message
-	returnChannel chan *nsq.FinishedMessage
-}
+// HandleMessages writes a batch of messages and syncs them to disk before they are FINished
+func (f *FileLogger) HandleMessages(messages []*nsq.Message) []nsq.BatchResult {
+	f.Lock()
+	defer f.Unlock()
 
-type SyncMsg struct {
-	m             *nsq.FinishedMessage
-	returnChannel chan *nsq.FinishedMessage
-}
+	f.updateFile()
+	results := make([]nsq.BatchResult, len(messages))
+	for i, m := range messages {
+		_, err := f.Write(m.Body)
+		if err != nil {
+			log.Fatalf("ERROR: writing message to disk - %s", err.Error())
+		}
+		_, err = f.Write([]byte("\n"))
+		if err != nil {
+			log.Fatalf("ERROR: writing newline to disk - %s", err.Error())
+		}
+		results[i] = nsq.BatchResult{Finish: true}
+	}
 
-func (l *FileLogger) HandleMessage(m *nsq.Message, responseChannel chan *nsq.FinishedMessage) {
-	l.logChan <- &Message{m, responseChannel}
+	log.Printf("syncing %d records to disk", len(messages))
+	err := f.Sync()
+	if err != nil {
+		log.Fatalf("ERROR: failed syncing messages - %s", err.Error())
+	}
+	return results
 }
 
 func router(r *nsq.Reader, f *FileLogger, termChan chan os.Signal, hupChan chan os.Signal) {
-	pos := 0
-	output := make([]*Message, *maxInFlight)
-	sync := false
 	ticker := time.NewTicker(time.Duration(30) * time.Second)
-	closing := false
 
 	for {
 		select {
 		case <-termChan:
 			ticker.Stop()
 			r.Stop()
-			// ensures that we keep flushing whatever is left in the channels
-			closing = true
+			return
 		case <-hupChan:
+			f.Lock()
 			f.Close()
 			f.updateFile()
-			sync = true
+			f.Unlock()
 		case <-ticker.C:
+			f.Lock()
 			f.updateFile()
-			sync = true
-		case m := <-f.logChan:
-			if f.updateFile() {
-				sync = true
-			}
-			_, err := f.Write(m.Body)
-			if err != nil {
-				log.Fatalf("ERROR: writing message to disk - %s", err.Error())
-			}
-			_, err = f.Write([]byte("\n"))
-			if err != nil {
-				log.Fatalf("ERROR: writing newline to disk - %s", err.Error())
-			}
-			output[pos] = m
-			pos++
-			if pos == *maxInFlight {
-				sync = true
-			}
-		}
-
-		if closing || sync || r.IsStarved() {
-			if pos > 0 {
-				log.Printf("syncing %d records to disk", pos)
-				err := f.Sync()
-				if err != nil {
-					log.Fatalf("ERROR: failed syncing messages - %s", err.Error())
-				}
-				for pos > 0 {
-					pos--
-					m := output[pos]
-					m.returnChannel <- &nsq.FinishedMessage{m.Id, 0, true}
-					output[pos] = nil
-				}
-			}
-			sync = false
+			f.Unlock()
 		}
 	}
 }
@@ -214,9 +191,7 @@ func main() {
 	signal.Notify(hupChan, syscall.SIGHUP)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 
-	f := &FileLogger{
-		logChan: make(chan *Message, 1),
-	}
+	f := &FileLogger{}
 
 	r, err := nsq.NewReader(*topic, *channel)
 	if err != nil {
@@ -225,7 +200,8 @@ func main() {
 	r.SetMaxInFlight(*maxInFlight)
 	r.VerboseLogging = *verbose
 
-	r.AddAsyncHandler(f)
+	// batches are synced to disk before they are FINished
+	r.AddBatchHandler(f, *maxInFlight, time.Duration(30)*time.Second)
 	go router(r, f, termChan, hupChan)
 
 	for _, addrString := range nsqdTCPAddrs {
@@ -1,7 +1,6 @@
 package nsq
 
 import (
-	"errors"
 	"fmt"
 	"github.com/bitly/go-simplejson"
 	"io/ioutil"
@@ -39,12 +38,27 @@ func NewDeadlineTransport(timeout time.Duration) *http.Transport {
 	return transport
 }
 
+// ApiError is returned from ApiRequest when the status_code of the response isn't 200
+type ApiError struct {
+	StatusCode int
+	StatusTxt  string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("response status_code == %d (%s)", e.StatusCode, e.StatusTxt)
+}
+
 // ApiRequest is a helper function to perform an HTTP request
 // and parse our NSQ daemon's expected response format, with deadlines.
 //
 //     {"status_code":200, "status_txt":"OK", "data":{...}}
 func ApiRequest(endpoint string) (*simplejson.Json, error) {
-	httpclient := &http.Client{Transport: NewDeadlineTransport(2 * time.Second)}
+	return ApiRequestTimeout(endpoint, 2*time.Second)
+}
+
+// ApiRequestTimeout is ApiRequest with the given deadline for network reads and writes
+func ApiRequestTimeout(endpoint string, timeout time.Duration) (*simplejson.Json, error) {
+	httpclient := &http.Client{Transport: NewDeadlineTransport(timeout)}
 	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		return nil, err
@@ -63,6 +77,9 @@ func ApiRequest(endpoint string) (*simplejson.Json, error) {
 
 	data, err := simplejson.NewJson(body)
 	if err != nil {
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("HTTP response %s", resp.Status)
+		}
 		return nil, err
 	}
 
@@ -71,7 +88,8 @@ func ApiRequest(endpoint string) (*simplejson.Json, error) {
 		return nil, err
 	}
 	if statusCode != 200 {
-		return nil, errors.New(fmt.Sprintf("response status_code == %d", statusCode))
+		statusTxt, _ := data.Get("status_txt").String()
+		return nil, &ApiError{statusCode, statusTxt}
 	}
 	return data.Get("data"), nil
 }
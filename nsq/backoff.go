@@ -0,0 +1,217 @@
+package nsq
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// BackoffState is the state of a Reader's backoff (see Reader.BackoffMultiplier)
+type BackoffState int
+
+const (
+	BackoffNone   BackoffState = iota // consuming at the full max-in-flight
+	BackoffActive                     // waiting with RDY 0 on all connections
+	BackoffProbe                      // RDY 1 on a single connection, waiting for the result
+)
+
+func (s BackoffState) String() string {
+	switch s {
+	case BackoffNone:
+		return "none"
+	case BackoffActive:
+		return "active"
+	case BackoffProbe:
+		return "probe"
+	}
+	return fmt.Sprintf("BackoffState(%d)", int(s))
+}
+
+// MarshalText encodes the state as its String() (ie. in ReaderStats)
+func (s BackoffState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// BackoffState returns the current backoff state of the Reader
+func (q *Reader) BackoffState() BackoffState {
+	q.rdyMtx.Lock()
+	defer q.rdyMtx.Unlock()
+	return q.backoffState
+}
+
+// BackoffLevel returns the current backoff level of the Reader (ie. the number
+// of failures not yet offset by successes)
+func (q *Reader) BackoffLevel() int {
+	q.rdyMtx.Lock()
+	defer q.rdyMtx.Unlock()
+	return q.backoffLevel
+}
+
+// backoffDuration is BackoffMultiplier * 2^(level-1), bounded by MaxBackoffDuration
+func (q *Reader) backoffDuration(level int) time.Duration {
+	return exponentialBackoff(q.BackoffMultiplier, q.MaxBackoffDuration, level)
+}
+
+// exponentialBackoff is multiplier * 2^(level-1), bounded by max
+func exponentialBackoff(multiplier time.Duration, max time.Duration, level int) time.Duration {
+	d := multiplier
+	for i := 1; i < level && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// withJitter adds +/- random 1/10th of d
+func withJitter(d time.Duration) time.Duration {
+	if jitter := int64(d / 10); jitter > 0 {
+		d += time.Duration(rand.Int63n(2*jitter) - jitter)
+	}
+	return d
+}
+
+// updateBackoff updates the backoff state with the result of processing a message.
+//
+// A failure raises the backoff level, a success lowers it.  While the level is above 0
+// the Reader sets RDY 0 on all connections, waits (for an exponentially growing
+// duration, with jitter) and then probes with RDY 1 on a single connection, whose
+// result starts the cycle again.  Results of messages that were in flight before
+// the wait are ignored.
+func (q *Reader) updateBackoff(success bool) {
+	if q.BackoffMultiplier <= 0 {
+		return
+	}
+
+	q.rdyMtx.Lock()
+	if q.backoffState == BackoffActive {
+		q.rdyMtx.Unlock()
+		return
+	}
+
+	if success {
+		if q.backoffLevel == 0 {
+			q.rdyMtx.Unlock()
+			return
+		}
+		q.backoffLevel--
+	} else if q.backoffDuration(q.backoffLevel) < q.MaxBackoffDuration {
+		q.backoffLevel++
+	}
+
+	var delay time.Duration
+	if q.backoffLevel == 0 {
+		q.log(nil).Infof("resuming after backoff")
+		q.backoffState = BackoffNone
+		q.backoffProbeConn = nil
+		for _, c := range q.conns() {
+			q.sendReady(c, q.ConnectionMaxInFlight())
+		}
+	} else {
+		delay = withJitter(q.backoffDuration(q.backoffLevel))
+
+		q.log(nil).With("backoff_level", q.backoffLevel).Infof("backing off for %s", delay)
+		q.backoffState = BackoffActive
+		q.backoffProbeConn = nil
+		q.backoffTimer = time.AfterFunc(delay, q.backoffProbe)
+		for _, c := range q.conns() {
+			q.sendReady(c, 0)
+		}
+	}
+	state, level := q.backoffState, q.backoffLevel
+	q.rdyMtx.Unlock()
+
+	q.backoffStateChanged(state, level, delay)
+}
+
+// backoffProbe sends RDY 1 on a single connection once the backoff wait is over
+func (q *Reader) backoffProbe() {
+	if atomic.LoadInt32(&q.stopFlag) == 1 {
+		return
+	}
+
+	q.rdyMtx.Lock()
+	if q.backoffState != BackoffActive {
+		q.rdyMtx.Unlock()
+		return
+	}
+
+	q.backoffTimer = nil
+	q.backoffProbeConn = nil
+	for _, c := range q.conns() {
+		if atomic.LoadInt32(&c.stopFlag) == 0 {
+			q.backoffProbeConn = c
+			break
+		}
+	}
+	if q.backoffProbeConn == nil {
+		// try again once (re)connected
+		q.backoffTimer = time.AfterFunc(q.backoffDuration(q.backoffLevel), q.backoffProbe)
+		q.rdyMtx.Unlock()
+		return
+	}
+
+	q.log(q.backoffProbeConn).Infof("probing with RDY 1 after backoff")
+	q.backoffState = BackoffProbe
+	q.sendReady(q.backoffProbeConn, 1)
+	level := q.backoffLevel
+	q.rdyMtx.Unlock()
+
+	q.backoffStateChanged(BackoffProbe, level, 0)
+}
+
+// backoffConnClosed probes again if c was the connection being probed
+func (q *Reader) backoffConnClosed(c *nsqConn) {
+	q.rdyMtx.Lock()
+	if q.backoffState != BackoffProbe || q.backoffProbeConn != c {
+		q.rdyMtx.Unlock()
+		return
+	}
+	q.backoffState = BackoffActive
+	q.backoffProbeConn = nil
+	q.rdyMtx.Unlock()
+
+	q.backoffProbe()
+}
+
+func (q *Reader) stopBackoff() {
+	q.rdyMtx.Lock()
+	defer q.rdyMtx.Unlock()
+	if q.backoffTimer != nil {
+		q.backoffTimer.Stop()
+		q.backoffTimer = nil
+	}
+}
+
+func (q *Reader) backoffStateChanged(state BackoffState, level int, delay time.Duration) {
+	if q.BackoffStateChanged != nil {
+		q.BackoffStateChanged(state, level, delay)
+	}
+}
+
+// sendReady sets the RDY count of c, the caller must hold rdyMtx
+func (q *Reader) sendReady(c *nsqConn, count int) error {
+	var buf bytes.Buffer
+
+	if atomic.LoadInt32(&c.stopFlag) != 0 {
+		return nil
+	}
+
+	if int64(count) > c.maxRdyCount {
+		count = int(c.maxRdyCount)
+	}
+
+	atomic.StoreInt64(&c.rdyCount, int64(count))
+	if count > 0 {
+		atomic.StoreInt64(&c.lastRdyTime, time.Now().UnixNano())
+	}
+	err := c.sendCommand(&buf, Ready(count))
+	if err != nil {
+		handleError(q, c, "error sending RDY %d - %s", count, err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package nsq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// BatchHandler is the batching interface to Reader.
+//
+// HandleMessages receives up to batchSize messages (see AddBatchHandler) and returns
+// a BatchResult for each of them, in the same order.
+type BatchHandler interface {
+	HandleMessages(messages []*Message) []BatchResult
+}
+
+// BatchResult is the result of processing a message of a batch
+type BatchResult struct {
+	Finish       bool          // FINish the message, otherwise it is REQueued
+	RequeueDelay time.Duration // the delay when REQueueing (0 uses the Reader's default delay)
+	Err          error         // why the message failed (optional, see FailedMessage)
+}
+
+// AddBatchHandler adds a BatchHandler for messages received by this Reader.
+//
+// A batch is handled once it has batchSize messages, maxWait after its first message,
+// as soon as a connection is starved (ie. no more messages will be received over it
+// until some are responded to, see batchStarved) or when the Reader is stopping.
+// Max-in-flight should therefore be at least batchSize.
+//
+// It's ok to start more than one handler simultaneously, they
+// are concurrently executed in goroutines.
+func (q *Reader) AddBatchHandler(handler BatchHandler, batchSize int, maxWait time.Duration) {
+	if q.MaxInFlight() < batchSize {
+		q.log(nil).Warnf("max-in-flight %d < batch size %d, batches will be smaller", q.MaxInFlight(), batchSize)
+	}
+
+	atomic.AddInt32(&q.runningHandlers, 1)
+	q.log(nil).Infof("starting BatchHandler go-routine")
+	go func() {
+		var batch []*incomingMessage
+		var timeout <-chan time.Time
+		stopping := q.stopCtx.Done()
+		for {
+			select {
+			case <-q.handlerExitChan:
+				if len(batch) > 0 {
+					q.handleBatch(handler, batch)
+				}
+				q.log(nil).Infof("closing BatchHandler (after handlerExitChan closed)")
+				if atomic.AddInt32(&q.runningHandlers, -1) == 0 {
+					q.ExitChan <- 1
+				}
+				return
+			case message := <-q.incomingMessages:
+				batch = append(batch, message)
+				if len(batch) == 1 {
+					timeout = time.After(maxWait)
+				}
+				if len(batch) < batchSize && stopping != nil && !q.batchStarved() {
+					continue
+				}
+			case <-timeout:
+			case <-stopping:
+				// handle messages without waiting from now on
+				stopping = nil
+				if len(batch) == 0 {
+					continue
+				}
+			}
+
+			q.handleBatch(handler, batch)
+			batch = nil
+			timeout = nil
+		}
+	}()
+}
+
+// batchStarved indicates whether a connection with messages in flight is blocked until
+// some of them are responded to, ie. it has a connection's max-in-flight messages in
+// flight or used up its RDY count.  Unlike IsStarved, idle connections with a RDY count
+// of 0 (ie. during backoff or RDY rotation) are ignored.
+func (q *Reader) batchStarved() bool {
+	mif := int64(q.ConnectionMaxInFlight())
+	for _, c := range q.conns() {
+		inFlight := atomic.LoadInt64(&c.messagesInFlight)
+		if inFlight > 0 && (inFlight >= mif || atomic.LoadInt64(&c.rdyCount) <= 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Reader) handleBatch(handler BatchHandler, batch []*incomingMessage) {
+	messages := make([]*Message, len(batch))
+	for i, message := range batch {
+		messages[i] = message.Message
+	}
+
+	start := time.Now()
+	results := handler.HandleMessages(messages)
+	q.handlerLatency.observe(time.Since(start))
+	if len(results) != len(batch) {
+		q.log(nil).Errorf("batch handler returned %d results for %d messages", len(results), len(batch))
+	}
+
+	for i, message := range batch {
+		var result BatchResult
+		if i < len(results) {
+			result = results[i]
+		}
+
+		if result.Finish {
+			message.responseChannel <- &FinishedMessage{message.Id, 0, true}
+			continue
+		}
+
+		// message passed the max number of attempts
+		if q.MaxAttemptCount > 0 && message.Attempts > q.MaxAttemptCount {
+			q.giveUp(handler, message, result.Err)
+			continue
+		}
+
+		requeueDelay := result.RequeueDelay
+		if requeueDelay == 0 {
+			requeueDelay = q.requeueDelay(message.Message)
+		}
+		message.responseChannel <- &FinishedMessage{message.Id, int(requeueDelay / time.Millisecond), false}
+	}
+}
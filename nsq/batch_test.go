@@ -0,0 +1,179 @@
+package nsq
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type BatchTestHandler struct {
+	sync.Mutex
+	q          *Reader
+	batchSizes []int
+	finished   int
+	requeued   int
+	expected   int
+}
+
+func (h *BatchTestHandler) HandleMessages(messages []*Message) []BatchResult {
+	h.Lock()
+	defer h.Unlock()
+
+	h.batchSizes = append(h.batchSizes, len(messages))
+	results := make([]BatchResult, len(messages))
+	for i, message := range messages {
+		if string(message.Body) == "fail" && message.Attempts == 1 {
+			results[i] = BatchResult{RequeueDelay: 10 * time.Millisecond}
+			h.requeued++
+			continue
+		}
+		results[i] = BatchResult{Finish: true}
+		h.finished++
+	}
+	if h.finished == h.expected {
+		go h.q.Stop()
+	}
+	return results
+}
+
+func TestReaderBatchHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_batch_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.SetMaxInFlight(10)
+	h := &BatchTestHandler{q: q, expected: 5}
+	q.AddBatchHandler(h, 3, 50*time.Millisecond)
+
+	SendMessage(t, 4151, topicName, "mput", []byte("1\n2\n3\n4\nfail"))
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-q.ExitChan
+
+	h.Lock()
+	defer h.Unlock()
+	for _, size := range h.batchSizes {
+		if size > 3 {
+			t.Fatalf("batch sizes %v larger than 3", h.batchSizes)
+		}
+	}
+	if h.batchSizes[0] != 3 || h.requeued != 1 {
+		t.Fatalf("unexpected batches %v (%d REQ)", h.batchSizes, h.requeued)
+	}
+}
+
+func TestReaderBatchHandlerMaxInFlight(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_batch_mif_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.SetMaxInFlight(2)
+	h := &BatchTestHandler{q: q, expected: 4}
+	// batches are limited by max-in-flight rather than the batch size
+	q.AddBatchHandler(h, 10, 100*time.Millisecond)
+
+	SendMessage(t, 4151, topicName, "mput", []byte("1\n2\n3\n4"))
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case <-q.ExitChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for batches")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	for _, size := range h.batchSizes {
+		if size > 2 {
+			t.Fatalf("batch sizes %v larger than max-in-flight", h.batchSizes)
+		}
+	}
+}
+
+func TestReaderBatchHandlerStarved(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_batch_starved" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.SetMaxInFlight(10)
+	h := &BatchTestHandler{q: q, expected: -1}
+	q.AddBatchHandler(h, 10, time.Minute)
+
+	// an idle connection halves the max-in-flight of the nsqd connection
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+	AddTestConn(q, client, "idle:4150")
+
+	SendMessage(t, 4151, topicName, "mput", []byte("1\n2\n3\n4\n5\n6\n7"))
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// the batch is handled once the nsqd connection is starved, while the Reader has
+	// less than max-in-flight messages in flight
+	waitFor(t, "the first batch", func() bool {
+		h.Lock()
+		defer h.Unlock()
+		return len(h.batchSizes) > 0
+	})
+	h.Lock()
+	if h.batchSizes[0] != 5 {
+		t.Fatalf("unexpected batches %v", h.batchSizes)
+	}
+	h.Unlock()
+
+	RemoveTestConn(q, "idle:4150")
+	q.Stop()
+	<-q.ExitChan
+}
+
+func TestReaderBatchHandlerStop(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_batch_stop_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.SetMaxInFlight(10)
+	h := &BatchTestHandler{q: q, expected: -1}
+	q.AddBatchHandler(h, 10, time.Minute)
+
+	SendMessage(t, 4151, topicName, "mput", []byte("1\n2\n3"))
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for atomic.LoadUint64(&q.MessagesReceived) < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the partial batch is handled on stop rather than after maxWait
+	q.Stop()
+	select {
+	case <-q.ExitChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the partial batch")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if len(h.batchSizes) != 1 || h.batchSizes[0] != 3 {
+		t.Fatalf("unexpected batches %v", h.batchSizes)
+	}
+}
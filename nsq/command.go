@@ -78,6 +78,7 @@ func (c *Command) Write(w io.Writer) error {
 //     short_id - short identifier, typically client's short hosname
 //     long_id - long identifier, typically client's long hostname
 //     buffer_size - size in bytes for nsqd to buffer before writing to the wire for this client
+//     message_headers - (bool) receive messages (with headers) in the MsgFormatV2 format
 //
 // nsqlookupd currently supports the following keys:
 //
@@ -111,6 +112,18 @@ func UnRegister(topic string, channel string) *Command {
 	return &Command{[]byte("UNREGISTER"), params, nil}
 }
 
+// Pause creates a new Command to mark a topic as paused for the connected nsqd
+func Pause(topic string) *Command {
+	var params = [][]byte{[]byte(topic)}
+	return &Command{[]byte("PAUSE"), params, nil}
+}
+
+// UnPause creates a new Command to mark a topic as no longer paused for the connected nsqd
+func UnPause(topic string) *Command {
+	var params = [][]byte{[]byte(topic)}
+	return &Command{[]byte("UNPAUSE"), params, nil}
+}
+
 // Ping creates a new Command to keep-alive the state of all the 
 // announced topic/channels for a given client
 func Ping() *Command {
@@ -123,6 +136,30 @@ func Publish(topic string, body []byte) *Command {
 	return &Command{[]byte("PUB"), params, body}
 }
 
+// PublishWithDedupKey creates a new Command to write a message to a given topic,
+// nsqd acknowledges (but does not enqueue) a retried publish with the same dedup key
+func PublishWithDedupKey(topic string, dedupKey string, body []byte) *Command {
+	var params = [][]byte{[]byte(topic), []byte(dedupKey)}
+	return &Command{[]byte("PUB"), params, body}
+}
+
+// PublishWithHeaders creates a new Command to write a message with headers to a given topic
+func PublishWithHeaders(topic string, headers map[string]string, body []byte) (*Command, error) {
+	var params = [][]byte{[]byte(topic)}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(body)+2))
+	err := WriteHeaders(buf, headers)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Command{[]byte("HPUB"), params, buf.Bytes()}, nil
+}
+
 // MultiPublish creates a new Command to write more than one message to a given topic.
 // This is useful for high-throughput situations to avoid roundtrips and saturate the pipe.
 func MultiPublish(topic string, bodies [][]byte) (*Command, error) {
@@ -154,6 +191,17 @@ func MultiPublish(topic string, bodies [][]byte) (*Command, error) {
 	return &Command{[]byte("MPUB"), params, buf.Bytes()}, nil
 }
 
+// MultiPublishWithDedupKey creates a new Command to write more than one message to a
+// given topic, the dedup key covers the batch (see PublishWithDedupKey)
+func MultiPublishWithDedupKey(topic string, dedupKey string, bodies [][]byte) (*Command, error) {
+	cmd, err := MultiPublish(topic, bodies)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Params = append(cmd.Params, []byte(dedupKey))
+	return cmd, nil
+}
+
 // Subscribe creates a new Command to subscribe to the given topic/channel
 func Subscribe(topic string, channel string) *Command {
 	var params = [][]byte{[]byte(topic), []byte(channel)}
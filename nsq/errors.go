@@ -1,24 +1,35 @@
 package nsq
 
+import (
+	"strings"
+)
+
 // ClientErr provides a way for NSQ daemons to log a human reabable
-// error string and return a machine readable string to the client.
+// error string and return a machine readable string to the client,
+// one of the following codes (optionally followed by a detail, ie.
+// E_BAD_BODY message 2 for the invalid message of an MPUB batch):
 //
 //     E_INVALID
 //     E_BAD_PROTOCOL
 //     E_BAD_TOPIC
 //     E_BAD_CHANNEL
 //     E_BAD_BODY
+//     E_BAD_DEDUP_KEY
 //     E_REQ_FAILED
 //     E_FIN_FAILED
 //     E_PUT_FAILED
 //     E_MISSING_PARAMS
 type ClientErr struct {
-	Err  string
-	Desc string
+	Err    string
+	Desc   string
+	Detail string
 }
 
 // Error returns the machine readable form
 func (e *ClientErr) Error() string {
+	if e.Detail != "" {
+		return e.Err + " " + e.Detail
+	}
 	return e.Err
 }
 
@@ -29,5 +40,20 @@ func (e *ClientErr) Description() string {
 
 // NewClientErr creates a ClientErr with the supplied human and machine readable strings
 func NewClientErr(err string, description string) *ClientErr {
-	return &ClientErr{err, description}
+	return &ClientErr{Err: err, Desc: description}
+}
+
+// NewClientErrDetail creates a ClientErr whose machine readable code is followed by detail
+func NewClientErrDetail(err string, detail string, description string) *ClientErr {
+	return &ClientErr{Err: err, Desc: description, Detail: detail}
+}
+
+// ParseClientErr creates a ClientErr from the data of an error frame,
+// ie. E_BAD_BODY message 2 has the code E_BAD_BODY and the detail message 2
+func ParseClientErr(data []byte, description string) *ClientErr {
+	parts := strings.SplitN(string(data), " ", 2)
+	if len(parts) == 2 {
+		return NewClientErrDetail(parts[0], parts[1], description)
+	}
+	return NewClientErr(parts[0], description)
 }
@@ -0,0 +1,67 @@
+package nsq
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// helpers for tests in package nsq_test (which can import util without a cycle)
+
+// AddTestConn adds a connection over conn to q without starting its loops
+func AddTestConn(q *Reader, conn net.Conn, addr string) {
+	c := &nsqConn{
+		Conn:             conn,
+		r:                bufio.NewReader(conn),
+		addr:             addr,
+		finishedMessages: make(chan *FinishedMessage),
+		readTimeout:      time.Second,
+		writeTimeout:     time.Second,
+		dying:            make(chan struct{}, 1),
+		drainReady:       make(chan struct{}),
+		maxRdyCount:      MaxReadyCount,
+	}
+	q.connMtx.Lock()
+	q.nsqConnections[addr] = c
+	q.connMtx.Unlock()
+}
+
+func testConn(q *Reader, addr string) *nsqConn {
+	q.connMtx.RLock()
+	defer q.connMtx.RUnlock()
+	return q.nsqConnections[addr]
+}
+
+// RemoveTestConn closes a connection added with AddTestConn
+func RemoveTestConn(q *Reader, addr string) {
+	q.stopFinishLoop(testConn(q, addr))
+}
+
+// ReceiveTestMessage accounts for a message received on addr (as readLoop does)
+func ReceiveTestMessage(q *Reader, addr string) {
+	c := testConn(q, addr)
+	q.rdyMtx.Lock()
+	if atomic.LoadInt64(&c.rdyCount) > 0 {
+		atomic.AddInt64(&c.rdyCount, -1)
+		atomic.StoreInt64(&c.lastMsgTime, time.Now().UnixNano())
+	}
+	q.rdyMtx.Unlock()
+	q.updateReady(c)
+}
+
+func ConnRDY(q *Reader, addr string) int64 {
+	return atomic.LoadInt64(&testConn(q, addr).rdyCount)
+}
+
+func UpdateReady(q *Reader, addr string) {
+	q.updateReady(testConn(q, addr))
+}
+
+func RotateRDY(q *Reader) {
+	q.rotateRDY()
+}
+
+func TotalRdyCount(q *Reader) int64 {
+	return q.totalRdyCount()
+}
@@ -0,0 +1,256 @@
+package nsq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The Message headers added by TopicFailedMessageSink to the messages it republishes
+const (
+	FailedTopicHeader     = "failed_topic"
+	FailedChannelHeader   = "failed_channel"
+	FailedAttemptsHeader  = "failed_attempts"
+	FailedErrorHeader     = "failed_error"
+	FailedMessageIdHeader = "failed_message_id"
+)
+
+// FailedMessage is a message that exceeded the MaxAttemptCount of a Reader
+type FailedMessage struct {
+	Message *Message
+	Topic   string
+	Channel string
+	Err     string // the error of the last attempt ("" if unknown, ie. for an AsyncHandler)
+}
+
+// FailedMessageSink persists the messages of a Reader that exceeded its MaxAttemptCount
+// (see Reader.FailedMessageSink).
+//
+// A message is FINished once WriteFailedMessage returns nil, otherwise it is REQueued
+// (and passed to the sink again when it is next received).
+type FailedMessageSink interface {
+	WriteFailedMessage(msg *FailedMessage) error
+}
+
+// giveUp handles a message that exceeded MaxAttemptCount (err is the error of its last
+// attempt, if known).  It is passed to the FailedMessageLogger (if implemented by
+// handler) and the FailedMessageSink of the Reader, then FINished (or REQueued when
+// the sink fails).
+func (q *Reader) giveUp(handler interface{}, message *incomingMessage, err error) {
+	q.log(nil).Warnf("msg attempted %d times. giving up %s %s", message.Attempts, message.Id, message.Body)
+	logger, ok := handler.(FailedMessageLogger)
+	if ok {
+		logger.LogFailedMessage(message.Message)
+	}
+
+	if q.FailedMessageSink != nil {
+		failed := &FailedMessage{
+			Message: message.Message,
+			Topic:   q.TopicName,
+			Channel: q.ChannelName,
+		}
+		if err != nil {
+			failed.Err = err.Error()
+		}
+		sinkErr := q.FailedMessageSink.WriteFailedMessage(failed)
+		if sinkErr != nil {
+			q.logError(nil, "failed to persist failed msg %s - %s", message.Id, sinkErr.Error())
+			requeueDelay := q.requeueDelay(message.Message)
+			message.responseChannel <- &FinishedMessage{message.Id, int(requeueDelay / time.Millisecond), false}
+			return
+		}
+	}
+
+	message.responseChannel <- &FinishedMessage{message.Id, 0, true}
+}
+
+// failedMessageRecord is a line of a FileFailedMessageSink
+type failedMessageRecord struct {
+	Id        string            `json:"id"`
+	Timestamp int64             `json:"timestamp"`
+	Attempts  uint16            `json:"attempts"`
+	Topic     string            `json:"topic"`
+	Channel   string            `json:"channel"`
+	Err       string            `json:"error"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      []byte            `json:"body"`
+}
+
+// FileFailedMessageSink is a FailedMessageSink appending failed messages to a file,
+// one JSON object per line (the body is base64 encoded), ie.
+//
+//     {"id":"063e6e0ae7cbe000","timestamp":1370000000000000000,"attempts":6,"topic":"test","channel":"ch","error":"...","body":"aGVsbG8="}
+//
+// Once the file reaches maxBytes it is rotated, path is renamed to path.1 (path.1 to
+// path.2 and so on, up to maxBackups, none are kept when maxBackups is 0).
+type FileFailedMessageSink struct {
+	sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// NewFileFailedMessageSink opens (or creates) the file at path, maxBytes 0 disables
+// rotation
+func NewFileFailedMessageSink(path string, maxBytes int64, maxBackups int) (*FileFailedMessageSink, error) {
+	s := &FileFailedMessageSink{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileFailedMessageSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = fi.Size()
+	return nil
+}
+
+// rotate renames the current file (keeping up to maxBackups) and opens a new one
+func (s *FileFailedMessageSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			err = os.Rename(s.backupPath(i), s.backupPath(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(s.path, s.backupPath(1))
+	} else {
+		err = os.Remove(s.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *FileFailedMessageSink) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+func (s *FileFailedMessageSink) WriteFailedMessage(msg *FailedMessage) error {
+	line, err := json.Marshal(failedMessageRecord{
+		Id:        string(msg.Message.Id[:]),
+		Timestamp: msg.Message.Timestamp,
+		Attempts:  msg.Message.Attempts,
+		Topic:     msg.Topic,
+		Channel:   msg.Channel,
+		Err:       msg.Err,
+		Headers:   msg.Message.Headers,
+		Body:      msg.Message.Body,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.f == nil {
+		// a previous rotation failed
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		err = s.rotate()
+		if err != nil {
+			return fmt.Errorf("failed to rotate %s - %s", s.path, err.Error())
+		}
+	}
+
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Close closes the file
+func (s *FileFailedMessageSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// TopicFailedMessageSink is a FailedMessageSink republishing failed messages to a
+// topic, with their headers and the Failed*Header headers (which requires nsqd
+// support for message headers)
+type TopicFailedMessageSink struct {
+	topic     string
+	publisher *publisher
+}
+
+// NewTopicFailedMessageSink returns a TopicFailedMessageSink publishing to topic on
+// the nsqd at addr (TCP), it connects on demand
+func NewTopicFailedMessageSink(addr string, topic string) (*TopicFailedMessageSink, error) {
+	if !IsValidTopicName(topic) {
+		return nil, errors.New("invalid topic name")
+	}
+	return &TopicFailedMessageSink{
+		topic:     topic,
+		publisher: newPublisher(addr),
+	}, nil
+}
+
+func (s *TopicFailedMessageSink) WriteFailedMessage(msg *FailedMessage) error {
+	headers := make(map[string]string, len(msg.Message.Headers)+5)
+	for k, v := range msg.Message.Headers {
+		headers[k] = v
+	}
+	headers[FailedTopicHeader] = msg.Topic
+	headers[FailedChannelHeader] = msg.Channel
+	headers[FailedAttemptsHeader] = strconv.Itoa(int(msg.Message.Attempts))
+	headers[FailedMessageIdHeader] = string(msg.Message.Id[:])
+	if msg.Err != "" {
+		headers[FailedErrorHeader] = msg.Err
+	}
+
+	cmd, err := PublishWithHeaders(s.topic, headers, msg.Message.Body)
+	if err != nil {
+		return err
+	}
+	return s.publisher.publish(cmd)
+}
+
+// Stop closes the connection to nsqd
+func (s *TopicFailedMessageSink) Stop() {
+	s.publisher.Lock()
+	defer s.publisher.Unlock()
+	s.publisher.close()
+}
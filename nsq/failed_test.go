@@ -0,0 +1,177 @@
+package nsq
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileFailedMessageSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-failed")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "failed.log")
+	sink, err := NewFileFailedMessageSink(path, 300, 2)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 4; i++ {
+		msg := NewMessage(MessageID{'0', '1'}, []byte("body"+strconv.Itoa(i)))
+		msg.Attempts = 6
+		err = sink.WriteFailedMessage(&FailedMessage{msg, "test", "ch", "failed " + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	sink.Close()
+
+	// ~180 bytes per line, one per file, the first was rotated out
+	for p, expected := range map[string]string{path: "body3", path + ".1": "body2", path + ".2": "body1"} {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		var record failedMessageRecord
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			err = json.Unmarshal(scanner.Bytes(), &record)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+		f.Close()
+		if string(record.Body) != expected || record.Attempts != 6 || record.Topic != "test" ||
+			record.Err != "failed "+expected[4:] {
+			t.Fatalf("unexpected record %+v in %s", record, p)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("more than 2 backups")
+	}
+}
+
+// FailingTestHandler fails every message, the failed messages are passed to its sink
+// (which fails the first time)
+type FailingTestHandler struct {
+	sync.Mutex
+	failed     []*FailedMessage
+	sinkErrors int
+}
+
+func (h *FailingTestHandler) HandleMessage(message *Message) error {
+	return errors.New("always fails")
+}
+
+func (h *FailingTestHandler) WriteFailedMessage(msg *FailedMessage) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.sinkErrors == 0 {
+		h.sinkErrors++
+		return errors.New("sink unavailable")
+	}
+	h.failed = append(h.failed, msg)
+	return nil
+}
+
+func (h *FailingTestHandler) Failed() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.failed)
+}
+
+func TestReaderFailedMessageSink(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_failed_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.MaxAttemptCount = 1
+	q.DefaultRequeueDelay = 10 * time.Millisecond
+	h := &FailingTestHandler{}
+	q.FailedMessageSink = h
+	q.AddHandler(h)
+
+	SendMessage(t, 4151, topicName, "put", []byte("fail"))
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// attempt 2 is given up but the sink fails, attempt 3 is persisted
+	waitFor(t, "the failed message", func() bool { return h.Failed() == 1 })
+	waitFor(t, "the FIN", func() bool { return q.Stats().MessagesFinished == 1 })
+	h.Lock()
+	failed := h.failed[0]
+	h.Unlock()
+	if failed.Message.Attempts != 3 || failed.Topic != topicName || failed.Channel != "ch" ||
+		failed.Err != "always fails" || string(failed.Message.Body) != "fail" {
+		t.Fatalf("unexpected failed message %+v", failed)
+	}
+	if q.Stats().MessagesRequeued != 2 {
+		t.Fatalf("unexpected REQ count %d", q.Stats().MessagesRequeued)
+	}
+
+	q.Stop()
+	<-q.ExitChan
+}
+
+func TestTopicFailedMessageSink(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "failed_pub_test" + strconv.Itoa(int(time.Now().Unix()))
+	sink, err := NewTopicFailedMessageSink("127.0.0.1:4150", topicName+"_failed")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer sink.Stop()
+
+	q, _ := NewReader(topicName, "ch")
+	q.MaxAttemptCount = 1
+	q.DefaultRequeueDelay = 10 * time.Millisecond
+	q.FailedMessageSink = sink
+	q.AddHandler(&FailingTestHandler{})
+
+	failedQ, _ := NewReader(topicName+"_failed", "ch")
+	failedQ.MessageHeaders = true
+	received := make(chan *Message, 1)
+	failedQ.AddHandler(HandlerFunc(func(message *Message) error {
+		received <- message
+		return nil
+	}))
+
+	SendMessage(t, 4151, topicName, "put", []byte("fail"))
+	for _, r := range []*Reader{q, failedQ} {
+		err = r.ConnectToNSQ("127.0.0.1:4150")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	select {
+	case msg := <-received:
+		if string(msg.Body) != "fail" || msg.Headers[FailedTopicHeader] != topicName ||
+			msg.Headers[FailedChannelHeader] != "ch" || msg.Headers[FailedAttemptsHeader] != "2" ||
+			msg.Headers[FailedErrorHeader] != "always fails" {
+			t.Fatalf("unexpected republished message %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the republished message")
+	}
+
+	q.Stop()
+	<-q.ExitChan
+	failedQ.Stop()
+	<-failedQ.ExitChan
+}
@@ -0,0 +1,288 @@
+package nsq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LogLevel is the severity of a log message
+type LogLevel int32
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel parses a level name (debug, info, warn or error)
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	}
+	return LogLevelInfo, fmt.Errorf("invalid log level %q", s)
+}
+
+// Fields are the structured context of a log message, ie. {"topic": "foo"}
+type Fields map[string]interface{}
+
+// Logger is the logging interface of the nsq client and daemons.
+//
+// Implementations are responsible for filtering by level and must be safe for
+// concurrent use.  A Logger that has a Level() LogLevel method (like StdLogger)
+// isn't called, and the message isn't formatted, below that level.
+type Logger interface {
+	Log(level LogLevel, msg string, fields Fields)
+}
+
+type leveler interface {
+	Level() LogLevel
+}
+
+// the log formats of StdLogger
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// StdLogger is a Logger writing messages at or above its level as text, ie.
+//
+//     2013/01/02 15:04:05 INFO: connecting to nsqd addr=127.0.0.1:4150
+//
+// or, in the json format, one object per line with "time", "level" and "msg" keys
+// in addition to the fields
+type StdLogger struct {
+	level  int32
+	format string
+	out    *log.Logger // nil uses the log package's standard logger
+}
+
+// NewLogger returns a StdLogger writing to w (nil writes to the log package's
+// standard logger) in format (text or json)
+func NewLogger(w io.Writer, level LogLevel, format string) (*StdLogger, error) {
+	if format != LogFormatText && format != LogFormatJSON {
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	l := &StdLogger{
+		level:  int32(level),
+		format: format,
+	}
+	if w != nil {
+		flags := log.LstdFlags
+		if format == LogFormatJSON {
+			flags = 0
+		}
+		l.out = log.New(w, "", flags)
+	}
+	return l, nil
+}
+
+// Level returns the minimum level that is logged
+func (l *StdLogger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel changes the minimum level that is logged
+func (l *StdLogger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *StdLogger) Log(level LogLevel, msg string, fields Fields) {
+	if level < l.Level() {
+		return
+	}
+
+	var line string
+	if l.format == LogFormatJSON {
+		entry := make(map[string]interface{}, len(fields)+3)
+		for k, v := range fields {
+			switch t := v.(type) {
+			case error:
+				v = t.Error()
+			case fmt.Stringer:
+				v = t.String()
+			}
+			entry[k] = v
+		}
+		entry["time"] = time.Now().Format(time.RFC3339Nano)
+		entry["level"] = level.String()
+		entry["msg"] = msg
+		data, err := json.Marshal(entry)
+		if err != nil {
+			data, _ = json.Marshal(map[string]interface{}{
+				"time":  entry["time"],
+				"level": level.String(),
+				"msg":   fmt.Sprintf("%s (failed to marshal fields - %s)", msg, err.Error()),
+			})
+		}
+		line = string(data)
+	} else {
+		line = strings.ToUpper(level.String()) + ": " + msg + formatFields(fields)
+	}
+
+	if l.out == nil {
+		if l.format == LogFormatJSON {
+			log.New(log.Writer(), "", 0).Print(line)
+			return
+		}
+		log.Print(line)
+		return
+	}
+	l.out.Print(line)
+}
+
+// formatFields returns fields as " key=value" pairs, sorted by key
+func formatFields(fields Fields) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		v := fmt.Sprint(fields[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, v)
+	}
+	return b.String()
+}
+
+var logger atomic.Value
+
+func init() {
+	SetLogger(nil)
+}
+
+// SetLogger replaces the Logger used by the nsq packages (and daemons) when no
+// other Logger is configured.
+//
+// The default (also restored by SetLogger(nil)) is a text StdLogger at the info
+// level writing to the log package's standard logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l, _ = NewLogger(nil, LogLevelInfo, LogFormatText)
+	}
+	logger.Store(loggerHolder{l})
+}
+
+// GetLogger returns the Logger set via SetLogger
+func GetLogger() Logger {
+	return logger.Load().(loggerHolder).Logger
+}
+
+// loggerHolder gives the atomic.Value a consistent concrete type
+type loggerHolder struct {
+	Logger
+}
+
+// VerboseLogger returns a Logger logging the debug messages of l at the info level
+func VerboseLogger(l Logger) Logger {
+	return verboseLogger{l}
+}
+
+type verboseLogger struct {
+	Logger
+}
+
+func (l verboseLogger) Level() LogLevel {
+	lv, ok := l.Logger.(leveler)
+	if !ok || lv.Level() <= LogLevelInfo {
+		return LogLevelDebug
+	}
+	return lv.Level()
+}
+
+func (l verboseLogger) Log(level LogLevel, msg string, fields Fields) {
+	if level == LogLevelDebug {
+		level = LogLevelInfo
+	}
+	l.Logger.Log(level, msg, fields)
+}
+
+// LogEntry logs printf style messages with a fixed set of fields
+type LogEntry struct {
+	Logger  Logger // nil uses GetLogger()
+	keyvals []interface{}
+}
+
+// NewLogEntry returns a LogEntry for logger (nil uses GetLogger()) with fields
+// from alternating key/value pairs
+func NewLogEntry(logger Logger, keyvals ...interface{}) LogEntry {
+	return LogEntry{Logger: logger}.With(keyvals...)
+}
+
+// With returns a copy of e with the additional fields from alternating key/value pairs
+func (e LogEntry) With(keyvals ...interface{}) LogEntry {
+	kv := make([]interface{}, 0, len(e.keyvals)+len(keyvals))
+	kv = append(append(kv, e.keyvals...), keyvals...)
+	return LogEntry{Logger: e.Logger, keyvals: kv}
+}
+
+// Fields returns the fields of e
+func (e LogEntry) Fields() Fields {
+	fields := make(Fields, len(e.keyvals)/2)
+	for i := 0; i+1 < len(e.keyvals); i += 2 {
+		fields[fmt.Sprint(e.keyvals[i])] = e.keyvals[i+1]
+	}
+	return fields
+}
+
+func (e LogEntry) logf(level LogLevel, format string, args []interface{}) {
+	l := e.Logger
+	if l == nil {
+		l = GetLogger()
+	}
+	if lv, ok := l.(leveler); ok && level < lv.Level() {
+		return
+	}
+	l.Log(level, fmt.Sprintf(format, args...), e.Fields())
+}
+
+func (e LogEntry) Debugf(format string, args ...interface{}) {
+	e.logf(LogLevelDebug, format, args)
+}
+
+func (e LogEntry) Infof(format string, args ...interface{}) {
+	e.logf(LogLevelInfo, format, args)
+}
+
+func (e LogEntry) Warnf(format string, args ...interface{}) {
+	e.logf(LogLevelWarn, format, args)
+}
+
+func (e LogEntry) Errorf(format string, args ...interface{}) {
+	e.logf(LogLevelError, format, args)
+}
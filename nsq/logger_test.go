@@ -0,0 +1,112 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/bmizerany/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testLogEntry struct {
+	level  LogLevel
+	msg    string
+	fields Fields
+}
+
+type testLogger struct {
+	sync.Mutex
+	entries []testLogEntry
+}
+
+func (l *testLogger) Log(level LogLevel, msg string, fields Fields) {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, testLogEntry{level, msg, fields})
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LogLevelInfo, LogFormatText)
+	assert.Equal(t, err, nil)
+
+	e := NewLogEntry(logger, "topic", "test", "addr", "127.0.0.1:4150")
+	e.Debugf("not logged")
+	e.With("reason", "two words").Warnf("backing off for %s", "1s")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(lines), 1)
+	assert.Equal(t, strings.HasSuffix(lines[0],
+		` WARN: backing off for 1s addr=127.0.0.1:4150 reason="two words" topic=test`), true)
+
+	buf.Reset()
+	logger.SetLevel(LogLevelDebug)
+	e.Debugf("logged")
+	assert.Equal(t, strings.Contains(buf.String(), "DEBUG: logged"), true)
+
+	_, err = NewLogger(&buf, LogLevelInfo, "xml")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LogLevelDebug, LogFormatJSON)
+	assert.Equal(t, err, nil)
+
+	NewLogEntry(logger, "topic", "test", "count", 3, "err", errors.New("EOF")).Errorf("failed")
+
+	var entry map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &entry)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entry["level"], "error")
+	assert.Equal(t, entry["msg"], "failed")
+	assert.Equal(t, entry["topic"], "test")
+	assert.Equal(t, entry["count"], float64(3))
+	assert.Equal(t, entry["err"], "EOF")
+	assert.NotEqual(t, entry["time"], nil)
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError} {
+		parsed, err := ParseLogLevel(strings.ToUpper(level.String()))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, parsed, level)
+	}
+	_, err := ParseLogLevel("loud")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestVerboseLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := NewLogger(&buf, LogLevelInfo, LogFormatText)
+
+	NewLogEntry(VerboseLogger(logger)).Debugf("promoted")
+	assert.Equal(t, strings.Contains(buf.String(), "INFO: promoted"), true)
+
+	buf.Reset()
+	logger.SetLevel(LogLevelWarn)
+	NewLogEntry(VerboseLogger(logger)).Debugf("filtered")
+	assert.Equal(t, buf.Len(), 0)
+}
+
+func TestReaderLogger(t *testing.T) {
+	logger := &testLogger{}
+	q, _ := NewReader("reader_logger_test", "ch")
+	q.Logger = logger
+
+	q.SetMaxInFlight(MaxReadyCount + 1)
+	q.log(nil).Debugf("debug")
+	q.VerboseLogging = true
+	q.log(nil).Debugf("verbose")
+
+	logger.Lock()
+	defer logger.Unlock()
+	assert.Equal(t, len(logger.entries), 3)
+	assert.Equal(t, logger.entries[0].level, LogLevelWarn)
+	assert.Equal(t, logger.entries[0].fields, Fields{"topic": "reader_logger_test", "channel": "ch"})
+	// a Logger without a Level method receives every message
+	assert.Equal(t, logger.entries[1].level, LogLevelDebug)
+	assert.Equal(t, logger.entries[2].level, LogLevelInfo)
+}
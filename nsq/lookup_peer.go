@@ -1,7 +1,6 @@
 package nsq
 
 import (
-	"log"
 	"net"
 	"time"
 )
@@ -40,7 +39,7 @@ func NewLookupPeer(addr string, connectCallback func(*LookupPeer)) *LookupPeer {
 
 // Connect will Dial the specified address, with timeouts
 func (lp *LookupPeer) Connect() error {
-	log.Printf("LOOKUP connecting to %s", lp.addr)
+	NewLogEntry(nil, "addr", lp.addr).Infof("connecting to lookupd")
 	conn, err := net.DialTimeout("tcp", lp.addr, time.Second)
 	if err != nil {
 		return err
@@ -69,6 +68,9 @@ func (lp *LookupPeer) Write(data []byte) (int, error) {
 // Close implements the io.Closer interface
 func (lp *LookupPeer) Close() error {
 	lp.state = StateDisconnected
+	if lp.conn == nil {
+		return nil
+	}
 	return lp.conn.Close()
 }
 
@@ -0,0 +1,256 @@
+package nsq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectToLookupd adds a nsqlookupd address to the list for this Reader instance.
+//
+// If it is the first to be added, it initiates an HTTP request to discover nsqd
+// producers for the configured topic.
+//
+// A goroutine is spawned to handle continual polling.
+func (q *Reader) ConnectToLookupd(addr string) error {
+	return q.ConnectToLookupds([]string{addr})
+}
+
+// ConnectToLookupds adds multiple nsqlookupd addresses (see ConnectToLookupd), none
+// are added if any of them already exists.
+func (q *Reader) ConnectToLookupds(addrs []string) error {
+	q.connMtx.Lock()
+	for i, addr := range addrs {
+		exists := inStringSlice(addrs[:i], addr)
+		if exists || inStringSlice(q.lookupdHTTPAddrs, addr) {
+			q.connMtx.Unlock()
+			return fmt.Errorf("lookupd address %s already exists", addr)
+		}
+	}
+	q.lookupdHTTPAddrs = append(q.lookupdHTTPAddrs, addrs...)
+	q.connMtx.Unlock()
+
+	// if these are the first ones, kick off the go loop
+	first := false
+	q.lookupdLoopOnce.Do(func() { first = true })
+	if first {
+		q.queryLookupd()
+		go q.lookupdLoop()
+	} else {
+		q.recheckLookupd()
+	}
+
+	return nil
+}
+
+// DisconnectFromLookupd removes a nsqlookupd address from the list for this Reader
+// instance.
+//
+// Connections to nsqd that were only discovered via addr are closed once they are
+// missing from the responses of the remaining nsqlookupd (see MaxLookupdMisses).
+func (q *Reader) DisconnectFromLookupd(addr string) error {
+	q.connMtx.Lock()
+	defer q.connMtx.Unlock()
+
+	for i, x := range q.lookupdHTTPAddrs {
+		if x == addr {
+			addrs := make([]string, 0, len(q.lookupdHTTPAddrs)-1)
+			addrs = append(addrs, q.lookupdHTTPAddrs[:i]...)
+			q.lookupdHTTPAddrs = append(addrs, q.lookupdHTTPAddrs[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("lookupd address not found")
+}
+
+func inStringSlice(s []string, x string) bool {
+	for _, v := range s {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+// recheckLookupd triggers a poll of the lookupd (if one isn't pending already)
+func (q *Reader) recheckLookupd() {
+	select {
+	case q.lookupdRecheckChan <- 1:
+	default:
+	}
+}
+
+// poll all known lookup servers every LookupdPollInterval
+func (q *Reader) lookupdLoop() {
+	// add some jitter so that multiple consumers discovering the same topic,
+	// when restarted at the same time, dont all connect at once.
+	rand.Seed(time.Now().UnixNano())
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(q.LookupdPollInterval / 10)))):
+	case <-q.stopCtx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(q.LookupdPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.queryLookupd()
+		case <-q.lookupdRecheckChan:
+			q.queryLookupd()
+		case <-q.stopCtx.Done():
+			return
+		}
+	}
+}
+
+// make a HTTP req to the /lookup endpoint on each lookup server (concurrently)
+// to find what nsq's provide the topic we are consuming.
+// for any new producers, initiate a connection to those NSQ's
+func (q *Reader) queryLookupd() {
+	q.connMtx.RLock()
+	addrs := make([]string, len(q.lookupdHTTPAddrs))
+	copy(addrs, q.lookupdHTTPAddrs)
+	q.connMtx.RUnlock()
+
+	var wg sync.WaitGroup
+	results := make([][]string, len(addrs))
+	errs := make([]error, len(addrs))
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			results[i], errs[i] = q.lookupProducers(addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	// the union of the producers of the lookupd that responded
+	responded := false
+	producers := make(map[string]bool)
+	var order []string
+	for i, addr := range addrs {
+		if errs[i] != nil {
+			q.logError(nil, "failed to query lookupd %s - %s", addr, errs[i].Error())
+			continue
+		}
+		responded = true
+		for _, producer := range results[i] {
+			if !producers[producer] {
+				producers[producer] = true
+				order = append(order, producer)
+			}
+		}
+	}
+
+	// concurrently, so that nsqd slow to respond (ie. to IDENTIFY, see IdentifyTimeout)
+	// don't delay connecting to the others
+	for _, addr := range order {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := q.connectToNSQ(addr)
+			if err != nil && err != ErrAlreadyConnected {
+				q.logError(nil, "failed to connect to nsqd (%s) - %s", addr, err.Error())
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	// without any response there is no telling which producers are gone
+	if responded {
+		q.closeMissingProducers(producers)
+	}
+}
+
+// lookupProducers returns the TCP addresses of the nsqd producing the topic
+// according to the lookupd at addr
+func (q *Reader) lookupProducers(addr string) ([]string, error) {
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", addr, url.QueryEscape(q.TopicName))
+
+	q.log(nil).Infof("querying lookupd %s", endpoint)
+
+	data, err := ApiRequestTimeout(endpoint, q.LookupdHTTPTimeout)
+	if err != nil {
+		if apiErr, ok := err.(*ApiError); ok && apiErr.StatusTxt == "INVALID_ARG_TOPIC" {
+			// the topic isn't registered with this lookupd (yet)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// {"data":{"channels":[],"producers":[{"address":"jehiah-air.local", "tpc_port":4150, "http_port":4151}],"timestamp":1340152173},"status_code":200,"status_txt":"OK"}
+	producers, _ := data.Get("producers").Array()
+	addrs := make([]string, 0, len(producers))
+	for i := range producers {
+		producer := data.Get("producers").GetIndex(i)
+		address, err := producer.Get("address").String()
+		if err != nil {
+			return nil, fmt.Errorf("invalid producer address - %s", err.Error())
+		}
+		port, err := producer.Get("tcp_port").Int()
+		if err != nil {
+			return nil, fmt.Errorf("invalid producer tcp_port - %s", err.Error())
+		}
+		addrs = append(addrs, net.JoinHostPort(address, strconv.Itoa(port)))
+	}
+	return addrs, nil
+}
+
+// isDirect indicates whether addr was configured via ConnectToNSQ
+func (q *Reader) isDirect(addr string) bool {
+	q.reconnectMtx.Lock()
+	defer q.reconnectMtx.Unlock()
+	_, ok := q.nsqdAddrs[addr]
+	return ok
+}
+
+// closeMissingProducers gracefully closes the connections to nsqd (discovered via
+// lookupd) that have been missing from producers for MaxLookupdMisses consecutive
+// polls, ie. nsqd that no longer have the topic or are no longer registered
+func (q *Reader) closeMissingProducers(producers map[string]bool) {
+	var buf bytes.Buffer
+
+	if q.MaxLookupdMisses <= 0 {
+		return
+	}
+
+	var missing []*nsqConn
+	for _, c := range q.conns() {
+		addr := c.String()
+		if producers[addr] || atomic.LoadInt32(&c.stopFlag) == 1 || q.isDirect(addr) {
+			continue
+		}
+		missing = append(missing, c)
+	}
+
+	var closing []*nsqConn
+	q.connMtx.Lock()
+	misses := make(map[string]int, len(missing))
+	for _, c := range missing {
+		n := q.lookupdMisses[c.String()] + 1
+		if n >= q.MaxLookupdMisses {
+			closing = append(closing, c)
+			continue
+		}
+		misses[c.String()] = n
+	}
+	q.lookupdMisses = misses
+	q.connMtx.Unlock()
+
+	for _, c := range closing {
+		q.log(c).Infof("missing from lookupd for %d polls, closing", q.MaxLookupdMisses)
+		err := c.sendCommand(&buf, StartClose())
+		if err != nil {
+			q.logError(c, "failed to start close - %s", err.Error())
+		}
+	}
+}
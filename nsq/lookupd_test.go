@@ -0,0 +1,202 @@
+package nsq
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLookupd responds to /lookup with the local nsqd as producer while it is registered
+type testLookupd struct {
+	*httptest.Server
+	registered int32
+	delay      time.Duration
+}
+
+func newTestLookupd(registered bool, delay time.Duration) *testLookupd {
+	return newTestLookupdProducers(registered, delay, []int{4150})
+}
+
+// newTestLookupdProducers responds with producers on 127.0.0.1 at the TCP ports
+func newTestLookupdProducers(registered bool, delay time.Duration, ports []int) *testLookupd {
+	l := &testLookupd{delay: delay}
+	if registered {
+		l.registered = 1
+	}
+	producers := make([]string, 0, len(ports))
+	for _, port := range ports {
+		producers = append(producers,
+			fmt.Sprintf(`{"address":"127.0.0.1","tcp_port":%d,"http_port":4151}`, port))
+	}
+	l.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(l.delay)
+		if atomic.LoadInt32(&l.registered) == 0 {
+			w.WriteHeader(500)
+			io.WriteString(w, `{"status_code":500,"status_txt":"INVALID_ARG_TOPIC","data":null}`)
+			return
+		}
+		io.WriteString(w, `{"status_code":200,"status_txt":"OK","data":{"channels":[],`+
+			`"producers":[`+strings.Join(producers, ",")+`]}}`)
+	}))
+	return l
+}
+
+func (l *testLookupd) Addr() string {
+	return l.Listener.Addr().String()
+}
+
+func (l *testLookupd) SetRegistered(registered bool) {
+	if registered {
+		atomic.StoreInt32(&l.registered, 1)
+	} else {
+		atomic.StoreInt32(&l.registered, 0)
+	}
+}
+
+func TestReaderLookupd(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	registered := newTestLookupd(true, 0)
+	defer registered.Close()
+	unregistered := newTestLookupd(false, 0)
+	defer unregistered.Close()
+	slow := newTestLookupd(true, 500*time.Millisecond)
+	defer slow.Close()
+
+	topicName := "reader_lookupd_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.LookupdPollInterval = 50 * time.Millisecond
+	q.LookupdHTTPTimeout = 100 * time.Millisecond
+	q.MaxLookupdMisses = 2
+	q.AddHandler(&CountingTestHandler{})
+
+	connected := func() bool { return len(q.ConnectionStats()) == 1 }
+	disconnected := func() bool { return len(q.ConnectionStats()) == 0 }
+
+	start := time.Now()
+	err := q.ConnectToLookupds([]string{registered.Addr(), unregistered.Addr(), slow.Addr()})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// the slow lookupd times out without delaying the others
+	if !connected() || time.Since(start) > 400*time.Millisecond {
+		t.Fatalf("not connected after %s", time.Since(start))
+	}
+	if q.Stats().LastError == "" {
+		t.Fatalf("the timeout of the slow lookupd is not the last error")
+	}
+	if q.ConnectToLookupds([]string{unregistered.Addr()}) == nil {
+		t.Fatalf("duplicate lookupd address was added")
+	}
+
+	// the connection is closed once nsqd is missing from the lookupd responses
+	slow.SetRegistered(false)
+	registered.SetRegistered(false)
+	waitFor(t, "the disconnection", disconnected)
+
+	registered.SetRegistered(true)
+	waitFor(t, "the reconnection", connected)
+
+	// nsqd is missing from the responses once the lookupd is removed
+	err = q.DisconnectFromLookupd(registered.Addr())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	waitFor(t, "the disconnection after removing the lookupd", disconnected)
+	if q.DisconnectFromLookupd(registered.Addr()) == nil {
+		t.Fatalf("removed lookupd address was removed again")
+	}
+
+	q.Stop()
+	<-q.ExitChan
+}
+
+// silentNSQd accepts connections and never responds, like nsqd that predate feature
+// negotiation do to IDENTIFY
+type silentNSQd struct {
+	sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+}
+
+func newSilentNSQd(t *testing.T) *silentNSQd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	s := &silentNSQd{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.conns = append(s.conns, conn)
+			s.Unlock()
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	return s
+}
+
+func (s *silentNSQd) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *silentNSQd) Close() {
+	s.listener.Close()
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func TestReaderLookupdIdentifyTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	var ports []int
+	for i := 0; i < 3; i++ {
+		s := newSilentNSQd(t)
+		defer s.Close()
+		ports = append(ports, s.Port())
+	}
+	lookupd := newTestLookupdProducers(true, 0, ports)
+	defer lookupd.Close()
+
+	topicName := "identify_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.IdentifyTimeout = 300 * time.Millisecond
+	q.AddHandler(&CountingTestHandler{})
+
+	// the IDENTIFY responses are waited for concurrently
+	start := time.Now()
+	err := q.ConnectToLookupd(lookupd.Addr())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(q.ConnectionStats()) != 3 || time.Since(start) > 800*time.Millisecond {
+		t.Fatalf("%d connections after %s", len(q.ConnectionStats()), time.Since(start))
+	}
+	for _, stats := range q.ConnectionStats() {
+		if stats.ServerVersion != "" {
+			t.Fatalf("unexpected connection stats %+v", stats)
+		}
+	}
+
+	q.Stop()
+}
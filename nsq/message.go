@@ -3,14 +3,46 @@ package nsq
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"sort"
 	"time"
 )
 
 // The number of bytes for a Message.Id
 const MsgIdLength = 16
 
+// Message format versions.
+//
+// The original format has no explicit version, its first byte is always 0 because
+// it is the high byte of the (unix) timestamp.  Later formats are prefixed with a
+// single non-zero version byte.
+const (
+	MsgFormatV1 byte = 0
+	MsgFormatV2 byte = 2
+)
+
+// The maximum number of headers a Message can carry
+const MaxMsgHeaders = 256
+
+// The Message header used to select a priority level at publish time,
+// one of "high", "normal" (the default) or "low"
+const PriorityHeader = "priority"
+
+// The Message header used to supply a dedup key at publish time (see PublishWithDedupKey)
+const DedupKeyHeader = "dedup_key"
+
+// The Message headers used for request/reply (see Requester and Responder):
+// the topic a reply should be published to (on the nsqd the request was received
+// from) and an identifier that is copied to the reply to match it with its request
+const (
+	ReplyToHeader       = "reply_to"
+	CorrelationIdHeader = "correlation_id"
+)
+
 type MessageID [MsgIdLength]byte
 
 // Message is the fundamental data type containing
@@ -20,6 +52,9 @@ type Message struct {
 	Body      []byte
 	Timestamp int64
 	Attempts  uint16
+	Headers   map[string]string
+
+	nsqdAddress string // the nsqd a Reader received the message from (see Responder)
 }
 
 // NewMessage creates a Message, initializes some metadata, 
@@ -44,8 +79,31 @@ func (m *Message) EncodeBytes() ([]byte, error) {
 
 // Write serializes the message into the supplied writer.
 //
+// Messages with headers are written in the MsgFormatV2 format, otherwise the
+// original MsgFormatV1 format is used.
+//
 // It is suggested that the target Writer is buffered to avoid performing many system calls.
 func (m *Message) Write(w io.Writer) error {
+	if len(m.Headers) > 0 {
+		return m.WriteFormat(w, MsgFormatV2)
+	}
+	return m.WriteFormat(w, MsgFormatV1)
+}
+
+// WriteFormat serializes the message into the supplied writer using the specified
+// format version (headers are omitted when writing MsgFormatV1)
+func (m *Message) WriteFormat(w io.Writer, version byte) error {
+	switch version {
+	case MsgFormatV1:
+	case MsgFormatV2:
+		_, err := w.Write([]byte{version})
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid message format version %d", version)
+	}
+
 	err := binary.Write(w, binary.BigEndian, &m.Timestamp)
 	if err != nil {
 		return err
@@ -61,6 +119,13 @@ func (m *Message) Write(w io.Writer) error {
 		return err
 	}
 
+	if version == MsgFormatV2 {
+		err = WriteHeaders(w, m.Headers)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = w.Write(m.Body)
 	if err != nil {
 		return err
@@ -70,11 +135,26 @@ func (m *Message) Write(w io.Writer) error {
 }
 
 // DecodeMessage deseralizes data (as []byte) and creates a new Message
+//
+// Both the MsgFormatV1 and MsgFormatV2 formats are supported.
 func DecodeMessage(byteBuf []byte) (*Message, error) {
 	var timestamp int64
 	var attempts uint16
 	var msg Message
 
+	if len(byteBuf) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	version := byteBuf[0]
+	switch version {
+	case MsgFormatV1:
+	case MsgFormatV2:
+		byteBuf = byteBuf[1:]
+	default:
+		return nil, fmt.Errorf("invalid message format version %d", version)
+	}
+
 	buf := bytes.NewBuffer(byteBuf)
 
 	err := binary.Read(buf, binary.BigEndian, &timestamp)
@@ -92,6 +172,13 @@ func DecodeMessage(byteBuf []byte) (*Message, error) {
 		return nil, err
 	}
 
+	if version == MsgFormatV2 {
+		msg.Headers, err = ReadHeaders(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	body, err := ioutil.ReadAll(buf)
 	if err != nil {
 		return nil, err
@@ -103,3 +190,82 @@ func DecodeMessage(byteBuf []byte) (*Message, error) {
 
 	return &msg, nil
 }
+
+// WriteHeaders serializes message headers into the supplied writer:
+//
+//    [x][x][x][x][x]...[x][x][x]...
+//    |(uint16)||(uint16)||(binary)||(uint16)||(binary)| ... (repeated <count> times)
+//    | 2-byte || 2-byte || N-byte || 2-byte || N-byte |
+//    --------------------------------------------------...
+//       count    key size    key     value size  value
+//
+// Keys are written in sorted order.
+func WriteHeaders(w io.Writer, headers map[string]string) error {
+	if len(headers) > MaxMsgHeaders {
+		return errors.New("too many headers")
+	}
+
+	keys := make([]string, 0, len(headers))
+	for k, v := range headers {
+		if len(k) == 0 || len(k) > math.MaxUint16 || len(v) > math.MaxUint16 {
+			return fmt.Errorf("invalid header %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	err := binary.Write(w, binary.BigEndian, uint16(len(keys)))
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		for _, field := range []string{k, headers[k]} {
+			err = binary.Write(w, binary.BigEndian, uint16(len(field)))
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, field)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadHeaders deserializes message headers (see WriteHeaders) from the supplied reader
+func ReadHeaders(r io.Reader) (map[string]string, error) {
+	var count uint16
+
+	err := binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > MaxMsgHeaders {
+		return nil, errors.New("too many headers")
+	}
+
+	headers := make(map[string]string, count)
+	for i := uint16(0); i < count; i++ {
+		var fields [2]string
+		for j := range fields {
+			var size uint16
+			err = binary.Read(r, binary.BigEndian, &size)
+			if err != nil {
+				return nil, err
+			}
+			field := make([]byte, size)
+			_, err = io.ReadFull(r, field)
+			if err != nil {
+				return nil, err
+			}
+			fields[j] = string(field)
+		}
+		headers[fields[0]] = fields[1]
+	}
+
+	return headers, nil
+}
@@ -0,0 +1,91 @@
+package nsq
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"strconv"
+	"testing"
+)
+
+func TestMessageFormatV1(t *testing.T) {
+	var id MessageID
+	copy(id[:], []byte("0123456789abcdef"))
+	msg := NewMessage(id, []byte("test body"))
+	msg.Attempts = 3
+
+	var buf bytes.Buffer
+	err := msg.Write(&buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.Bytes()[0], MsgFormatV1)
+	assert.Equal(t, buf.Len(), 8+2+MsgIdLength+len("test body"))
+
+	decoded, err := DecodeMessage(buf.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded.Id, msg.Id)
+	assert.Equal(t, decoded.Timestamp, msg.Timestamp)
+	assert.Equal(t, decoded.Attempts, uint16(3))
+	assert.Equal(t, decoded.Body, []byte("test body"))
+	assert.Equal(t, len(decoded.Headers), 0)
+}
+
+func TestMessageFormatV2(t *testing.T) {
+	var id MessageID
+	copy(id[:], []byte("0123456789abcdef"))
+	msg := NewMessage(id, []byte("test body"))
+	msg.Headers = map[string]string{"content-type": "text/plain", "trace": ""}
+
+	var buf bytes.Buffer
+	err := msg.Write(&buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.Bytes()[0], MsgFormatV2)
+
+	decoded, err := DecodeMessage(buf.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded.Id, msg.Id)
+	assert.Equal(t, decoded.Timestamp, msg.Timestamp)
+	assert.Equal(t, decoded.Body, []byte("test body"))
+	assert.Equal(t, decoded.Headers, msg.Headers)
+
+	// headers are dropped when explicitly writing the original format
+	buf.Reset()
+	err = msg.WriteFormat(&buf, MsgFormatV1)
+	assert.Equal(t, err, nil)
+
+	decoded, err = DecodeMessage(buf.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded.Body, []byte("test body"))
+	assert.Equal(t, len(decoded.Headers), 0)
+}
+
+func TestMessageHeadersInvalid(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := WriteHeaders(&buf, map[string]string{"": "value"})
+	assert.NotEqual(t, err, nil)
+
+	headers := make(map[string]string)
+	for i := 0; i <= MaxMsgHeaders; i++ {
+		headers[strconv.Itoa(i)] = "v"
+	}
+	err = WriteHeaders(&buf, headers)
+	assert.NotEqual(t, err, nil)
+
+	_, err = DecodeMessage([]byte{9, 0, 0})
+	assert.NotEqual(t, err, nil)
+
+	// truncated header section
+	_, err = DecodeMessage(append([]byte{MsgFormatV2}, make([]byte, 8+2+MsgIdLength+1)...))
+	assert.NotEqual(t, err, nil)
+}
+
+func TestPublishWithHeaders(t *testing.T) {
+	cmd, err := PublishWithHeaders("test", map[string]string{"a": "b"}, []byte("body"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cmd.Name, []byte("HPUB"))
+
+	buf := bytes.NewBuffer(cmd.Body)
+	headers, err := ReadHeaders(buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, headers, map[string]string{"a": "b"})
+	assert.Equal(t, buf.Bytes(), []byte("body"))
+}
@@ -27,8 +27,15 @@ const (
 // The amount of time nsqd will allow a client to idle, can be overriden
 const DefaultClientTimeout = 60 * time.Second
 
-var validTopicNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+$`)
+// The amount of time nsqd waits for a response to an in-flight message, can be overriden
+const DefaultMsgTimeout = 60 * time.Second
+
+var validTopicNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
 var validChannelNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
+var validDedupKeyRegex = regexp.MustCompile(`^[[:graph:]]+$`)
+
+// The maximum length of a dedup key supplied at publish time
+const MaxDedupKeyLength = 255
 
 // IsValidTopicName checks a topic name for correctness
 func IsValidTopicName(name string) bool {
@@ -46,6 +53,14 @@ func IsValidChannelName(name string) bool {
 	return validChannelNameRegex.MatchString(name)
 }
 
+// IsValidDedupKey checks a dedup key for correctness
+func IsValidDedupKey(key string) bool {
+	if len(key) > MaxDedupKeyLength || len(key) < 1 {
+		return false
+	}
+	return validDedupKeyRegex.MatchString(key)
+}
+
 // Protocol describes the basic behavior of any protocol in the system
 type Protocol interface {
 	IOLoop(conn net.Conn) error
@@ -0,0 +1,96 @@
+package nsq
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// rdyLoop rotates RDY every RDYRotateInterval until the Reader is stopped
+func (q *Reader) rdyLoop() {
+	ticker := time.NewTicker(q.RDYRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.rotateRDY()
+		case <-q.rdyExitChan:
+			return
+		}
+	}
+}
+
+// totalRdyCount is the sum of the RDY counts of all connections
+func (q *Reader) totalRdyCount() int64 {
+	var total int64
+	for _, c := range q.conns() {
+		total += atomic.LoadInt64(&c.rdyCount)
+	}
+	return total
+}
+
+// rotateRDY redistributes RDY when there are more connections than max-in-flight
+// (ie. not every connection can have RDY 1).
+//
+// Connections that have not received a message for RDYRotateInterval give up their RDY
+// and the available max-in-flight is handed out as RDY 1 to random connections without
+// any, preferring those that did not just give it up.
+func (q *Reader) rotateRDY() {
+	q.rdyMtx.Lock()
+	defer q.rdyMtx.Unlock()
+
+	if q.backoffState != BackoffNone {
+		return
+	}
+
+	conns := q.conns()
+	maxInFlight := int64(q.MaxInFlight())
+	if int64(len(conns)) <= maxInFlight {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	var total int64
+	var candidates []*nsqConn
+	var idle []*nsqConn
+	for _, c := range conns {
+		if atomic.LoadInt32(&c.stopFlag) != 0 {
+			continue
+		}
+
+		rdy := atomic.LoadInt64(&c.rdyCount)
+		if rdy == 0 {
+			candidates = append(candidates, c)
+			continue
+		}
+
+		last := atomic.LoadInt64(&c.lastMsgTime)
+		if t := atomic.LoadInt64(&c.lastRdyTime); t > last {
+			last = t
+		}
+		if time.Duration(now-last) < q.RDYRotateInterval {
+			total += rdy
+			continue
+		}
+
+		q.log(c).Debugf("idle for %s, rotating RDY", time.Duration(now-last))
+		if q.sendReady(c, 0) == nil {
+			idle = append(idle, c)
+		}
+	}
+
+	order := make([]*nsqConn, 0, len(candidates)+len(idle))
+	for _, i := range rand.Perm(len(candidates)) {
+		order = append(order, candidates[i])
+	}
+	order = append(order, idle...)
+	for _, c := range order {
+		if total >= maxInFlight {
+			break
+		}
+		if q.sendReady(c, 1) == nil {
+			total++
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package nsq_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"github.com/lhzd863/nsq-0.2.16/util"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is the ReadWriter of the util.MockConn of test connections
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Read(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+// run with -race
+func TestReaderRDYRotation(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	q, _ := nsq.NewReader("reader_rdy_test", "ch")
+	q.RDYRotateInterval = 10 * time.Millisecond
+	q.SetMaxInFlight(2)
+
+	var addrs []string
+	for i := 0; i < 5; i++ {
+		addr := fmt.Sprintf("127.0.0.1:%d", 5000+i)
+		nsq.AddTestConn(q, util.MockConn{ReadWriter: &lockedBuffer{}}, addr)
+		addrs = append(addrs, addr)
+	}
+	for _, addr := range addrs {
+		nsq.UpdateReady(q, addr)
+	}
+	if nsq.TotalRdyCount(q) != 2 {
+		t.Fatalf("RDY %d should be limited to max-in-flight", nsq.TotalRdyCount(q))
+	}
+
+	var wg sync.WaitGroup
+	var exitFlag int32
+	hadRdy := make(map[string]bool)
+
+	// rotate, checking the RDY budget
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			nsq.RotateRDY(q)
+			if total := nsq.TotalRdyCount(q); total > 2 {
+				t.Errorf("total RDY %d > max-in-flight", total)
+			}
+			for _, addr := range addrs {
+				if nsq.ConnRDY(q, addr) > 0 {
+					hadRdy[addr] = true
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		atomic.StoreInt32(&exitFlag, 1)
+	}()
+
+	// keep the first connection busy
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&exitFlag) == 0 {
+			nsq.ReceiveTestMessage(q, addrs[0])
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// add and remove connections
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; atomic.LoadInt32(&exitFlag) == 0; i++ {
+			addr := fmt.Sprintf("127.0.0.1:%d", 6000+i)
+			nsq.AddTestConn(q, util.MockConn{ReadWriter: &lockedBuffer{}}, addr)
+			nsq.UpdateReady(q, addr)
+			nsq.RemoveTestConn(q, addr)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// read the connection state
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&exitFlag) == 0 {
+			q.IsStarved()
+			q.ConnectionMaxInFlight()
+			q.ConnectionStats()
+			q.Stats()
+			q.SetMaxInFlight(2)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	wg.Wait()
+
+	// RDY was rotated to every connection
+	for _, addr := range addrs {
+		if !hadRdy[addr] {
+			t.Fatalf("%s never had RDY", addr)
+		}
+	}
+}
@@ -3,15 +3,14 @@ package nsq
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
-	"math/rand"
 	"net"
-	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -33,6 +32,24 @@ type Handler interface {
 	HandleMessage(message *Message) error
 }
 
+// HandlerFunc is an adapter to use an ordinary function as a Handler
+type HandlerFunc func(message *Message) error
+
+// HandleMessage calls h(message)
+func (h HandlerFunc) HandleMessage(message *Message) error {
+	return h(message)
+}
+
+// ContextHandler is the synchronous interface to Reader for handlers that
+// support cancellation.
+//
+// The context is cancelled when the message is about to time out in nsqd (at 90% of
+// its in-flight timeout) or when the Reader is stopping.  The return value is
+// handled as for Handler.
+type ContextHandler interface {
+	HandleMessage(ctx context.Context, message *Message) error
+}
+
 // AsyncHandler is the asynchronous interface to Reader.
 //
 // Implement this interface for handlers that wish to defer responding until later.
@@ -56,7 +73,7 @@ type FinishedMessage struct {
 
 // FailedMessageLogger is an interface that can be implemented by handlers that wish
 // to receive a callback when a message is deemed "failed" (i.e. the number of attempts
-// exceeded the Reader specified MaxAttemptCount)
+// exceeded the Reader specified MaxAttemptCount).  See also Reader.FailedMessageSink.
 type FailedMessageLogger interface {
 	LogFailedMessage(message *Message)
 }
@@ -64,6 +81,7 @@ type FailedMessageLogger interface {
 type incomingMessage struct {
 	*Message
 	responseChannel chan *FinishedMessage
+	deadline        time.Time // when the context of a ContextHandler is cancelled
 }
 
 type nsqConn struct {
@@ -77,9 +95,18 @@ type nsqConn struct {
 	messagesFinished uint64
 	messagesRequeued uint64
 	rdyCount         int64
+	lastRdyTime      int64 // unix nano of the last RDY > 0 (for RDY rotation)
+	lastMsgTime      int64 // unix nano of the last message received
 	readTimeout      time.Duration
 	writeTimeout     time.Duration
 	stopper          sync.Once
+
+	// settings negotiated with nsqd in IDENTIFY (see identify)
+	maxRdyCount       int64
+	heartbeatInterval time.Duration
+	msgTimeout        time.Duration
+	serverVersion     string
+
 	dying            chan struct{}
 	drainReady       chan struct{}
 }
@@ -99,6 +126,7 @@ func newNSQConn(addr string, readTimeout time.Duration, writeTimeout time.Durati
 		writeTimeout:     writeTimeout,
 		dying:            make(chan struct{}, 1),
 		drainReady:       make(chan struct{}),
+		maxRdyCount:      MaxReadyCount,
 	}
 
 	nc.SetWriteDeadline(time.Now().Add(nc.writeTimeout))
@@ -111,6 +139,73 @@ func newNSQConn(addr string, readTimeout time.Duration, writeTimeout time.Durati
 	return nc, nil
 }
 
+// identifyResponse is the response to IDENTIFY from nsqd that support feature negotiation
+type identifyResponse struct {
+	MaxRdyCount       int64  `json:"max_rdy_count"`
+	Version           string `json:"version"`
+	HeartbeatInterval int64  `json:"heartbeat_interval"`
+	MsgTimeout        int64  `json:"msg_timeout"`
+	MessageHeaders    bool   `json:"message_headers"`
+}
+
+// identify sends IDENTIFY (requesting feature negotiation) and applies the settings
+// from the JSON response, if nsqd provides one within timeout
+func (c *nsqConn) identify(js map[string]interface{}, timeout time.Duration) error {
+	var buf bytes.Buffer
+
+	js["feature_negotiation"] = true
+	cmd, err := Identify(js)
+	if err != nil {
+		return err
+	}
+	err = c.sendCommand(&buf, cmd)
+	if err != nil {
+		return err
+	}
+
+	// nsqd that predate feature negotiation do not respond
+	readTimeout := c.readTimeout
+	c.readTimeout = timeout
+	resp, err := ReadResponse(c)
+	c.readTimeout = readTimeout
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return err
+	}
+
+	frameType, data, err := UnpackResponse(resp)
+	if err != nil {
+		return err
+	}
+	if frameType == FrameTypeError {
+		return errors.New(string(data))
+	}
+	if frameType != FrameTypeResponse || len(data) == 0 || data[0] != '{' {
+		return nil
+	}
+
+	var negotiated identifyResponse
+	err = json.Unmarshal(data, &negotiated)
+	if err != nil {
+		return fmt.Errorf("invalid IDENTIFY response %s - %s", data, err.Error())
+	}
+
+	if negotiated.MaxRdyCount > 0 {
+		c.maxRdyCount = negotiated.MaxRdyCount
+	}
+	c.heartbeatInterval = time.Duration(negotiated.HeartbeatInterval) * time.Millisecond
+	c.msgTimeout = time.Duration(negotiated.MsgTimeout) * time.Millisecond
+	c.serverVersion = negotiated.Version
+	// don't time out between heartbeats
+	if c.readTimeout < 2*c.heartbeatInterval {
+		c.readTimeout = 2 * c.heartbeatInterval
+	}
+
+	return nil
+}
+
 func (c *nsqConn) String() string {
 	return c.addr
 }
@@ -148,30 +243,95 @@ type Reader struct {
 	TopicName           string        // name of topic to subscribe to
 	ChannelName         string        // name of channel to subscribe to
 	LookupdPollInterval time.Duration // seconds between polling lookupd's (+/- random 1/10th this value for jitter)
+	LookupdHTTPTimeout  time.Duration // the deadline of HTTP requests to lookupd
+	MaxLookupdMisses    int           // # of consecutive polls an nsqd may be missing from the lookupd responses before its connection is closed (0 keeps it open)
 	MaxAttemptCount     uint16        // maximum number of times this reader will attempt to process a message
 	DefaultRequeueDelay time.Duration // the default duration when REQueueing
 	MaxRequeueDelay     time.Duration // the maximum duration when REQueueing (for doubling backoff)
-	VerboseLogging      bool          // enable verbose logging
+	VerboseLogging      bool          // log debug messages at the info level
 	ShortIdentifier     string        // an identifier to send to nsqd when connecting (defaults: short hostname)
 	LongIdentifier      string        // an identifier to send to nsqd when connecting (defaults: long hostname)
 	ReadTimeout         time.Duration // the deadline set for network reads
 	WriteTimeout        time.Duration // the deadline set for network writes
+	UserAgent           string        // a client library identifier to send to nsqd when connecting (default: nsq/<VERSION>)
+	MessageHeaders      bool          // IDENTIFY to receive messages with their headers
+	IdentifyTimeout     time.Duration // how long to wait for the IDENTIFY response (nsqd that predate feature negotiation never respond)
+	BackoffMultiplier   time.Duration // unit of the exponential backoff after handler failures (0 disables backoff)
+	MaxBackoffDuration  time.Duration // the maximum duration of a single backoff wait
+	ReconnectMultiplier time.Duration // unit of the exponential backoff when reconnecting to ConnectToNSQ addresses (0 disables reconnection)
+	MaxReconnectDelay   time.Duration // the maximum duration between reconnection attempts
+	RDYRotateInterval   time.Duration // how often RDY is rotated to idle connections when max-in-flight < # of connections
+	DrainTimeout        time.Duration // how long Stop waits for in-flight messages before closing the handlers
 	MessagesReceived    uint64        // an atomic counter - # of messages received
 	MessagesFinished    uint64        // an atomic counter - # of messages FINished
 	MessagesRequeued    uint64        // an atomic counter - # of messages REQueued
 	ExitChan            chan int      // read from this channel to block your main loop
+	Logger              Logger        // the Logger of this reader's messages (nil uses GetLogger())
+
+	// called (if set) when the backoff state changes, delay is the duration of a BackoffActive wait
+	BackoffStateChanged func(state BackoffState, level int, delay time.Duration)
+
+	// persists messages that exceeded MaxAttemptCount before they are FINished (optional,
+	// see FileFailedMessageSink and TopicFailedMessageSink)
+	FailedMessageSink FailedMessageSink
 
 	// internal variables
-	maxInFlight        int
+	maxInFlight        int32
 	incomingMessages   chan *incomingMessage
-	nsqConnections     map[string]*nsqConn
-	lookupdExitChan    chan int
+	lookupdLoopOnce    sync.Once
 	lookupdRecheckChan chan int
 	stopFlag           int32
 	runningHandlers    int32
 	messagesInFlight   int64
-	lookupdHTTPAddrs   []string
 	stopHandler        sync.Once
+	handlerExitChan    chan int
+	rdyLoopOnce        sync.Once
+	rdyExitChan        chan int
+	drainOnce          sync.Once
+	drainChan          chan int
+	stopCtx            context.Context
+	stopCancel         context.CancelFunc
+	reconnects         uint64
+	handlerLatency     latencyHistogram
+
+	// guards the last error (see Stats)
+	statsMtx      sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+
+	// guards the connections (and those being established) and the lookupd state
+	connMtx            sync.RWMutex
+	nsqConnections     map[string]*nsqConn
+	pendingConnections map[string]bool
+	lookupdHTTPAddrs   []string
+	lookupdMisses      map[string]int // see closeMissingProducers
+
+	// guards the RDY count of connections and the backoff state (see updateBackoff)
+	rdyMtx           sync.Mutex
+	backoffState     BackoffState
+	backoffLevel     int
+	backoffTimer     *time.Timer
+	backoffProbeConn *nsqConn
+
+	// directly configured nsqd addresses, see scheduleReconnect
+	reconnectMtx sync.Mutex
+	nsqdAddrs    map[string]*nsqdAddr
+}
+
+// log returns a LogEntry with the topic and channel (and the address of c if set)
+func (q *Reader) log(c *nsqConn) LogEntry {
+	logger := q.Logger
+	if logger == nil {
+		logger = GetLogger()
+	}
+	if q.VerboseLogging {
+		logger = VerboseLogger(logger)
+	}
+	e := NewLogEntry(logger, "topic", q.TopicName, "channel", q.ChannelName)
+	if c != nil {
+		e = e.With("addr", c.String())
+	}
+	return e
 }
 
 // NewReader creates a new instance of Reader for the specified topic/channel
@@ -197,18 +357,32 @@ func NewReader(topic string, channel string) (*Reader, error) {
 		incomingMessages:    make(chan *incomingMessage),
 		ExitChan:            make(chan int),
 		nsqConnections:      make(map[string]*nsqConn),
+		pendingConnections:  make(map[string]bool),
+		rdyExitChan:         make(chan int),
+		handlerExitChan:     make(chan int),
+		drainChan:           make(chan int),
 		MaxAttemptCount:     5,
 		LookupdPollInterval: 120 * time.Second,
-		lookupdExitChan:     make(chan int),
+		LookupdHTTPTimeout:  2 * time.Second,
+		MaxLookupdMisses:    3,
 		lookupdRecheckChan:  make(chan int, 1), // used at connection close to force a possible reconnect
 		DefaultRequeueDelay: 90 * time.Second,
 		MaxRequeueDelay:     15 * time.Minute,
+		MaxBackoffDuration:  2 * time.Minute,
+		ReconnectMultiplier: time.Second,
+		MaxReconnectDelay:   time.Minute,
+		RDYRotateInterval:   5 * time.Second,
+		DrainTimeout:        30 * time.Second,
+		nsqdAddrs:           make(map[string]*nsqdAddr),
 		ShortIdentifier:     strings.Split(hostname, ".")[0],
 		LongIdentifier:      hostname,
+		UserAgent:           "nsq/" + VERSION,
 		ReadTimeout:         DefaultClientTimeout,
 		WriteTimeout:        time.Second,
+		IdentifyTimeout:     2 * time.Second,
 		maxInFlight:         1,
 	}
+	q.stopCtx, q.stopCancel = context.WithCancel(context.Background())
 	return q, nil
 }
 
@@ -217,15 +391,39 @@ func NewReader(topic string, channel string) (*Reader, error) {
 // This may change dynamically based on the number of connections to nsqd the Reader
 // is responsible for.
 func (q *Reader) ConnectionMaxInFlight() int {
-	b := float64(q.maxInFlight)
-	s := b / float64(len(q.nsqConnections))
+	b := float64(q.MaxInFlight())
+	s := b / float64(q.connectionCount())
 	return int(math.Min(math.Max(1, s), b))
 }
 
+// conns returns a snapshot of the current connections
+func (q *Reader) conns() []*nsqConn {
+	q.connMtx.RLock()
+	defer q.connMtx.RUnlock()
+
+	conns := make([]*nsqConn, 0, len(q.nsqConnections))
+	for _, c := range q.nsqConnections {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (q *Reader) connectionCount() int {
+	q.connMtx.RLock()
+	defer q.connMtx.RUnlock()
+	return len(q.nsqConnections)
+}
+
+func (q *Reader) lookupdCount() int {
+	q.connMtx.RLock()
+	defer q.connMtx.RUnlock()
+	return len(q.lookupdHTTPAddrs)
+}
+
 // IsStarved indicates whether any connections for this reader are blocked on processing
 // before being able to receive more messages (ie. RDY count of 0 and not exiting)
 func (q *Reader) IsStarved() bool {
-	for _, conn := range q.nsqConnections {
+	for _, conn := range q.conns() {
 		threshold := int64(float64(atomic.LoadInt64(&conn.rdyCount)) * 0.85)
 		if atomic.LoadInt64(&conn.messagesInFlight) >= threshold &&
 			atomic.LoadInt32(&conn.stopFlag) != 1 {
@@ -245,102 +443,22 @@ func (q *Reader) SetMaxInFlight(maxInFlight int) {
 	}
 
 	if maxInFlight > MaxReadyCount {
-		log.Printf("WARNING: tried to SetMaxInFlight() > %d, truncating...", MaxReadyCount)
+		q.log(nil).Warnf("tried to SetMaxInFlight() > %d, truncating...", MaxReadyCount)
 		maxInFlight = MaxReadyCount
 	}
 
-	if q.maxInFlight == maxInFlight {
+	if atomic.SwapInt32(&q.maxInFlight, int32(maxInFlight)) == int32(maxInFlight) {
 		return
 	}
-	q.maxInFlight = maxInFlight
 
-	for _, c := range q.nsqConnections {
+	for _, c := range q.conns() {
 		q.updateReady(c)
 	}
 }
 
 // MaxInFlight returns the configured maximum number of messages to allow in-flight.
 func (q *Reader) MaxInFlight() int {
-	return q.maxInFlight
-}
-
-// ConnectToLookupd adds a nsqlookupd address to the list for this Reader instance.
-//
-// If it is the first to be added, it initiates an HTTP request to discover nsqd
-// producers for the configured topic.
-//
-// A goroutine is spawned to handle continual polling.
-func (q *Reader) ConnectToLookupd(addr string) error {
-	// make a HTTP req to the lookupd, and ask it for endpoints that have the
-	// topic we are interested in.
-	// this is a go loop that fires every x seconds
-	for _, x := range q.lookupdHTTPAddrs {
-		if x == addr {
-			return errors.New("lookupd address already exists")
-		}
-	}
-	q.lookupdHTTPAddrs = append(q.lookupdHTTPAddrs, addr)
-
-	// if this is the first one, kick off the go loop
-	if len(q.lookupdHTTPAddrs) == 1 {
-		q.queryLookupd()
-		go q.lookupdLoop()
-	}
-
-	return nil
-}
-
-// poll all known lookup servers every LookupdPollInterval
-func (q *Reader) lookupdLoop() {
-	// add some jitter so that multiple consumers discovering the same topic,
-	// when restarted at the same time, dont all connect at once.
-	rand.Seed(time.Now().UnixNano())
-	time.Sleep(time.Duration(rand.Int63n(int64(q.LookupdPollInterval / 10))))
-	ticker := time.Tick(q.LookupdPollInterval)
-	for {
-		select {
-		case <-ticker:
-			q.queryLookupd()
-		case <-q.lookupdRecheckChan:
-			q.queryLookupd()
-		case <-q.lookupdExitChan:
-			return
-		}
-	}
-}
-
-// make a HTTP req to the /lookup endpoint on each lookup server
-// to find what nsq's provide the topic we are consuming.
-// for any new topics, initiate a connection to those NSQ's
-func (q *Reader) queryLookupd() {
-	for _, addr := range q.lookupdHTTPAddrs {
-		endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", addr, url.QueryEscape(q.TopicName))
-
-		log.Printf("LOOKUPD: querying %s", endpoint)
-
-		data, err := ApiRequest(endpoint)
-		if err != nil {
-			log.Printf("ERROR: lookupd %s - %s", addr, err.Error())
-			continue
-		}
-
-		// {"data":{"channels":[],"producers":[{"address":"jehiah-air.local", "tpc_port":4150, "http_port":4151}],"timestamp":1340152173},"status_code":200,"status_txt":"OK"}
-		producers, _ := data.Get("producers").Array()
-		for _, producer := range producers {
-			producerData, _ := producer.(map[string]interface{})
-			address := producerData["address"].(string)
-			//port := int(producerData["tcp_port"].(float64))
-                        port, _ := strconv.Atoi(fmt.Sprintf("%v",producerData["tcp_port"]))
-
-			// make an address, start a connection
-			joined := net.JoinHostPort(address, strconv.Itoa(port))
-			err = q.ConnectToNSQ(joined)
-			if err != nil && err != ErrAlreadyConnected {
-				log.Printf("ERROR: failed to connect to nsqd (%s) - %s", joined, err.Error())
-				continue
-			}
-		}
-	}
+	return int(atomic.LoadInt32(&q.maxInFlight))
 }
 
 // ConnectToNSQ takes a nsqd address to connect directly to.
@@ -348,7 +466,19 @@ func (q *Reader) queryLookupd() {
 // It is recommended to use ConnectToLookupd so that topics are discovered
 // automatically.  This method is useful when you want to connect to a single, local,
 // instance.
+//
+// The address is remembered, when the connection drops it is re-established with
+// an exponential backoff (see ReconnectMultiplier).
 func (q *Reader) ConnectToNSQ(addr string) error {
+	err := q.connectToNSQ(addr)
+	if err != nil {
+		return err
+	}
+	q.markConnected(addr, true)
+	return nil
+}
+
+func (q *Reader) connectToNSQ(addr string) error {
 	var buf bytes.Buffer
 
 	if atomic.LoadInt32(&q.stopFlag) == 1 {
@@ -359,37 +489,70 @@ func (q *Reader) ConnectToNSQ(addr string) error {
 		return errors.New("no handlers")
 	}
 
+	// reserve addr while connecting
+	q.connMtx.Lock()
 	_, ok := q.nsqConnections[addr]
-	if ok {
+	if ok || q.pendingConnections[addr] {
+		q.connMtx.Unlock()
 		return ErrAlreadyConnected
 	}
+	q.pendingConnections[addr] = true
+	q.connMtx.Unlock()
+
+	defer func() {
+		q.connMtx.Lock()
+		delete(q.pendingConnections, addr)
+		q.connMtx.Unlock()
+	}()
 
-	log.Printf("[%s] connecting to nsqd", addr)
+	q.log(nil).With("addr", addr).Infof("connecting to nsqd")
 
 	connection, err := newNSQConn(addr, q.ReadTimeout, q.WriteTimeout)
 	if err != nil {
 		return err
 	}
 
+	err = connection.identify(map[string]interface{}{
+		"short_id":        q.ShortIdentifier,
+		"long_id":         q.LongIdentifier,
+		"user_agent":      q.UserAgent,
+		"message_headers": q.MessageHeaders,
+	}, q.IdentifyTimeout)
+	if err != nil {
+		connection.Close()
+		return fmt.Errorf("[%s] failed to identify - %s", addr, err.Error())
+	}
+	if connection.serverVersion == "" {
+		q.log(connection).Infof("no IDENTIFY response, feature negotiation is not supported")
+	}
+
 	cmd := Subscribe(q.TopicName, q.ChannelName)
 	err = connection.sendCommand(&buf, cmd)
 	if err != nil {
 		connection.Close()
-		return fmt.Errorf("[%s] failed to subscribe to %s:%s - %s", q.TopicName, q.ChannelName, err.Error())
+		return fmt.Errorf("[%s] failed to subscribe to %s:%s - %s", addr, q.TopicName, q.ChannelName, err.Error())
 	}
 
+	q.connMtx.Lock()
 	q.nsqConnections[connection.String()] = connection
+	q.connMtx.Unlock()
+
+	if q.RDYRotateInterval > 0 {
+		q.rdyLoopOnce.Do(func() { go q.rdyLoop() })
+	}
 
 	go q.readLoop(connection)
 	go q.finishLoop(connection)
 
+	q.markConnected(addr, false)
+
 	return nil
 }
 
-func handleError(q *Reader, c *nsqConn, errMsg string) {
-	log.Printf(errMsg)
+func handleError(q *Reader, c *nsqConn, format string, args ...interface{}) {
+	q.logError(c, format, args...)
 	atomic.StoreInt32(&c.stopFlag, 1)
-	if len(q.nsqConnections) == 1 && len(q.lookupdHTTPAddrs) == 0 {
+	if q.connectionCount() == 1 && q.lookupdCount() == 0 && !q.reconnectEnabled() {
 		// This is the only remaining connection, so stop the queue
 		atomic.StoreInt32(&q.stopFlag, 1)
 	}
@@ -399,7 +562,7 @@ func (q *Reader) readLoop(c *nsqConn) {
 	// prime our ready state
 	err := q.updateReady(c)
 	if err != nil {
-		handleError(q, c, fmt.Sprintf("[%s] failed to send initial ready - %s", c, err.Error()))
+		handleError(q, c, "failed to send initial ready - %s", err.Error())
 		q.stopFinishLoop(c)
 		return
 	}
@@ -410,21 +573,21 @@ func (q *Reader) readLoop(c *nsqConn) {
 			if atomic.LoadInt64(&c.messagesInFlight) == 0 {
 				q.stopFinishLoop(c)
 			} else {
-				log.Printf("[%s] delaying close of FinishedMesages channel; %d outstanding messages", c, c.messagesInFlight)
+				q.log(c).Infof("delaying close of FinishedMesages channel; %d outstanding messages", atomic.LoadInt64(&c.messagesInFlight))
 			}
-			log.Printf("[%s] stopped read loop ", c)
+			q.log(c).Infof("stopped read loop")
 			break
 		}
 
 		resp, err := ReadResponse(c)
 		if err != nil {
-			handleError(q, c, fmt.Sprintf("[%s] error reading response %s", c, err.Error()))
+			handleError(q, c, "error reading response %s", err.Error())
 			continue
 		}
 
 		frameType, data, err := UnpackResponse(resp)
 		if err != nil {
-			handleError(q, c, fmt.Sprintf("[%s] error (%s) unpacking response %d %s", c, err.Error(), frameType, data))
+			handleError(q, c, "error (%s) unpacking response %d %s", err.Error(), frameType, data)
 			continue
 		}
 
@@ -432,42 +595,55 @@ func (q *Reader) readLoop(c *nsqConn) {
 		case FrameTypeMessage:
 			msg, err := DecodeMessage(data)
 			if err != nil {
-				handleError(q, c, fmt.Sprintf("[%s] error (%s) decoding message %s", c, err.Error(), data))
+				handleError(q, c, "error (%s) decoding message %s", err.Error(), data)
 				continue
 			}
 
+			msg.nsqdAddress = c.String()
+
 			remain := atomic.AddInt64(&c.rdyCount, -1)
+			atomic.StoreInt64(&c.lastMsgTime, time.Now().UnixNano())
 			atomic.AddUint64(&c.messagesReceived, 1)
 			atomic.AddUint64(&q.MessagesReceived, 1)
 			atomic.AddInt64(&c.messagesInFlight, 1)
 			atomic.AddInt64(&q.messagesInFlight, 1)
 
-			if q.VerboseLogging {
-				log.Printf("[%s] (remain %d) FrameTypeMessage: %s - %s", c, remain, msg.Id, msg.Body)
+			q.log(c).Debugf("(remain %d) FrameTypeMessage: %s - %s", remain, msg.Id, msg.Body)
+
+			msgTimeout := c.msgTimeout
+			if msgTimeout == 0 {
+				msgTimeout = DefaultMsgTimeout
 			}
+			deadline := time.Now().Add(msgTimeout * 9 / 10)
 
-			q.incomingMessages <- &incomingMessage{msg, c.finishedMessages}
+			select {
+			case q.incomingMessages <- &incomingMessage{msg, c.finishedMessages, deadline}:
+			case <-q.handlerExitChan:
+				// the handlers were stopped before draining, hand it back to nsqd
+				q.log(c).Infof("requeuing %s (handlers stopped)", msg.Id)
+				c.finishedMessages <- &FinishedMessage{msg.Id, 0, false}
+			}
 		case FrameTypeResponse:
 			switch {
 			case bytes.Equal(data, []byte("CLOSE_WAIT")):
 				// server is ready for us to close (it ack'd our StartClose)
 				// we can assume we will not receive any more messages over this channel
 				// (but we can still write back responses)
-				log.Printf("[%s] received ACK from nsqd - now in CLOSE_WAIT", c)
+				q.log(c).Infof("received ACK from nsqd - now in CLOSE_WAIT")
 				atomic.StoreInt32(&c.stopFlag, 1)
 			case bytes.Equal(data, []byte("_heartbeat_")):
 				var buf bytes.Buffer
-				log.Printf("[%s] received heartbeat from nsqd", c)
+				q.log(c).Infof("received heartbeat from nsqd")
 				err := c.sendCommand(&buf, Nop())
 				if err != nil {
-					handleError(q, c, fmt.Sprintf("[%s] error sending NOP - %s", c, err.Error()))
+					handleError(q, c, "error sending NOP - %s", err.Error())
 					return
 				}
 			}
 		case FrameTypeError:
-			log.Printf("[%s] error from nsqd %s", c, data)
+			q.logError(c, "error from nsqd %s", data)
 		default:
-			log.Printf("[%s] unknown message type %d", c, frameType)
+			q.logError(c, "unknown message type %d", frameType)
 		}
 
 		q.updateReady(c)
@@ -480,7 +656,7 @@ func (q *Reader) finishLoop(c *nsqConn) {
 	for {
 		select {
 		case <-c.dying:
-			log.Printf("[%s] breaking out of finish loop ", c)
+			q.log(c).Infof("breaking out of finish loop")
 			// Indicate drainReady because we will not pull any more off finishedMessages
 			c.drainReady <- struct{}{}
 			return
@@ -490,29 +666,27 @@ func (q *Reader) finishLoop(c *nsqConn) {
 			atomic.AddInt64(&c.messagesInFlight, -1)
 
 			if msg.Success {
-				if q.VerboseLogging {
-					log.Printf("[%s] finishing %s", c, msg.Id)
-				}
+				q.log(c).Debugf("finishing %s", msg.Id)
 				err := c.sendCommand(&buf, Finish(msg.Id))
 				if err != nil {
-					log.Printf("[%s] error finishing %s - %s", c, msg.Id, err.Error())
+					q.logError(c, "error finishing %s - %s", msg.Id, err.Error())
 					q.stopFinishLoop(c)
 					continue
 				}
 				atomic.AddUint64(&c.messagesFinished, 1)
 				atomic.AddUint64(&q.MessagesFinished, 1)
+				q.updateBackoff(true)
 			} else {
-				if q.VerboseLogging {
-					log.Printf("[%s] requeuing %s", c, msg.Id)
-				}
+				q.log(c).Debugf("requeuing %s", msg.Id)
 				err := c.sendCommand(&buf, Requeue(msg.Id, msg.RequeueDelayMs))
 				if err != nil {
-					log.Printf("[%s] error requeueing %s - %s", c, msg.Id, err.Error())
+					q.logError(c, "error requeueing %s - %s", msg.Id, err.Error())
 					q.stopFinishLoop(c)
 					continue
 				}
 				atomic.AddUint64(&c.messagesRequeued, 1)
 				atomic.AddUint64(&q.MessagesRequeued, 1)
+				q.updateBackoff(false)
 			}
 
 			if atomic.LoadInt64(&c.messagesInFlight) == 0 &&
@@ -526,7 +700,7 @@ func (q *Reader) finishLoop(c *nsqConn) {
 
 func (q *Reader) stopFinishLoop(c *nsqConn) {
 	c.stopper.Do(func() {
-		log.Printf("[%s] beginning stopFinishLoop logic", c)
+		q.log(c).Infof("beginning stopFinishLoop logic")
 		// This doesn't block because dying has buffer of 1
 		c.dying <- struct{}{}
 
@@ -538,96 +712,142 @@ func (q *Reader) stopFinishLoop(c *nsqConn) {
 			}
 		}()
 		c.Close()
+		q.connMtx.Lock()
 		delete(q.nsqConnections, c.String())
+		numConns := len(q.nsqConnections)
+		numLookupd := len(q.lookupdHTTPAddrs)
+		q.connMtx.Unlock()
 
-		log.Printf("there are %d connections left alive", len(q.nsqConnections))
+		q.log(nil).Infof("there are %d connections left alive", numConns)
 
-		if len(q.nsqConnections) == 0 && len(q.lookupdHTTPAddrs) == 0 {
+		q.backoffConnClosed(c)
+		q.scheduleReconnect(c.String())
+
+		if numConns == 0 && numLookupd == 0 {
 			// no lookupd entry means no reconnection
 			if atomic.LoadInt32(&q.stopFlag) == 1 {
-				q.stopHandlers()
+				q.drained()
 			}
 			return
 		}
 
 		// ie: we were the last one, and stopping
-		if len(q.nsqConnections) == 0 && atomic.LoadInt32(&q.stopFlag) == 1 {
-			q.stopHandlers()
+		if numConns == 0 && atomic.LoadInt32(&q.stopFlag) == 1 {
+			q.drained()
 		}
 
-		if len(q.lookupdHTTPAddrs) != 0 && atomic.LoadInt32(&q.stopFlag) == 0 {
+		if numLookupd != 0 && atomic.LoadInt32(&q.stopFlag) == 0 {
 			// trigger a poll of the lookupd
-			select {
-			case q.lookupdRecheckChan <- 1:
-			default:
-			}
+			q.recheckLookupd()
 		}
 	})
 }
 
 func (q *Reader) updateReady(c *nsqConn) error {
-	var buf bytes.Buffer
-
 	if atomic.LoadInt32(&c.stopFlag) != 0 {
 		return nil
 	}
 
+	q.rdyMtx.Lock()
+	defer q.rdyMtx.Unlock()
+
+	if q.backoffState != BackoffNone {
+		// RDY is managed by the backoff (see updateBackoff)
+		return nil
+	}
+
 	remain := atomic.LoadInt64(&c.rdyCount)
 	mif := q.ConnectionMaxInFlight()
 	// refill when at 1, or at 25% whichever comes first
 	if remain <= 1 || remain < (int64(mif)/int64(4)) {
-		if q.VerboseLogging {
-			log.Printf("[%s] sending RDY %d (%d remain)", c, mif, remain)
-		}
-		atomic.StoreInt64(&c.rdyCount, int64(mif))
-		err := c.sendCommand(&buf, Ready(mif))
-		if err != nil {
-			handleError(q, c, fmt.Sprintf("[%s] error sending RDY %d - %s", c, mif, err.Error()))
-			return err
+		maxInFlight := q.MaxInFlight()
+		if q.connectionCount() > maxInFlight &&
+			q.totalRdyCount()-remain+int64(mif) > int64(maxInFlight) {
+			// there are more connections than max-in-flight, the remaining RDY
+			// is handed out by rotateRDY
+			q.log(c).Debugf("skip sending RDY (max-in-flight %d in use)", maxInFlight)
+			return nil
 		}
+		q.log(c).Debugf("sending RDY %d (%d remain)", mif, remain)
+		return q.sendReady(c, mif)
 	} else {
-		if q.VerboseLogging {
-			log.Printf("[%s] skip sending RDY (%d remain out of %d)", c, remain, mif)
-		}
+		q.log(c).Debugf("skip sending RDY (%d remain out of %d)", remain, mif)
 	}
 
 	return nil
 }
 
 // Stop will gracefully stop the Reader
+//
+// Connections are closed once their in-flight messages are responded to, the handlers
+// are closed after at most DrainTimeout.
 func (q *Reader) Stop() {
+	q.stop(q.DrainTimeout)
+}
+
+// StopContext will gracefully stop the Reader and wait until in-flight messages are
+// responded to (FINished or REQueued) and all connections are closed.
+//
+// If ctx is done first the handlers are closed and ctx.Err() is returned.
+func (q *Reader) StopContext(ctx context.Context) error {
+	q.stop(0)
+
+	select {
+	case <-q.drainChan:
+		return nil
+	case <-ctx.Done():
+		q.log(nil).Infof("stopped before draining - %s", ctx.Err())
+		q.stopHandlers()
+		return ctx.Err()
+	}
+}
+
+// stop starts closing the connections, the handlers are closed after drainTimeout (when > 0)
+func (q *Reader) stop(drainTimeout time.Duration) {
 	var buf bytes.Buffer
 
 	if !atomic.CompareAndSwapInt32(&q.stopFlag, 0, 1) {
 		return
 	}
 
-	log.Printf("Stopping reader")
+	q.log(nil).Infof("Stopping reader")
+	q.stopCancel()
+	q.stopBackoff()
+	q.stopReconnects()
 
-	if len(q.nsqConnections) == 0 {
-		q.stopHandlers()
+	conns := q.conns()
+	if len(conns) == 0 {
+		q.drained()
 	} else {
-		for _, c := range q.nsqConnections {
+		for _, c := range conns {
 			err := c.sendCommand(&buf, StartClose())
 			if err != nil {
-				log.Printf("[%s] failed to start close - %s", c, err.Error())
+				q.logError(c, "failed to start close - %s", err.Error())
 			}
 		}
-		go func() {
-			<-time.After(time.Duration(30) * time.Second)
-			q.stopHandlers()
-		}()
+		if drainTimeout > 0 {
+			go func() {
+				<-time.After(drainTimeout)
+				q.stopHandlers()
+			}()
+		}
 	}
+}
 
-	if len(q.lookupdHTTPAddrs) != 0 {
-		q.lookupdExitChan <- 1
-	}
+// drained is called once all connections are closed while stopping
+func (q *Reader) drained() {
+	q.drainOnce.Do(func() {
+		close(q.drainChan)
+	})
+	q.stopHandlers()
 }
 
 func (q *Reader) stopHandlers() {
 	q.stopHandler.Do(func() {
-		log.Printf("closing incomingMessages")
-		close(q.incomingMessages)
+		q.log(nil).Infof("closing handlers")
+		// incomingMessages is never closed, readLoop may still be sending to it
+		close(q.handlerExitChan)
+		close(q.rdyExitChan)
 	})
 }
 
@@ -638,47 +858,82 @@ func (q *Reader) stopHandlers() {
 // It's ok to start more than one handler simultaneously, they
 // are concurrently executed in goroutines.
 func (q *Reader) AddHandler(handler Handler) {
+	q.addHandler("Handler", handler, func(message *incomingMessage) error {
+		return handler.HandleMessage(message.Message)
+	})
+}
+
+// AddContextHandler adds a ContextHandler for messages received by this Reader.
+//
+// See ContextHandler for details on implementing this interface.
+//
+// It's ok to start more than one handler simultaneously, they
+// are concurrently executed in goroutines.
+func (q *Reader) AddContextHandler(handler ContextHandler) {
+	q.addHandler("ContextHandler", handler, func(message *incomingMessage) error {
+		ctx, cancel := context.WithDeadline(q.stopCtx, message.deadline)
+		defer cancel()
+		return handler.HandleMessage(ctx, message.Message)
+	})
+}
+
+// addHandler starts a goroutine that handles messages with handle (handler is
+// checked for optional interfaces ie. FailedMessageLogger)
+func (q *Reader) addHandler(name string, handler interface{}, handle func(message *incomingMessage) error) {
 	atomic.AddInt32(&q.runningHandlers, 1)
-	log.Println("starting Handler go-routine")
+	q.log(nil).Infof("starting %s go-routine", name)
 	go func() {
 		for {
-			message, ok := <-q.incomingMessages
+			message, ok := q.nextMessage()
 			if !ok {
-				log.Printf("closing Handler (after self.incomingMessages closed)")
+				q.log(nil).Infof("closing %s (after handlerExitChan closed)", name)
 				if atomic.AddInt32(&q.runningHandlers, -1) == 0 {
 					q.ExitChan <- 1
 				}
 				break
 			}
 
-			err := handler.HandleMessage(message.Message)
+			start := time.Now()
+			err := handle(message)
+			q.handlerLatency.observe(time.Since(start))
 			if err != nil {
-				log.Printf("ERR: handler returned %s for msg %s %s", err.Error(), message.Id, message.Body)
+				q.log(nil).Errorf("handler returned %s for msg %s %s", err.Error(), message.Id, message.Body)
 			}
 
 			// message passed the max number of attempts
 			if err != nil && q.MaxAttemptCount > 0 && message.Attempts > q.MaxAttemptCount {
-				log.Printf("WARNING: msg attempted %d times. giving up %s %s", message.Attempts, message.Id, message.Body)
-				logger, ok := handler.(FailedMessageLogger)
-				if ok {
-					logger.LogFailedMessage(message.Message)
-				}
-				message.responseChannel <- &FinishedMessage{message.Id, 0, true}
+				q.giveUp(handler, message, err)
 				continue
 			}
 
-			// linear delay
-			requeueDelay := q.DefaultRequeueDelay * time.Duration(message.Attempts)
-			// bound the requeueDelay to configured max
-			if requeueDelay > q.MaxRequeueDelay {
-				requeueDelay = q.MaxRequeueDelay
-			}
-
+			requeueDelay := q.requeueDelay(message.Message)
 			message.responseChannel <- &FinishedMessage{message.Id, int(requeueDelay / time.Millisecond), err == nil}
 		}
 	}()
 }
 
+// nextMessage returns the next message for a handler, ok is false once the handlers
+// are stopped
+func (q *Reader) nextMessage() (message *incomingMessage, ok bool) {
+	select {
+	case message = <-q.incomingMessages:
+		return message, true
+	case <-q.handlerExitChan:
+		return nil, false
+	}
+}
+
+// requeueDelay is the default delay when REQueueing message
+func (q *Reader) requeueDelay(message *Message) time.Duration {
+	// linear delay
+	requeueDelay := q.DefaultRequeueDelay * time.Duration(message.Attempts)
+	// bound the requeueDelay to configured max
+	if requeueDelay > q.MaxRequeueDelay {
+		requeueDelay = q.MaxRequeueDelay
+	}
+	return requeueDelay
+}
+
 // AddAsyncHandler adds an AsyncHandler for messages received by this Reader.
 //
 // See AsyncHandler for details on implementing this interface.
@@ -687,12 +942,12 @@ func (q *Reader) AddHandler(handler Handler) {
 // are concurrently executed in goroutines.
 func (q *Reader) AddAsyncHandler(handler AsyncHandler) {
 	atomic.AddInt32(&q.runningHandlers, 1)
-	log.Println("starting AsyncHandler go-routine")
+	q.log(nil).Infof("starting AsyncHandler go-routine")
 	go func() {
 		for {
-			message, ok := <-q.incomingMessages
+			message, ok := q.nextMessage()
 			if !ok {
-				log.Printf("closing AsyncHandler (after self.incomingMessages closed)")
+				q.log(nil).Infof("closing AsyncHandler (after handlerExitChan closed)")
 				if atomic.AddInt32(&q.runningHandlers, -1) == 0 {
 					q.ExitChan <- 1
 				}
@@ -702,12 +957,7 @@ func (q *Reader) AddAsyncHandler(handler AsyncHandler) {
 			// message passed the max number of attempts
 			// note: unfortunately it's not straight forward to do this after passing to async handler, so we don't.
 			if q.MaxAttemptCount > 0 && message.Attempts > q.MaxAttemptCount {
-				log.Printf("WARNING: msg attempted %d times. giving up %s %s", message.Attempts, message.Id, message.Body)
-				logger, ok := handler.(FailedMessageLogger)
-				if ok {
-					logger.LogFailedMessage(message.Message)
-				}
-				message.responseChannel <- &FinishedMessage{message.Id, 0, true}
+				q.giveUp(handler, message, nil)
 				continue
 			}
 
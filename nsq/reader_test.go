@@ -2,14 +2,20 @@ package nsq
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/bitly/go-simplejson"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -99,3 +105,326 @@ func TestQueuereader(t *testing.T) {
 		t.Fatal("failed message not done")
 	}
 }
+
+type BackoffTestHandler struct{}
+
+func (h *BackoffTestHandler) HandleMessage(message *Message) error {
+	if string(message.Body) == "fail" && message.Attempts == 1 {
+		return errors.New("fail this message once")
+	}
+	return nil
+}
+
+func TestReaderBackoff(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_backoff_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	// the failed message is redelivered after the backoff wait
+	q.DefaultRequeueDelay = 100 * time.Millisecond
+	q.BackoffMultiplier = 50 * time.Millisecond
+	q.SetMaxInFlight(5)
+
+	var lock sync.Mutex
+	var states []BackoffState
+	q.BackoffStateChanged = func(state BackoffState, level int, delay time.Duration) {
+		lock.Lock()
+		states = append(states, state)
+		lock.Unlock()
+		if state == BackoffNone {
+			q.Stop()
+		}
+	}
+
+	q.AddHandler(&BackoffTestHandler{})
+
+	SendMessage(t, 4151, topicName, "mput", []byte("fail\nok\nok"))
+
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	<-q.ExitChan
+
+	// a failure backs off until a successful probe
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []BackoffState{BackoffActive, BackoffProbe, BackoffNone}
+	if fmt.Sprint(states) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected backoff states %v", states)
+	}
+	if q.BackoffLevel() != 0 {
+		t.Fatalf("backoff level should be 0")
+	}
+}
+
+// tcpProxy forwards connections to an nsqd so that tests can drop them
+type tcpProxy struct {
+	sync.Mutex
+	listener net.Listener
+	target   string
+	accepted int
+	conns    []net.Conn
+}
+
+func newTCPProxy(t *testing.T, target string) *tcpProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	p := &tcpProxy{listener: listener, target: target}
+	go func() {
+		for {
+			clientConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			targetConn, err := net.Dial("tcp", target)
+			if err != nil {
+				clientConn.Close()
+				continue
+			}
+			p.Lock()
+			p.accepted++
+			p.conns = append(p.conns, clientConn, targetConn)
+			p.Unlock()
+			go io.Copy(clientConn, targetConn)
+			go io.Copy(targetConn, clientConn)
+		}
+	}()
+	return p
+}
+
+func (p *tcpProxy) Accepted() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.accepted
+}
+
+func (p *tcpProxy) DropConns() {
+	p.Lock()
+	defer p.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+type CountingTestHandler struct {
+	received int32
+}
+
+func (h *CountingTestHandler) HandleMessage(message *Message) error {
+	atomic.AddInt32(&h.received, 1)
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReaderReconnect(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	proxy := newTCPProxy(t, "127.0.0.1:4150")
+	addr := proxy.listener.Addr().String()
+
+	topicName := "reader_reconnect_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.ReconnectMultiplier = 50 * time.Millisecond
+	h := &CountingTestHandler{}
+	q.AddHandler(h)
+
+	err := q.ConnectToNSQ(addr)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	SendMessage(t, 4151, topicName, "put", []byte("1"))
+	waitFor(t, "the 1st message", func() bool { return atomic.LoadInt32(&h.received) == 1 })
+
+	// the dropped connection is re-established
+	proxy.DropConns()
+	waitFor(t, "the reconnection", func() bool {
+		stats := q.ConnectionStats()
+		return proxy.Accepted() == 2 && len(stats) == 1 && stats[0].State == ConnectionConnected
+	})
+
+	if stats := q.Stats(); stats.Reconnects != 1 || stats.Connections[0].Reconnects != 1 {
+		t.Fatalf("unexpected reconnects %+v", stats)
+	}
+
+	SendMessage(t, 4151, topicName, "put", []byte("2"))
+	waitFor(t, "the 2nd message", func() bool { return atomic.LoadInt32(&h.received) == 2 })
+
+	// reconnection keeps failing while the address is unavailable
+	proxy.listener.Close()
+	proxy.DropConns()
+	waitFor(t, "a failed reconnection", func() bool {
+		stats := q.ConnectionStats()
+		return len(stats) == 1 && stats[0].State == ConnectionReconnecting && stats[0].Attempts > 0
+	})
+	stats := q.ConnectionStats()
+	if !stats[0].Direct || stats[0].Addr != addr || stats[0].LastError == "" {
+		t.Fatalf("unexpected connection stats %+v", stats[0])
+	}
+	if q.Stats().LastError == "" {
+		t.Fatalf("the failed reconnection is not the last error")
+	}
+
+	q.Stop()
+	<-q.ExitChan
+}
+
+func TestReaderIdentify(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_identify_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.AddHandler(&CountingTestHandler{})
+
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// settings negotiated with nsqd
+	stats := q.ConnectionStats()
+	if len(stats) != 1 || stats[0].MaxRdyCount != MaxReadyCount ||
+		stats[0].HeartbeatInterval != DefaultClientTimeout/2 || stats[0].ServerVersion == "" {
+		t.Fatalf("unexpected connection stats %+v", stats)
+	}
+
+	q.Stop()
+	<-q.ExitChan
+}
+
+func TestReaderStopContext(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	for i, drain := range []bool{true, false} {
+		topicName := fmt.Sprintf("reader_stop_test%d_%d", time.Now().Unix(), i)
+		q, _ := NewReader(topicName, "ch")
+		received := make(chan int)
+		release := make(chan int)
+		q.AddHandler(HandlerFunc(func(message *Message) error {
+			received <- 1
+			<-release
+			return nil
+		}))
+
+		SendMessage(t, 4151, topicName, "put", []byte("1"))
+		err := q.ConnectToNSQ("127.0.0.1:4150")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		<-received
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		if drain {
+			// the in-flight message is FINished before the deadline
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				close(release)
+			}()
+			err = q.StopContext(ctx)
+			if err != nil || atomic.LoadUint64(&q.MessagesFinished) != 1 {
+				t.Fatalf("StopContext should drain the in-flight message - %v", err)
+			}
+		} else {
+			err = q.StopContext(ctx)
+			if err != context.DeadlineExceeded {
+				t.Fatalf("StopContext should time out - %v", err)
+			}
+			close(release)
+		}
+		cancel()
+		<-q.ExitChan
+	}
+}
+
+func TestReaderStopContextBuffered(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_stop_buf_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.SetMaxInFlight(20)
+	received := make(chan int, 50)
+	q.AddHandler(HandlerFunc(func(message *Message) error {
+		received <- 1
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}))
+
+	body := make([]string, 50)
+	for i := range body {
+		body[i] = strconv.Itoa(i)
+	}
+	SendMessage(t, 4151, topicName, "mput", []byte(strings.Join(body, "\n")))
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-received
+
+	// readLoop is blocked handing over the next message when the handlers are closed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err = q.StopContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("StopContext should time out - %v", err)
+	}
+	<-q.ExitChan
+
+	// the messages readLoop was holding are REQueued once nsqd closes the connection
+	waitFor(t, "the connection to close", func() bool { return len(q.ConnectionStats()) == 0 })
+}
+
+type ContextTestHandler struct {
+	received chan int
+	err      error
+}
+
+func (h *ContextTestHandler) HandleMessage(ctx context.Context, message *Message) error {
+	h.received <- 1
+	<-ctx.Done()
+	h.err = ctx.Err()
+	return nil
+}
+
+func TestReaderContextHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_context_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	h := &ContextTestHandler{received: make(chan int)}
+	q.AddContextHandler(h)
+
+	SendMessage(t, 4151, topicName, "put", []byte("1"))
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-h.received
+
+	// stopping cancels the context of the in-flight message
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = q.StopContext(ctx)
+	if err != nil || h.err != context.Canceled {
+		t.Fatalf("handler context should be cancelled - %v %v", err, h.err)
+	}
+	<-q.ExitChan
+}
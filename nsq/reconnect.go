@@ -0,0 +1,211 @@
+package nsq
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionState is the state of a nsqd connection (see Reader.ConnectionStats)
+type ConnectionState int
+
+const (
+	ConnectionConnected    ConnectionState = iota // connected and subscribed
+	ConnectionReconnecting                        // dropped, waiting to reconnect
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionReconnecting:
+		return "reconnecting"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// MarshalText encodes the state as its String() (ie. in ReaderStats)
+func (s ConnectionState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ConnectionStats describes a nsqd connection of a Reader
+type ConnectionStats struct {
+	Addr             string          `json:"addr"`
+	State            ConnectionState `json:"state"`
+	Direct           bool            `json:"direct"`       // configured via ConnectToNSQ (ie. reconnected when it drops)
+	Attempts         int             `json:"attempts"`     // failed reconnection attempts since the connection dropped
+	Reconnects       int             `json:"reconnects"`   // successful reconnections (of a direct connection)
+	LastError        string          `json:"last_error"`   // the error of the last failed reconnection attempt
+	ConnectedAt      time.Time       `json:"connected_at"` // the time of the last (re)connection
+	RdyCount         int64           `json:"rdy_count"`
+	MessagesInFlight int64           `json:"messages_in_flight"`
+	MessagesReceived uint64          `json:"messages_received"`
+	MessagesFinished uint64          `json:"messages_finished"`
+	MessagesRequeued uint64          `json:"messages_requeued"`
+
+	// negotiated with nsqd in IDENTIFY (only MaxRdyCount, the default MaxReadyCount,
+	// is set when nsqd does not support feature negotiation)
+	MaxRdyCount       int64         `json:"max_rdy_count"`
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	MsgTimeout        time.Duration `json:"msg_timeout"`
+	ServerVersion     string        `json:"server_version"`
+}
+
+// nsqdAddr is the reconnection state of an address configured via ConnectToNSQ
+type nsqdAddr struct {
+	state       ConnectionState
+	attempts    int
+	reconnects  int
+	lastError   string
+	connectedAt time.Time
+	timer       *time.Timer
+}
+
+// ConnectionStats returns the state of the connections to nsqd, including the
+// directly configured addresses that are waiting to reconnect
+func (q *Reader) ConnectionStats() []ConnectionStats {
+	q.reconnectMtx.Lock()
+	defer q.reconnectMtx.Unlock()
+
+	conns := q.conns()
+	stats := make([]ConnectionStats, 0, len(conns))
+	for _, c := range conns {
+		addr := c.String()
+		s := ConnectionStats{
+			Addr:             addr,
+			State:            ConnectionConnected,
+			RdyCount:         atomic.LoadInt64(&c.rdyCount),
+			MessagesInFlight: atomic.LoadInt64(&c.messagesInFlight),
+			MessagesReceived: atomic.LoadUint64(&c.messagesReceived),
+			MessagesFinished: atomic.LoadUint64(&c.messagesFinished),
+			MessagesRequeued: atomic.LoadUint64(&c.messagesRequeued),
+
+			MaxRdyCount:       c.maxRdyCount,
+			HeartbeatInterval: c.heartbeatInterval,
+			MsgTimeout:        c.msgTimeout,
+			ServerVersion:     c.serverVersion,
+		}
+		if a, ok := q.nsqdAddrs[addr]; ok {
+			s.Direct = true
+			s.Reconnects = a.reconnects
+			s.ConnectedAt = a.connectedAt
+		}
+		stats = append(stats, s)
+	}
+	for addr, a := range q.nsqdAddrs {
+		if a.state != ConnectionReconnecting {
+			continue
+		}
+		stats = append(stats, ConnectionStats{
+			Addr:        addr,
+			State:       ConnectionReconnecting,
+			Direct:      true,
+			Attempts:    a.attempts,
+			Reconnects:  a.reconnects,
+			LastError:   a.lastError,
+			ConnectedAt: a.connectedAt,
+		})
+	}
+	return stats
+}
+
+// reconnectEnabled indicates whether dropped direct connections are reconnected
+func (q *Reader) reconnectEnabled() bool {
+	q.reconnectMtx.Lock()
+	defer q.reconnectMtx.Unlock()
+	return q.ReconnectMultiplier > 0 && len(q.nsqdAddrs) > 0
+}
+
+// markConnected records a successful connection to addr, which becomes a directly
+// configured address when direct is set
+func (q *Reader) markConnected(addr string, direct bool) {
+	q.reconnectMtx.Lock()
+	defer q.reconnectMtx.Unlock()
+
+	a, ok := q.nsqdAddrs[addr]
+	if !ok {
+		if !direct {
+			return
+		}
+		a = &nsqdAddr{}
+		q.nsqdAddrs[addr] = a
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.state = ConnectionConnected
+	a.attempts = 0
+	a.lastError = ""
+	a.connectedAt = time.Now()
+}
+
+// scheduleReconnect starts reconnecting to addr (when it is directly configured)
+// after a jittered exponential backoff
+func (q *Reader) scheduleReconnect(addr string) {
+	if q.ReconnectMultiplier <= 0 || atomic.LoadInt32(&q.stopFlag) == 1 {
+		return
+	}
+
+	q.reconnectMtx.Lock()
+	defer q.reconnectMtx.Unlock()
+
+	a, ok := q.nsqdAddrs[addr]
+	if !ok {
+		return
+	}
+
+	a.state = ConnectionReconnecting
+	delay := withJitter(exponentialBackoff(q.ReconnectMultiplier,
+		q.MaxReconnectDelay, a.attempts+1))
+	q.log(nil).With("addr", addr).Infof("reconnecting in %s (attempt %d)", delay, a.attempts+1)
+	a.timer = time.AfterFunc(delay, func() { q.reconnect(addr) })
+}
+
+func (q *Reader) reconnect(addr string) {
+	if atomic.LoadInt32(&q.stopFlag) == 1 {
+		return
+	}
+
+	q.reconnectMtx.Lock()
+	a, ok := q.nsqdAddrs[addr]
+	if !ok || a.state != ConnectionReconnecting {
+		q.reconnectMtx.Unlock()
+		return
+	}
+	a.timer = nil
+	q.reconnectMtx.Unlock()
+
+	err := q.connectToNSQ(addr)
+	if err == nil || err == ErrAlreadyConnected {
+		q.log(nil).With("addr", addr).Infof("reconnected")
+		q.markConnected(addr, false)
+		q.reconnectMtx.Lock()
+		a.reconnects++
+		q.reconnectMtx.Unlock()
+		atomic.AddUint64(&q.reconnects, 1)
+		return
+	}
+
+	q.logError(nil, "failed to reconnect to nsqd (%s) - %s", addr, err.Error())
+	q.reconnectMtx.Lock()
+	a.attempts++
+	a.lastError = err.Error()
+	q.reconnectMtx.Unlock()
+
+	q.scheduleReconnect(addr)
+}
+
+// stopReconnects stops any pending reconnection
+func (q *Reader) stopReconnects() {
+	q.reconnectMtx.Lock()
+	defer q.reconnectMtx.Unlock()
+
+	for _, a := range q.nsqdAddrs {
+		if a.timer != nil {
+			a.timer.Stop()
+			a.timer = nil
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package nsq
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// returned from Future.Get() when no reply arrived before the timeout
+var ErrRequestTimeout = errors.New("request timed out")
+
+// returned from Future.Get() for requests that were pending when the Requester stopped
+var ErrRequesterStopped = errors.New("requester stopped")
+
+// returned from Responder.Reply() for messages that were not sent by a Requester
+var ErrNoReplyTo = errors.New("message has no reply_to header")
+
+// returned from Responder.Reply() for messages that were not received by a Reader
+var ErrNoReplyAddress = errors.New("message was not received from nsqd")
+
+// publisher is a connection to nsqd used to synchronously publish messages
+// (ie. one at a time, waiting for the response).  It connects on demand.
+type publisher struct {
+	sync.Mutex
+	addr    string
+	timeout time.Duration
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+}
+
+func newPublisher(addr string) *publisher {
+	return &publisher{
+		addr:    addr,
+		timeout: time.Second,
+	}
+}
+
+func (p *publisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, time.Second)
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	_, err = conn.Write(MagicV2)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("[%s] failed to write magic - %s", p.addr, err.Error())
+	}
+
+	p.conn = conn
+	p.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return nil
+}
+
+func (p *publisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// publish sends cmd and waits for nsqd to respond, an idle connection might have
+// been closed by nsqd (after its client timeout) so a failure to talk to nsqd is
+// retried once on a new connection
+func (p *publisher) publish(cmd *Command) error {
+	p.Lock()
+	defer p.Unlock()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if p.conn == nil {
+			err = p.connect()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = p.exec(cmd)
+		if _, ok := err.(*ClientErr); ok || err == nil {
+			return err
+		}
+		p.close()
+	}
+	return err
+}
+
+func (p *publisher) exec(cmd *Command) error {
+	p.conn.SetDeadline(time.Now().Add(p.timeout))
+
+	err := cmd.Write(p.rw)
+	if err != nil {
+		return err
+	}
+	err = p.rw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := ReadResponse(p.rw)
+		if err != nil {
+			return err
+		}
+
+		frameType, data, err := UnpackResponse(resp)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case frameType == FrameTypeError:
+			return ParseClientErr(data, fmt.Sprintf("[%s] error from nsqd %s", p.addr, data))
+		case bytes.Equal(data, []byte("_heartbeat_")):
+			// nsqd heartbeats every client, the response to cmd follows
+			continue
+		case bytes.Equal(data, []byte("OK")):
+			return nil
+		}
+		return fmt.Errorf("[%s] unexpected response %s", p.addr, data)
+	}
+}
+
+// Future is the pending reply to a request made by a Requester
+type Future struct {
+	CorrelationId string
+
+	done  chan struct{}
+	once  sync.Once
+	timer *time.Timer
+	reply *Message
+	err   error
+}
+
+func (f *Future) complete(reply *Message, err error) {
+	f.once.Do(func() {
+		f.reply = reply
+		f.err = err
+		close(f.done)
+	})
+}
+
+// Done returns a channel that is closed once the reply arrived (or the request failed)
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Get waits for the reply to the request.
+//
+// It returns ErrRequestTimeout if the reply did not arrive in time and
+// ErrRequesterStopped if the Requester was stopped while waiting.
+func (f *Future) Get() (*Message, error) {
+	<-f.done
+	return f.reply, f.err
+}
+
+// Requester is a high-level type to make requests over NSQ (ie. RPC).
+//
+// Requests are published to a topic with a reply_to header naming an ephemeral
+// reply topic, that only this Requester consumes (from the same nsqd), and a
+// correlation_id header used to match replies with requests.  Handlers reply
+// to requests using a Responder.
+type Requester struct {
+	Timeout time.Duration // the default time to wait for a reply
+
+	replyTopic string
+	publisher  *publisher
+	reader     *Reader
+	nextId     uint64
+	stopFlag   int32
+
+	sync.Mutex
+	pending map[string]*Future
+}
+
+// NewRequester creates a Requester that publishes requests to (and consumes
+// replies from) the nsqd at the specified TCP address
+func NewRequester(addr string) (*Requester, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Requester{
+		Timeout:    10 * time.Second,
+		replyTopic: fmt.Sprintf("rpc_%x#ephemeral", b),
+		publisher:  newPublisher(addr),
+		pending:    make(map[string]*Future),
+	}
+
+	// the ephemeral reply channel (and so the ephemeral topic) goes away
+	// when we disconnect
+	r.reader, err = NewReader(r.replyTopic, "reply#ephemeral")
+	if err != nil {
+		return nil, err
+	}
+	r.reader.MessageHeaders = true
+	r.reader.SetMaxInFlight(MaxReadyCount)
+	r.reader.AddHandler(r)
+
+	err = r.reader.ConnectToNSQ(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ReplyTopic returns the name of the topic replies are published to
+func (r *Requester) ReplyTopic() string {
+	return r.replyTopic
+}
+
+// Request publishes body to the specified topic and returns a Future for the
+// reply, which times out after the Requester's Timeout
+func (r *Requester) Request(topic string, body []byte) (*Future, error) {
+	return r.RequestTimeout(topic, body, r.Timeout)
+}
+
+// RequestTimeout publishes body to the specified topic and returns a Future
+// for the reply, which times out after the specified duration
+func (r *Requester) RequestTimeout(topic string, body []byte, timeout time.Duration) (*Future, error) {
+	if atomic.LoadInt32(&r.stopFlag) == 1 {
+		return nil, ErrRequesterStopped
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&r.nextId, 1), 10)
+	cmd, err := PublishWithHeaders(topic, map[string]string{
+		ReplyToHeader:       r.replyTopic,
+		CorrelationIdHeader: id,
+	}, body)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Future{
+		CorrelationId: id,
+		done:          make(chan struct{}),
+	}
+	r.Lock()
+	r.pending[id] = f
+	f.timer = time.AfterFunc(timeout, func() {
+		r.complete(id, nil, ErrRequestTimeout)
+	})
+	r.Unlock()
+
+	err = r.publisher.publish(cmd)
+	if err != nil {
+		r.complete(id, nil, err)
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (r *Requester) complete(id string, reply *Message, err error) bool {
+	r.Lock()
+	f, ok := r.pending[id]
+	delete(r.pending, id)
+	r.Unlock()
+
+	if !ok {
+		return false
+	}
+	f.timer.Stop()
+	f.complete(reply, err)
+	return true
+}
+
+// HandleMessage implements Handler for the reply topic
+func (r *Requester) HandleMessage(message *Message) error {
+	id := message.Headers[CorrelationIdHeader]
+	if !r.complete(id, message, nil) {
+		// the request already timed out
+		r.reader.log(nil).Warnf("dropping reply %s for unknown correlation_id %q", message.Id, id)
+	}
+	return nil
+}
+
+// Stop fails any pending requests and disconnects from nsqd
+func (r *Requester) Stop() {
+	if !atomic.CompareAndSwapInt32(&r.stopFlag, 0, 1) {
+		return
+	}
+
+	r.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*Future)
+	r.Unlock()
+
+	for _, f := range pending {
+		f.timer.Stop()
+		f.complete(nil, ErrRequesterStopped)
+	}
+
+	r.reader.Stop()
+	// nobody else waits for the reader to exit
+	go func() {
+		<-r.reader.ExitChan
+	}()
+
+	r.publisher.Lock()
+	r.publisher.close()
+	r.publisher.Unlock()
+}
+
+// Responder publishes replies to requests made by a Requester, for use in
+// Handler implementations:
+//
+//     func (h *MyHandler) HandleMessage(message *nsq.Message) error {
+//         ...
+//         return h.responder.Reply(message, result)
+//     }
+//
+// The Reader consuming the requests must set MessageHeaders.  Replies are published
+// to the nsqd a request was received from (which is where its Requester consumes
+// replies), never to an address supplied by the request.
+type Responder struct {
+	sync.Mutex
+	publishers map[string]*publisher
+}
+
+// NewResponder creates a Responder, connections to the nsqd a reply is
+// published to are made on demand (and reused)
+func NewResponder() *Responder {
+	return &Responder{
+		publishers: make(map[string]*publisher),
+	}
+}
+
+// Reply publishes body as the reply to the request message
+func (r *Responder) Reply(request *Message, body []byte) error {
+	topic := request.Headers[ReplyToHeader]
+	if topic == "" {
+		return ErrNoReplyTo
+	}
+	addr := request.nsqdAddress
+	if addr == "" {
+		return ErrNoReplyAddress
+	}
+
+	cmd, err := PublishWithHeaders(topic, map[string]string{
+		CorrelationIdHeader: request.Headers[CorrelationIdHeader],
+	}, body)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	p, ok := r.publishers[addr]
+	if !ok {
+		p = newPublisher(addr)
+		r.publishers[addr] = p
+	}
+	r.Unlock()
+
+	return p.publish(cmd)
+}
+
+// Stop closes the connections used to publish replies
+func (r *Responder) Stop() {
+	r.Lock()
+	defer r.Unlock()
+	for addr, p := range r.publishers {
+		p.Lock()
+		p.close()
+		p.Unlock()
+		delete(r.publishers, addr)
+	}
+}
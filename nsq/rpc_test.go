@@ -0,0 +1,116 @@
+package nsq
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type EchoHandler struct {
+	responder *Responder
+}
+
+func (h *EchoHandler) HandleMessage(message *Message) error {
+	return h.responder.Reply(message, bytes.ToUpper(message.Body))
+}
+
+func TestRequestReply(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	addr := "127.0.0.1:4150"
+	topicName := "rpc_test" + strconv.Itoa(int(time.Now().Unix()))
+
+	responder := NewResponder()
+	defer responder.Stop()
+
+	q, _ := NewReader(topicName, "ch")
+	q.MessageHeaders = true
+	q.AddHandler(&EchoHandler{responder})
+	err := q.ConnectToNSQ(addr)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer q.Stop()
+
+	requester, err := NewRequester(addr)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer requester.Stop()
+
+	futures := make([]*Future, 0)
+	for i := 0; i < 5; i++ {
+		f, err := requester.Request(topicName, []byte("ping"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		futures = append(futures, f)
+	}
+
+	for i, f := range futures {
+		reply, err := f.Get()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if string(reply.Body) != "PING"+strconv.Itoa(i) {
+			t.Fatalf("unexpected reply %s to request %d", reply.Body, i)
+		}
+		if reply.Headers[CorrelationIdHeader] != f.CorrelationId {
+			t.Fatalf("unexpected correlation_id %s", reply.Headers[CorrelationIdHeader])
+		}
+	}
+
+	err = responder.Reply(NewMessage(MessageID{}, []byte("no headers")), nil)
+	if err != ErrNoReplyTo {
+		t.Fatalf("should not be able to reply to a message without reply_to")
+	}
+
+	// the address a reply is published to can't be supplied by the request
+	forged := NewMessage(MessageID{}, []byte("forged"))
+	forged.Headers = map[string]string{ReplyToHeader: "reply", "reply_address": "127.0.0.1:1"}
+	err = responder.Reply(forged, nil)
+	if err != ErrNoReplyAddress {
+		t.Fatalf("should not be able to reply to a message that wasn't received from nsqd - %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	requester, err := NewRequester("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// nobody consumes this topic
+	topicName := "rpc_timeout_test" + strconv.Itoa(int(time.Now().Unix()))
+	f, err := requester.RequestTimeout(topicName, []byte("ping"), 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = f.Get()
+	if err != ErrRequestTimeout {
+		t.Fatalf("request should have timed out - %v", err)
+	}
+
+	f, err = requester.Request(topicName, []byte("ping"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	requester.Stop()
+	_, err = f.Get()
+	if err != ErrRequesterStopped {
+		t.Fatalf("request should have failed on Stop() - %v", err)
+	}
+
+	_, err = requester.Request(topicName, []byte("ping"))
+	if err != ErrRequesterStopped {
+		t.Fatalf("should not be able to request after Stop()")
+	}
+}
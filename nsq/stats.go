@@ -0,0 +1,209 @@
+package nsq
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ReaderStats is a snapshot of the state of a Reader (see Reader.Stats)
+type ReaderStats struct {
+	TopicName        string       `json:"topic_name"`
+	ChannelName      string       `json:"channel_name"`
+	ConnectionCount  int          `json:"connection_count"` // # of connected nsqd
+	MaxInFlight      int          `json:"max_in_flight"`
+	RdyCount         int64        `json:"rdy_count"` // the sum of the RDY counts of the connections
+	MessagesInFlight int64        `json:"messages_in_flight"`
+	MessagesReceived uint64       `json:"messages_received"`
+	MessagesFinished uint64       `json:"messages_finished"`
+	MessagesRequeued uint64       `json:"messages_requeued"`
+	BackoffState     BackoffState `json:"backoff_state"`
+	BackoffLevel     int          `json:"backoff_level"`
+	Reconnects       uint64       `json:"reconnects"` // successful reconnections to ConnectToNSQ addresses
+	LastError        string       `json:"last_error"`
+	LastErrorTime    time.Time    `json:"last_error_time"`
+
+	// the duration of Handler and ContextHandler calls, and of BatchHandler calls
+	// (per batch), AsyncHandler messages are not measured
+	HandlerLatency LatencyHistogram `json:"handler_latency"`
+
+	Connections []ConnectionStats `json:"connections"`
+}
+
+// Stats returns the aggregate and per-connection stats of the Reader
+func (q *Reader) Stats() ReaderStats {
+	q.rdyMtx.Lock()
+	backoffState, backoffLevel := q.backoffState, q.backoffLevel
+	q.rdyMtx.Unlock()
+
+	q.statsMtx.Lock()
+	lastError, lastErrorTime := q.lastError, q.lastErrorTime
+	q.statsMtx.Unlock()
+
+	stats := ReaderStats{
+		TopicName:        q.TopicName,
+		ChannelName:      q.ChannelName,
+		MaxInFlight:      q.MaxInFlight(),
+		MessagesInFlight: atomic.LoadInt64(&q.messagesInFlight),
+		MessagesReceived: atomic.LoadUint64(&q.MessagesReceived),
+		MessagesFinished: atomic.LoadUint64(&q.MessagesFinished),
+		MessagesRequeued: atomic.LoadUint64(&q.MessagesRequeued),
+		BackoffState:     backoffState,
+		BackoffLevel:     backoffLevel,
+		Reconnects:       atomic.LoadUint64(&q.reconnects),
+		LastError:        lastError,
+		LastErrorTime:    lastErrorTime,
+		HandlerLatency:   q.handlerLatency.snapshot(),
+		Connections:      q.ConnectionStats(),
+	}
+	for _, c := range stats.Connections {
+		if c.State == ConnectionConnected {
+			stats.ConnectionCount++
+			stats.RdyCount += c.RdyCount
+		}
+	}
+	return stats
+}
+
+// StatsHandler returns an http.Handler responding with the Stats of the Reader as
+// JSON, in the envelope of the nsqd and nsqlookupd HTTP APIs, ie.
+//
+//     {"status_code":200,"status_txt":"OK","data":{"topic_name":"test",...}}
+//
+// durations are in nanoseconds
+func (q *Reader) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		response, err := json.Marshal(struct {
+			StatusCode int         `json:"status_code"`
+			StatusTxt  string      `json:"status_txt"`
+			Data       ReaderStats `json:"data"`
+		}{200, "OK", q.Stats()})
+		statusCode := 200
+		if err != nil {
+			statusCode = 500
+			response = []byte(fmt.Sprintf(`{"status_code":500, "status_txt":"%s", "data":null}`, err.Error()))
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+		w.WriteHeader(statusCode)
+		w.Write(response)
+	})
+}
+
+// setLastError records err as the last error of the Reader (see ReaderStats)
+func (q *Reader) setLastError(err string) {
+	q.statsMtx.Lock()
+	q.lastError = err
+	q.lastErrorTime = time.Now()
+	q.statsMtx.Unlock()
+}
+
+// logError logs an error (for the connection c, if set) and records it as the last
+// error of the Reader
+func (q *Reader) logError(c *nsqConn, format string, args ...interface{}) {
+	err := fmt.Sprintf(format, args...)
+	if c != nil {
+		err = fmt.Sprintf("[%s] %s", c, err)
+	}
+	q.setLastError(err)
+	q.log(c).Errorf(format, args...)
+}
+
+// the upper bounds of the buckets of a LatencyHistogram
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	time.Minute,
+}
+
+// LatencyHistogram is a snapshot of the latency of a Reader's handlers
+type LatencyHistogram struct {
+	Buckets []LatencyBucket `json:"buckets"`
+	Count   uint64          `json:"count"`
+	Sum     time.Duration   `json:"sum"`
+	Max     time.Duration   `json:"max"`
+}
+
+// LatencyBucket is the cumulative # of latencies <= UpperBound
+type LatencyBucket struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Count      uint64        `json:"count"`
+}
+
+// Mean returns the mean latency
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Percentile returns an upper bound of the perc (0-100) percentile, ie. the upper
+// bound of the bucket it falls in (or Max when it exceeds the largest bucket)
+func (h LatencyHistogram) Percentile(perc float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(perc / 100 * float64(h.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	for _, b := range h.Buckets {
+		if b.Count >= rank {
+			if b.UpperBound > h.Max {
+				return h.Max
+			}
+			return b.UpperBound
+		}
+	}
+	return h.Max
+}
+
+// latencyHistogram records latencies with atomic counters
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]uint64 // the last bucket is unbounded
+	sum    int64
+	max    int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			break
+		}
+	}
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	s := LatencyHistogram{
+		Buckets: make([]LatencyBucket, len(latencyBuckets)),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)),
+		Max:     time.Duration(atomic.LoadInt64(&h.max)),
+	}
+	for i := range h.counts {
+		s.Count += atomic.LoadUint64(&h.counts[i])
+		if i < len(latencyBuckets) {
+			s.Buckets[i] = LatencyBucket{latencyBuckets[i], s.Count}
+		}
+	}
+	return s
+}
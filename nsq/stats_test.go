@@ -0,0 +1,100 @@
+package nsq
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	for i := 0; i < 8; i++ {
+		h.observe(500 * time.Microsecond)
+	}
+	h.observe(20 * time.Millisecond)
+	h.observe(2 * time.Minute)
+
+	s := h.snapshot()
+	if s.Count != 10 || s.Max != 2*time.Minute || s.Buckets[0].Count != 8 ||
+		s.Buckets[len(s.Buckets)-1].Count != 9 {
+		t.Fatalf("unexpected histogram %+v", s)
+	}
+	if s.Mean() != (4*time.Millisecond+20*time.Millisecond+2*time.Minute)/10 {
+		t.Fatalf("unexpected mean %s", s.Mean())
+	}
+	for perc, expected := range map[float64]time.Duration{
+		50:  time.Millisecond,
+		90:  50 * time.Millisecond,
+		100: 2 * time.Minute,
+	} {
+		if s.Percentile(perc) != expected {
+			t.Fatalf("p%v %s != %s", perc, s.Percentile(perc), expected)
+		}
+	}
+}
+
+type StatsTestHandler struct {
+	finished int32
+}
+
+func (h *StatsTestHandler) HandleMessage(message *Message) error {
+	if string(message.Body) == "fail" && message.Attempts == 1 {
+		return errors.New("fail this message once")
+	}
+	atomic.AddInt32(&h.finished, 1)
+	return nil
+}
+
+func TestReaderStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "reader_stats_test" + strconv.Itoa(int(time.Now().Unix()))
+	q, _ := NewReader(topicName, "ch")
+	q.SetMaxInFlight(5)
+	q.DefaultRequeueDelay = 10 * time.Millisecond
+	h := &StatsTestHandler{}
+	q.AddHandler(h)
+
+	SendMessage(t, 4151, topicName, "mput", []byte("1\n2\nfail"))
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	waitFor(t, "the messages", func() bool { return atomic.LoadInt32(&h.finished) == 3 })
+	waitFor(t, "the FINs", func() bool { return q.Stats().MessagesFinished == 3 })
+
+	stats := q.Stats()
+	if stats.TopicName != topicName || stats.ConnectionCount != 1 || stats.MaxInFlight != 5 ||
+		stats.MessagesReceived != 4 || stats.MessagesRequeued != 1 || stats.MessagesInFlight != 0 ||
+		stats.BackoffState != BackoffNone || stats.HandlerLatency.Count != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(stats.Connections) != 1 || !stats.Connections[0].Direct ||
+		stats.Connections[0].RdyCount == 0 || stats.RdyCount != stats.Connections[0].RdyCount {
+		t.Fatalf("unexpected connection stats %+v", stats.Connections)
+	}
+
+	server := httptest.NewServer(q.StatsHandler())
+	defer server.Close()
+	data, err := ApiRequest(server.URL)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	received, _ := data.Get("messages_received").Int()
+	backoffState, _ := data.Get("backoff_state").String()
+	addr, _ := data.Get("connections").GetIndex(0).Get("addr").String()
+	latencyCount, _ := data.Get("handler_latency").Get("count").Int()
+	if received != 4 || backoffState != "none" || addr != "127.0.0.1:4150" || latencyCount != 4 {
+		t.Fatalf("unexpected stats response %v", data)
+	}
+
+	q.Stop()
+	<-q.ExitChan
+}
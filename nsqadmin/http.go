@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -25,7 +24,7 @@ func loadTemplates() {
 	})
 	templates, err = t.ParseGlob(fmt.Sprintf("%s/*.html", *templateDir))
 	if err != nil {
-		log.Printf("ERROR: %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to load templates - %s", err.Error())
 	}
 }
 
@@ -47,7 +46,8 @@ func NewSingleHostReverseProxy(target *url.URL, timeout time.Duration) *httputil
 
 func httpServer(listener net.Listener) {
 	loadTemplates()
-	log.Printf("HTTP: listening on %s", listener.Addr().String())
+	l := nsq.NewLogEntry(nil, "addr", listener.Addr().String())
+	l.Infof("listening for HTTP clients")
 	globalCounters = make(map[string]counterData)
 	handler := http.NewServeMux()
 	handler.HandleFunc("/favicon.ico", faviconHandler)
@@ -60,6 +60,8 @@ func httpServer(listener net.Listener) {
 	handler.HandleFunc("/empty_channel", emptyChannelHandler)
 	handler.HandleFunc("/pause_channel", pauseChannelHandler)
 	handler.HandleFunc("/unpause_channel", pauseChannelHandler)
+	handler.HandleFunc("/pause_topic", pauseTopicHandler)
+	handler.HandleFunc("/unpause_topic", pauseTopicHandler)
 	handler.HandleFunc("/counter/data", counterDataHandler)
 	handler.HandleFunc("/counter", counterHandler)
 	handler.HandleFunc("/lookup", lookupHandler)
@@ -67,7 +69,7 @@ func httpServer(listener net.Listener) {
 	if *proxyGraphite {
 		url, err := url.Parse(*graphiteUrl)
 		if err != nil {
-			log.Printf("%s - %v", err.Error(), *graphiteUrl)
+			l.Errorf("invalid --graphite-url %s - %s", *graphiteUrl, err.Error())
 		} else {
 			proxy := NewSingleHostReverseProxy(url, 20*time.Second)
 			handler.Handle("/render", proxy)
@@ -80,10 +82,10 @@ func httpServer(listener net.Listener) {
 	err := server.Serve(listener)
 	// theres no direct way to detect this error because it is not exposed
 	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: http.Serve() - %s", err.Error())
+		l.Errorf("http.Serve() - %s", err.Error())
 	}
 
-	log.Printf("HTTP: closing %s", listener.Addr().String())
+	l.Infof("closing HTTP listener")
 }
 
 func pingHandler(w http.ResponseWriter, req *http.Request) {
@@ -94,7 +96,7 @@ func pingHandler(w http.ResponseWriter, req *http.Request) {
 func indexHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -119,7 +121,7 @@ func indexHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	err = templates.ExecuteTemplate(w, "index.html", p)
 	if err != nil {
-		log.Printf("Template Error %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("template error %s", err.Error())
 		http.Error(w, "Template Error", 500)
 	}
 }
@@ -149,7 +151,7 @@ func topicHandler(w http.ResponseWriter, req *http.Request) {
 
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -188,7 +190,7 @@ func topicHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	err = templates.ExecuteTemplate(w, "topic.html", p)
 	if err != nil {
-		log.Printf("Template Error %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("template error %s", err.Error())
 		http.Error(w, "Template Error", 500)
 	}
 }
@@ -196,7 +198,7 @@ func topicHandler(w http.ResponseWriter, req *http.Request) {
 func channelHandler(w http.ResponseWriter, req *http.Request, topicName string, channelName string) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -230,7 +232,7 @@ func channelHandler(w http.ResponseWriter, req *http.Request, topicName string,
 
 	err = templates.ExecuteTemplate(w, "channel.html", p)
 	if err != nil {
-		log.Printf("Template Error %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("template error %s", err.Error())
 		http.Error(w, "Template Error", 500)
 	}
 }
@@ -238,7 +240,7 @@ func channelHandler(w http.ResponseWriter, req *http.Request, topicName string,
 func lookupHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -269,7 +271,7 @@ func lookupHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	err = templates.ExecuteTemplate(w, "lookup.html", p)
 	if err != nil {
-		log.Printf("Template Error %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("template error %s", err.Error())
 		http.Error(w, "Template Error", 500)
 	}
 }
@@ -277,7 +279,7 @@ func lookupHandler(w http.ResponseWriter, req *http.Request) {
 func createTopicChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -296,10 +298,10 @@ func createTopicChannelHandler(w http.ResponseWriter, req *http.Request) {
 
 	for _, addr := range lookupdHTTPAddrs {
 		endpoint := fmt.Sprintf("http://%s/create_topic?topic=%s", addr, url.QueryEscape(topicName))
-		log.Printf("LOOKUPD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 		_, err := nsq.ApiRequest(endpoint)
 		if err != nil {
-			log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 			continue
 		}
 	}
@@ -308,10 +310,10 @@ func createTopicChannelHandler(w http.ResponseWriter, req *http.Request) {
 		for _, addr := range lookupdHTTPAddrs {
 			endpoint := fmt.Sprintf("http://%s/create_channel?topic=%s&channel=%s",
 				addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-			log.Printf("LOOKUPD: querying %s", endpoint)
+			nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 			_, err := nsq.ApiRequest(endpoint)
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				continue
 			}
 		}
@@ -321,10 +323,10 @@ func createTopicChannelHandler(w http.ResponseWriter, req *http.Request) {
 		for _, addr := range producers {
 			endpoint := fmt.Sprintf("http://%s/create_channel?topic=%s&channel=%s",
 				addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-			log.Printf("NSQD: querying %s", endpoint)
+			nsq.NewLogEntry(nil).Infof("querying nsqd %s", endpoint)
 			_, err := nsq.ApiRequest(endpoint)
 			if err != nil {
-				log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				continue
 			}
 		}
@@ -336,7 +338,7 @@ func createTopicChannelHandler(w http.ResponseWriter, req *http.Request) {
 func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -364,11 +366,11 @@ func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 	// remove the topic from all the lookupds
 	for _, addr := range lookupdHTTPAddrs {
 		endpoint := fmt.Sprintf("http://%s/delete_topic?topic=%s", addr, url.QueryEscape(topicName))
-		log.Printf("LOOKUPD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 
 		_, err := nsq.ApiRequest(endpoint)
 		if err != nil {
-			log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 			continue
 		}
 	}
@@ -376,10 +378,10 @@ func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 	// now remove the topic from all the producers
 	for _, addr := range producers {
 		endpoint := fmt.Sprintf("http://%s/delete_topic?topic=%s", addr, url.QueryEscape(topicName))
-		log.Printf("NSQD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying nsqd %s", endpoint)
 		_, err := nsq.ApiRequest(endpoint)
 		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 			continue
 		}
 	}
@@ -390,7 +392,7 @@ func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -410,11 +412,11 @@ func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 	for _, addr := range lookupdHTTPAddrs {
 		endpoint := fmt.Sprintf("http://%s/delete_channel?topic=%s&channel=%s",
 			addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-		log.Printf("LOOKUPD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 
 		_, err := nsq.ApiRequest(endpoint)
 		if err != nil {
-			log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 			continue
 		}
 	}
@@ -429,10 +431,10 @@ func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 	for _, addr := range producers {
 		endpoint := fmt.Sprintf("http://%s/delete_channel?topic=%s&channel=%s",
 			addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-		log.Printf("NSQD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying nsqd %s", endpoint)
 		_, err := nsq.ApiRequest(endpoint)
 		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 			continue
 		}
 	}
@@ -443,7 +445,7 @@ func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 func emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -464,11 +466,11 @@ func emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 	for _, addr := range producers {
 		endpoint := fmt.Sprintf("http://%s/empty_channel?topic=%s&channel=%s",
 			addr, url.QueryEscape(topicName), url.QueryEscape(channelName))
-		log.Printf("NSQD: calling %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("calling nsqd %s", endpoint)
 
 		_, err := nsq.ApiRequest(endpoint)
 		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 			continue
 		}
 	}
@@ -479,7 +481,7 @@ func emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 func pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -500,11 +502,11 @@ func pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
 	for _, addr := range producers {
 		endpoint := fmt.Sprintf("http://%s%s?topic=%s&channel=%s",
 			addr, req.URL.Path, url.QueryEscape(topicName), url.QueryEscape(channelName))
-		log.Printf("NSQD: calling %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("calling nsqd %s", endpoint)
 
 		_, err := nsq.ApiRequest(endpoint)
 		if err != nil {
-			log.Printf("ERROR: nsqd %s - %s", endpoint, err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 			continue
 		}
 	}
@@ -512,10 +514,45 @@ func pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, fmt.Sprintf("/topic/%s/%s", url.QueryEscape(topicName), url.QueryEscape(channelName)), 302)
 }
 
+func pauseTopicHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
+		http.Error(w, "INVALID_REQUEST", 500)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		http.Error(w, "MISSING_ARG_TOPIC", 500)
+		return
+	}
+
+	var producers []string
+	if len(lookupdHTTPAddrs) != 0 {
+		producers, _ = getLookupdTopicProducers(topicName, lookupdHTTPAddrs)
+	} else {
+		producers, _ = getNSQDTopicProducers(topicName, nsqdHTTPAddrs)
+	}
+
+	for _, addr := range producers {
+		endpoint := fmt.Sprintf("http://%s%s?topic=%s", addr, req.URL.Path, url.QueryEscape(topicName))
+		nsq.NewLogEntry(nil).Infof("calling nsqd %s", endpoint)
+
+		_, err := nsq.ApiRequest(endpoint)
+		if err != nil {
+			nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
+			continue
+		}
+	}
+
+	http.Redirect(w, req, fmt.Sprintf("/topic/%s", url.QueryEscape(topicName)), 302)
+}
+
 func nodesHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -534,7 +571,7 @@ func nodesHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	err = templates.ExecuteTemplate(w, "nodes.html", p)
 	if err != nil {
-		log.Printf("Template Error %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("template error %s", err.Error())
 		http.Error(w, "Template Error", 500)
 	}
 }
@@ -542,7 +579,7 @@ func nodesHandler(w http.ResponseWriter, req *http.Request) {
 func counterHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		http.Error(w, "INVALID_REQUEST", 500)
 		return
 	}
@@ -557,7 +594,7 @@ func counterHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	err = templates.ExecuteTemplate(w, "counter.html", p)
 	if err != nil {
-		log.Printf("Template Error %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("template error %s", err.Error())
 		http.Error(w, "Template Error", 500)
 	}
 }
@@ -573,7 +610,7 @@ var globalCounters map[string]counterData
 func counterDataHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		nsq.NewLogEntry(nil).Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
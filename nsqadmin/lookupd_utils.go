@@ -6,7 +6,6 @@ import (
 	"github.com/lhzd863/nsq-0.2.16/util/semver"
 	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"sort"
 	"strings"
@@ -23,7 +22,7 @@ func getLookupdTopics(lookupdHTTPAddrs []string) ([]string, error) {
 	for _, addr := range lookupdHTTPAddrs {
 		wg.Add(1)
 		endpoint := fmt.Sprintf("http://%s/topics", addr)
-		log.Printf("LOOKUPD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 
 		go func(endpoint string) {
 			data, err := nsq.ApiRequest(endpoint)
@@ -31,7 +30,7 @@ func getLookupdTopics(lookupdHTTPAddrs []string) ([]string, error) {
 			defer lock.Unlock()
 			defer wg.Done()
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				return
 			}
 			success = true
@@ -57,7 +56,7 @@ func getLookupdTopicChannels(topic string, lookupdHTTPAddrs []string) ([]string,
 	for _, addr := range lookupdHTTPAddrs {
 		wg.Add(1)
 		endpoint := fmt.Sprintf("http://%s/channels?topic=%s", addr, url.QueryEscape(topic))
-		log.Printf("LOOKUPD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 
 		go func(endpoint string) {
 			data, err := nsq.ApiRequest(endpoint)
@@ -65,7 +64,7 @@ func getLookupdTopicChannels(topic string, lookupdHTTPAddrs []string) ([]string,
 			defer lock.Unlock()
 			defer wg.Done()
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				return
 			}
 			success = true
@@ -94,14 +93,14 @@ func getLookupdProducers(lookupdHTTPAddrs []string) ([]*Producer, error) {
 	for _, addr := range lookupdHTTPAddrs {
 		wg.Add(1)
 		endpoint := fmt.Sprintf("http://%s/nodes", addr)
-		log.Printf("LOOKUPD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 		go func(endpoint string) {
 			data, err := nsq.ApiRequest(endpoint)
 			lock.Lock()
 			defer lock.Unlock()
 			defer wg.Done()
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				return
 			}
 			success = true
@@ -167,7 +166,7 @@ func getLookupdTopicProducers(topic string, lookupdHTTPAddrs []string) ([]string
 		wg.Add(1)
 
 		endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", addr, url.QueryEscape(topic))
-		log.Printf("LOOKUPD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 
 		go func(endpoint string) {
 			data, err := nsq.ApiRequest(endpoint)
@@ -175,7 +174,7 @@ func getLookupdTopicProducers(topic string, lookupdHTTPAddrs []string) ([]string
 			defer lock.Unlock()
 			defer wg.Done()
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				return
 			}
 			success = true
@@ -206,7 +205,7 @@ func getNSQDTopics(nsqdHTTPAddrs []string) ([]string, error) {
 	for _, addr := range nsqdHTTPAddrs {
 		wg.Add(1)
 		endpoint := fmt.Sprintf("http://%s/stats?format=json", addr)
-		log.Printf("NSQD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying nsqd %s", endpoint)
 
 		go func(endpoint string) {
 			data, err := nsq.ApiRequest(endpoint)
@@ -214,7 +213,7 @@ func getNSQDTopics(nsqdHTTPAddrs []string) ([]string, error) {
 			defer lock.Unlock()
 			defer wg.Done()
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				return
 			}
 			success = true
@@ -242,7 +241,7 @@ func getNSQDTopicProducers(topic string, nsqdHTTPAddrs []string) ([]string, erro
 	for _, addr := range nsqdHTTPAddrs {
 		wg.Add(1)
 		endpoint := fmt.Sprintf("http://%s/stats?format=json", addr)
-		log.Printf("NSQD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying nsqd %s", endpoint)
 
 		go func(endpoint string) {
 			data, err := nsq.ApiRequest(endpoint)
@@ -250,7 +249,7 @@ func getNSQDTopicProducers(topic string, nsqdHTTPAddrs []string) ([]string, erro
 			defer lock.Unlock()
 			defer wg.Done()
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				return
 			}
 			success = true
@@ -283,7 +282,7 @@ func getNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicHostSta
 	for _, addr := range nsqdHTTPAddrs {
 		wg.Add(1)
 		endpoint := fmt.Sprintf("http://%s/stats?format=json", addr)
-		log.Printf("NSQD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying nsqd %s", endpoint)
 
 		go func(endpoint string, addr string) {
 			data, err := nsq.ApiRequest(endpoint)
@@ -291,7 +290,7 @@ func getNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicHostSta
 			defer lock.Unlock()
 			defer wg.Done()
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query %s - %s", endpoint, err.Error())
 				return
 			}
 			success = true
@@ -318,6 +317,10 @@ func getNSQDStats(nsqdHTTPAddrs []string, selectedTopic string) ([]*TopicHostSta
 					ChannelCount: len(topicInfo["channels"].([]interface{})),
 					Topic:        topicName,
 				}
+				pausedInterface, ok := topicInfo["paused"]
+				if ok {
+					h.Paused = pausedInterface.(bool)
+				}
 				topicHostStats = append(topicHostStats, h)
 
 				channels := topicInfo["channels"].([]interface{})
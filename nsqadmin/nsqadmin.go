@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"github.com/lhzd863/nsq-0.2.16/util"
 	"flag"
 	"log"
@@ -16,6 +17,8 @@ var (
 	graphiteUrl       = flag.String("graphite-url", "", "URL to graphite HTTP address")
 	proxyGraphite     = flag.Bool("proxy-graphite", true, "Proxy HTTP requests to graphite")
 	useStatsdPrefixes = flag.Bool("use-statsd-prefixes", true, "expect statsd prefixed keys in graphite (ie: 'stats_counts.')")
+	logLevel          = flag.String("log-level", "info", "log level (debug, info, warn or error)")
+	logFormat         = flag.String("log-format", "text", "log format (text or json)")
 	lookupdHTTPAddrs  = util.StringArray{}
 	nsqdHTTPAddrs     = util.StringArray{}
 )
@@ -30,7 +33,12 @@ func main() {
 
 	flag.Parse()
 
-	log.Printf("nsqadmin v%s", util.BINARY_VERSION)
+	_, err := util.SetupLogging(*logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
+	nsq.NewLogEntry(nil).Infof("nsqadmin v%s", util.BINARY_VERSION)
 	if *showVersion {
 		return
 	}
@@ -40,6 +40,7 @@ type TopicHostStats struct {
 	ChannelCount int
 	Topic        string
 	Aggregate    bool
+	Paused       bool
 }
 
 type ChannelStats struct {
@@ -142,6 +143,9 @@ func (t *TopicHostStats) AddHostStats(a *TopicHostStats) {
 	if a.ChannelCount > t.ChannelCount {
 		t.ChannelCount = a.ChannelCount
 	}
+	if a.Paused {
+		t.Paused = a.Paused
+	}
 }
 
 func (p *Producer) HTTPAddress() string {
@@ -0,0 +1,119 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// batchMessageError is the error for the invalid message at Index of a batch
+type batchMessageError struct {
+	Index int
+	Err   error
+}
+
+func (e *batchMessageError) Error() string {
+	return fmt.Sprintf("message %d - %s", e.Index, e.Err.Error())
+}
+
+// decodeMPUB decodes a batch of message bodies in the MPUB format:
+//
+//     [ 4-byte num messages ][ 4-byte message size ][ N-byte binary data ]...
+//
+// an invalid message (or one larger than maxMsgSize, when it is > 0) results
+// in a *batchMessageError
+func decodeMPUB(body []byte, maxMsgSize int64) ([][]byte, error) {
+	var numMessages int32
+	var messageSize int32
+
+	buf := bytes.NewBuffer(body)
+	err := binary.Read(buf, binary.BigEndian, &numMessages)
+	if err != nil {
+		return nil, err
+	}
+	if numMessages < 0 {
+		return nil, fmt.Errorf("invalid number of messages %d", numMessages)
+	}
+
+	bodies := make([][]byte, 0)
+	for i := 0; i < int(numMessages); i++ {
+		err = binary.Read(buf, binary.BigEndian, &messageSize)
+		if err == nil && (messageSize < 0 || int(messageSize) > buf.Len()) {
+			err = fmt.Errorf("invalid message size %d", messageSize)
+		}
+		if err == nil && maxMsgSize > 0 && int64(messageSize) > maxMsgSize {
+			err = fmt.Errorf("message size %d is larger than %d", messageSize, maxMsgSize)
+		}
+		if err != nil {
+			return nil, &batchMessageError{i, err}
+		}
+
+		msgBody := make([]byte, messageSize)
+		_, err = io.ReadFull(buf, msgBody)
+		if err != nil {
+			return nil, &batchMessageError{i, err}
+		}
+		bodies = append(bodies, msgBody)
+	}
+
+	if buf.Len() > 0 {
+		return nil, fmt.Errorf("%d bytes after the last message", buf.Len())
+	}
+
+	return bodies, nil
+}
+
+// decodeNewlineBatch decodes a batch of message bodies separated by \n (empty
+// lines are skipped), the legacy /mput format has no size limits
+func decodeNewlineBatch(body []byte) [][]byte {
+	bodies := make([][]byte, 0)
+	for _, block := range bytes.Split(body, []byte("\n")) {
+		if len(block) != 0 {
+			bodies = append(bodies, block)
+		}
+	}
+	return bodies
+}
+
+// decodeJSONBatch decodes a batch of message bodies from a JSON array, each
+// element is a message whose body is its JSON encoding (ie. a document may
+// contain newlines).  An invalid element (or one larger than maxMsgSize, when
+// it is > 0) results in a *batchMessageError
+func decodeJSONBatch(body []byte, maxMsgSize int64) ([][]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('[') {
+		return nil, errors.New("body is not a JSON array")
+	}
+
+	bodies := make([][]byte, 0)
+	for i := 0; dec.More(); i++ {
+		var msgBody json.RawMessage
+		err = dec.Decode(&msgBody)
+		if err == nil && maxMsgSize > 0 && int64(len(msgBody)) > maxMsgSize {
+			err = fmt.Errorf("message size %d is larger than %d", len(msgBody), maxMsgSize)
+		}
+		if err != nil {
+			return nil, &batchMessageError{i, err}
+		}
+		bodies = append(bodies, []byte(msgBody))
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	_, err = dec.Token()
+	if err != io.EOF {
+		return nil, errors.New("data after the JSON array")
+	}
+
+	return bodies, nil
+}
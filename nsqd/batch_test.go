@@ -0,0 +1,102 @@
+package nsqd
+
+import (
+	"../nsq"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDecodeMPUB(t *testing.T) {
+	cmd, err := nsq.MultiPublish("test", [][]byte{[]byte("a\nb"), []byte{0, 1, 2}})
+	assert.Equal(t, err, nil)
+
+	bodies, err := decodeMPUB(cmd.Body, 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, bodies, [][]byte{[]byte("a\nb"), []byte{0, 1, 2}})
+
+	_, err = decodeMPUB(cmd.Body, 2)
+	assert.Equal(t, err.(*batchMessageError).Index, 0)
+
+	// truncated in the 2nd message
+	_, err = decodeMPUB(cmd.Body[:len(cmd.Body)-1], 0)
+	assert.Equal(t, err.(*batchMessageError).Index, 1)
+
+	_, err = decodeMPUB(append(cmd.Body, 0), 0)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestDecodeJSONBatch(t *testing.T) {
+	bodies, err := decodeJSONBatch([]byte(`[{"a":"b\nc"}, "d", 1]`), 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, bodies, [][]byte{[]byte(`{"a":"b\nc"}`), []byte(`"d"`), []byte(`1`)})
+
+	_, err = decodeJSONBatch([]byte(`[1, "too long"]`), 5)
+	assert.Equal(t, err.(*batchMessageError).Index, 1)
+
+	_, err = decodeJSONBatch([]byte(`[1, 2, {"a":}]`), 0)
+	assert.Equal(t, err.(*batchMessageError).Index, 2)
+
+	_, err = decodeJSONBatch([]byte(`{"a":1}`), 0)
+	assert.NotEqual(t, err, nil)
+
+	_, err = decodeJSONBatch([]byte(`[1] [2]`), 0)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestHTTPMputBatches(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewOptions()
+	options.MaxMsgSize = 10
+	options.MaxBodySize = 100
+	_, httpAddr, nsqd := mustStartNSQd(options)
+	defer nsqd.Stop()
+
+	topicName := "test_http_mput" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	mput := func(mode string, body []byte) map[string]interface{} {
+		endpoint := fmt.Sprintf("http://%s/mput?topic=%s", httpAddr, topicName)
+		if mode != "" {
+			endpoint += "&" + mode + "=true"
+		}
+		resp, err := http.Post(endpoint, "application/octet-stream", bytes.NewBuffer(body))
+		assert.Equal(t, err, nil)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		if string(data) == "OK" {
+			return nil
+		}
+		var js map[string]interface{}
+		json.Unmarshal(data, &js)
+		return js
+	}
+
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte("a\nb"), []byte{0, 1}})
+	assert.Equal(t, mput("binary", cmd.Body), map[string]interface{}(nil))
+	assert.Equal(t, mput("json", []byte(`["c\nd", 1]`)), map[string]interface{}(nil))
+	assert.Equal(t, topic.Depth(), int64(4))
+
+	// nothing is published from an invalid batch
+	js := mput("json", []byte(`[1, "way too long"]`))
+	assert.Equal(t, js["status_txt"], "INVALID_MESSAGE")
+	assert.Equal(t, js["data"].(map[string]interface{})["index"], float64(1))
+
+	js = mput("binary", bytes.Repeat([]byte{0}, 101))
+	assert.Equal(t, js["status_txt"], "BODY_TOO_BIG")
+	assert.Equal(t, topic.Depth(), int64(4))
+
+	// the legacy newline format has no size limits
+	assert.Equal(t, mput("", []byte("e\n\nway too long\n")), map[string]interface{}(nil))
+	assert.Equal(t, topic.Depth(), int64(6))
+}
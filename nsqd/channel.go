@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
@@ -8,8 +8,6 @@ import (
 	"bytes"
 	"container/heap"
 	"errors"
-	"github.com/bitly/go-notify"
-	"log"
 	"math"
 	"strings"
 	"sync"
@@ -28,23 +26,31 @@ type Consumer interface {
 	Stats() ClientStats
 }
 
-// Channel represents the concrete type for a NSQ channel (and also
-// implements the Queue interface)
+// Channel represents the concrete type for a NSQ channel
 //
 // There can be multiple channels per topic, each with there own unique set
 // of subscribers (clients).
 //
 // Channels maintain all client and message metadata, orchestrating in-flight
 // messages, timeouts, requeueing, etc.
+//
+// Messages are queued (in memory, overflowing to the backend) per priority
+// level and higher priority levels are delivered first.
 type Channel struct {
 	sync.RWMutex // embed a r/w mutex
 
 	topicName string
 	name      string
-	options   *nsqdOptions
+	context   *NSQd
 
+	// the normal priority level's queue
 	backend BackendQueue
 
+	// the queue of each priority level, high and low are created on first use
+	// (see getPriorityQueue) and messagePump is signaled via priorityChan
+	priorityQueues  [numPriorities]*priorityQueue
+	priorityMutex   sync.RWMutex
+	priorityChan    chan int
 	incomingMsgChan chan *nsq.Message
 	memoryMsgChan   chan *nsq.Message
 	clientMsgChan   chan *nsq.Message
@@ -56,6 +62,8 @@ type Channel struct {
 	clients          []Consumer
 	paused           int32
 	ephemeralChannel bool
+	filter           MessageFilter // protected by filterMutex, see Filter()
+	filterMutex      sync.RWMutex
 	deleteCallback   func(*Channel)
 	deleter          sync.Once
 
@@ -71,6 +79,7 @@ type Channel struct {
 	requeueCount  uint64
 	messageCount  uint64
 	timeoutCount  uint64
+	filteredCount uint64
 	bufferedCount int32
 }
 
@@ -80,15 +89,14 @@ type inFlightMessage struct {
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
-func NewChannel(topicName string, channelName string, options *nsqdOptions, deleteCallback func(*Channel)) *Channel {
-	// backend names, for uniqueness, automatically include the topic... <topic>:<channel>
-	backendName := topicName + ":" + channelName
-	pqSize := int(math.Max(1, float64(options.memQueueSize)/10))
+func NewChannel(topicName string, channelName string, context *NSQd, deleteCallback func(*Channel)) *Channel {
+	memQueueSize, _, _ := context.options.getQueueOptions()
+	pqSize := int(math.Max(1, float64(memQueueSize)/10))
 	c := &Channel{
 		topicName:        topicName,
 		name:             channelName,
+		priorityChan:     make(chan int, 1),
 		incomingMsgChan:  make(chan *nsq.Message, 1),
-		memoryMsgChan:    make(chan *nsq.Message, options.memQueueSize),
 		clientMsgChan:    make(chan *nsq.Message),
 		exitChan:         make(chan int),
 		clients:          make([]Consumer, 0, 5),
@@ -97,24 +105,90 @@ func NewChannel(topicName string, channelName string, options *nsqdOptions, dele
 		deferredMessages: make(map[nsq.MessageID]*pqueue.Item),
 		deferredPQ:       pqueue.New(pqSize),
 		deleteCallback:   deleteCallback,
-		options:          options,
+		context:          context,
 	}
 	if strings.HasSuffix(channelName, "#ephemeral") {
 		c.ephemeralChannel = true
-		c.backend = NewDummyBackendQueue()
-	} else {
-		c.backend = NewDiskQueue(backendName, options.dataPath, options.maxBytesPerFile, options.syncEvery)
 	}
+	for level := range c.priorityQueues {
+		// the other levels are created up front only if they have been persisted
+		if level == priorityNormal || (!c.isMemoryOnly() &&
+			diskQueueExists(c.backendName(level), context.options.DataPath)) {
+			c.priorityQueues[level] = c.newPriorityQueue(level)
+		}
+	}
+	c.memoryMsgChan = c.priorityQueues[priorityNormal].memoryMsgChan
+	c.backend = c.priorityQueues[priorityNormal].backend
 	go c.messagePump()
 	c.waitGroup.Wrap(func() { c.router() })
 	c.waitGroup.Wrap(func() { c.deferredWorker() })
 	c.waitGroup.Wrap(func() { c.inFlightWorker() })
 
-	go notify.Post("channel_change", c)
+	context.notifyChannelChange(c)
 
 	return c
 }
 
+// isMemoryOnly returns true for ephemeral channels (and all channels of ephemeral topics)
+func (c *Channel) isMemoryOnly() bool {
+	return c.ephemeralChannel || isEphemeralTopicName(c.topicName)
+}
+
+// backendName returns the name of the backend of a priority level, for uniqueness
+// it automatically includes the topic... <topic>:<channel> for the normal level and
+// <topic>:<channel>:<priority> for the others
+func (c *Channel) backendName(level int) string {
+	name := c.topicName + ":" + c.name
+	if level != priorityNormal {
+		name += ":" + priorityNames[level]
+	}
+	return name
+}
+
+func (c *Channel) newPriorityQueue(level int) *priorityQueue {
+	memQueueSize, maxBytesPerFile, syncEvery := c.context.options.getQueueOptions()
+	var backend BackendQueue
+	if c.isMemoryOnly() {
+		backend = NewDummyBackendQueue()
+	} else {
+		backend = NewDiskQueue(c.backendName(level), c.context.options.DataPath, maxBytesPerFile, syncEvery)
+	}
+	return &priorityQueue{
+		memoryMsgChan: make(chan *nsq.Message, memQueueSize),
+		backend:       backend,
+	}
+}
+
+// getPriorityQueue returns the queue of a priority level, creating it on first use
+func (c *Channel) getPriorityQueue(level int) *priorityQueue {
+	c.priorityMutex.RLock()
+	q := c.priorityQueues[level]
+	c.priorityMutex.RUnlock()
+	if q != nil {
+		return q
+	}
+
+	c.priorityMutex.Lock()
+	defer c.priorityMutex.Unlock()
+	if c.priorityQueues[level] == nil {
+		c.log().Infof("creating %s priority queue", priorityNames[level])
+		c.priorityQueues[level] = c.newPriorityQueue(level)
+		// wake up messagePump to read from it
+		select {
+		case c.priorityChan <- 1:
+		default:
+		}
+	}
+	return c.priorityQueues[level]
+}
+
+// queues returns the queue of each priority level (nil if not created yet)
+func (c *Channel) queues() [numPriorities]*priorityQueue {
+	c.priorityMutex.RLock()
+	defer c.priorityMutex.RUnlock()
+	return c.priorityQueues
+}
+
 // Exiting returns a boolean indicating if this channel is closed/exiting
 func (c *Channel) Exiting() bool {
 	return atomic.LoadInt32(&c.exitFlag) == 1
@@ -125,6 +199,10 @@ func (c *Channel) Delete() error {
 	return c.exit(true)
 }
 
+func (c *Channel) log() nsq.LogEntry {
+	return c.context.log("topic", c.topicName, "channel", c.name)
+}
+
 // Close cleanly closes the Channel
 func (c *Channel) Close() error {
 	return c.exit(false)
@@ -137,7 +215,7 @@ func (c *Channel) exit(deleted bool) error {
 		return errors.New("exiting")
 	}
 
-	log.Printf("CHANNEL(%s): closing", c.name)
+	c.log().Infof("closing channel")
 
 	// initiate exit
 	atomic.StoreInt32(&c.exitFlag, 1)
@@ -159,48 +237,122 @@ func (c *Channel) exit(deleted bool) error {
 
 	if deleted {
 		// empty the queue (deletes the backend files, too)
-		EmptyQueue(c)
+		c.Empty()
 	} else {
 		// messagePump is responsible for closing the channel it writes to
 		// this will read until its closed (exited)
 		for msg := range c.clientMsgChan {
-			log.Printf("CHANNEL(%s): recovered buffered message from clientMsgChan", c.name)
-			WriteMessageToBackend(&msgBuf, msg, c)
+			c.log().Infof("recovered buffered message from clientMsgChan")
+			WriteMessageToBackend(&msgBuf, msg, c.queueFor(msg))
 		}
 
 		// write anything leftover to disk
-		if len(c.memoryMsgChan) > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
-			log.Printf("CHANNEL(%s): flushing %d memory %d in-flight %d deferred messages to backend",
-				c.name, len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
+		var memoryCount int
+		for _, q := range c.queues() {
+			if q != nil {
+				memoryCount += len(q.memoryMsgChan)
+			}
+		}
+		if memoryCount > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
+			c.log().Infof("flushing %d memory %d in-flight %d deferred messages to backend",
+				memoryCount, len(c.inFlightMessages), len(c.deferredMessages))
+		}
+		c.flush()
+	}
+
+	var err error
+	for _, q := range c.queues() {
+		if q == nil {
+			continue
+		}
+		closeErr := q.backend.Close()
+		if closeErr != nil {
+			err = closeErr
 		}
-		FlushQueue(c)
 	}
+	return err
+}
 
-	return c.backend.Close()
+// Empty discards all queued messages at every priority level
+// (deletes the backend files, too)
+func (c *Channel) Empty() error {
+	for _, q := range c.queues() {
+		if q == nil {
+			continue
+		}
+		err := EmptyQueue(q)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// MemoryChan implements the Queue interface
-func (c *Channel) MemoryChan() chan *nsq.Message {
-	return c.memoryMsgChan
+// flush writes in-memory, in-flight and deferred messages to the backend
+// of their priority level
+func (c *Channel) flush() {
+	var msgBuf bytes.Buffer
+
+	for _, q := range c.queues() {
+		if q != nil {
+			FlushQueue(q)
+		}
+	}
+
+	for _, item := range c.inFlightMessages {
+		msg := item.Value.(*inFlightMessage).msg
+		err := WriteMessageToBackend(&msgBuf, msg, c.queueFor(msg))
+		if err != nil {
+			c.log().Errorf("failed to write message to backend - %s", err.Error())
+		}
+	}
+
+	for _, item := range c.deferredMessages {
+		msg := item.Value.(*nsq.Message)
+		err := WriteMessageToBackend(&msgBuf, msg, c.queueFor(msg))
+		if err != nil {
+			c.log().Errorf("failed to write message to backend - %s", err.Error())
+		}
+	}
 }
 
-// BackendQueue implements the Queue interface
-func (c *Channel) BackendQueue() BackendQueue {
-	return c.backend
+// queueFor returns the queue for the message's priority level
+func (c *Channel) queueFor(msg *nsq.Message) *priorityQueue {
+	return c.getPriorityQueue(messagePriority(msg))
 }
 
-// InFlight implements the Queue interface
-func (c *Channel) InFlight() map[nsq.MessageID]*pqueue.Item {
-	return c.inFlightMessages
+func (c *Channel) Depth() int64 {
+	var depth int64
+	for _, q := range c.queues() {
+		if q != nil {
+			depth += q.Depth()
+		}
+	}
+	return depth + int64(atomic.LoadInt32(&c.bufferedCount))
 }
 
-// Deferred implements the Queue interface
-func (c *Channel) Deferred() map[nsq.MessageID]*pqueue.Item {
-	return c.deferredMessages
+// BackendDepth returns the number of messages in the backend of every priority level
+func (c *Channel) BackendDepth() int64 {
+	var depth int64
+	for _, q := range c.queues() {
+		if q != nil {
+			depth += q.backend.Depth()
+		}
+	}
+	return depth
 }
 
-func (c *Channel) Depth() int64 {
-	return int64(len(c.memoryMsgChan)) + c.backend.Depth() + int64(atomic.LoadInt32(&c.bufferedCount))
+// PriorityDepth returns the depth of each priority level (by name)
+func (c *Channel) PriorityDepth() map[string]int64 {
+	depths := make(map[string]int64, numPriorities)
+	for level, q := range c.queues() {
+		if q != nil {
+			depths[priorityNames[level]] = q.Depth()
+		} else {
+			depths[priorityNames[level]] = 0
+		}
+	}
+	return depths
 }
 
 func (c *Channel) Pause() {
@@ -225,6 +377,19 @@ func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
 
+// Filter returns the MessageFilter of the Channel (nil when it receives every message)
+func (c *Channel) Filter() MessageFilter {
+	c.filterMutex.RLock()
+	defer c.filterMutex.RUnlock()
+	return c.filter
+}
+
+func (c *Channel) setFilter(filter MessageFilter) {
+	c.filterMutex.Lock()
+	c.filter = filter
+	c.filterMutex.Unlock()
+}
+
 // PutMessage writes to the appropriate incoming message channel
 // (which will be routed asynchronously)
 func (c *Channel) PutMessage(msg *nsq.Message) error {
@@ -242,7 +407,7 @@ func (c *Channel) PutMessage(msg *nsq.Message) error {
 func (c *Channel) FinishMessage(client Consumer, id nsq.MessageID) error {
 	item, err := c.popInFlightMessage(client, id)
 	if err != nil {
-		log.Printf("ERROR: failed to finish message(%s) - %s", id, err.Error())
+		c.log().Errorf("failed to finish message(%s) - %s", id, err.Error())
 	} else {
 		c.removeFromInFlightPQ(item)
 	}
@@ -273,6 +438,58 @@ func (c *Channel) RequeueMessage(client Consumer, id nsq.MessageID, timeout time
 	return c.StartDeferredTimeout(msg, timeout)
 }
 
+// DeleteMessage discards a message (by id) that is either in-flight
+// (regardless of which client owns it) or deferred
+func (c *Channel) DeleteMessage(id nsq.MessageID) error {
+	item, err := c.popInFlightMessage(nil, id)
+	if err == nil {
+		c.removeFromInFlightPQ(item)
+		// the owning client no longer has this message in-flight
+		item.Value.(*inFlightMessage).client.TimedOutMessage()
+		return nil
+	}
+
+	item, err = c.popDeferredMessage(id)
+	if err != nil {
+		return errors.New("ID not in flight or deferred")
+	}
+	c.removeFromDeferredPQ(item)
+
+	return nil
+}
+
+// ForceRequeueMessage takes a message (by id) that is either in-flight
+// (regardless of which client owns it) or deferred and requeues it
+// based on `time.Duration` (see RequeueMessage)
+//
+// For a deferred message this reschedules it, a `timeout` of 0 makes it
+// available to clients immediately.
+func (c *Channel) ForceRequeueMessage(id nsq.MessageID, timeout time.Duration) error {
+	var msg *nsq.Message
+
+	item, err := c.popInFlightMessage(nil, id)
+	if err == nil {
+		c.removeFromInFlightPQ(item)
+		client := item.Value.(*inFlightMessage).client
+		msg = item.Value.(*inFlightMessage).msg
+		// the owning client no longer has this message in-flight
+		client.TimedOutMessage()
+	} else {
+		item, err = c.popDeferredMessage(id)
+		if err != nil {
+			return errors.New("ID not in flight or deferred")
+		}
+		c.removeFromDeferredPQ(item)
+		msg = item.Value.(*nsq.Message)
+	}
+
+	if timeout == 0 {
+		return c.doRequeue(msg)
+	}
+
+	return c.StartDeferredTimeout(msg, timeout)
+}
+
 // AddClient adds a client to the Channel's client list
 func (c *Channel) AddClient(client Consumer) {
 	c.Lock()
@@ -313,7 +530,7 @@ func (c *Channel) RemoveClient(client Consumer) {
 
 func (c *Channel) StartInFlightTimeout(msg *nsq.Message, client Consumer) error {
 	value := &inFlightMessage{msg, client}
-	absTs := time.Now().Add(c.options.msgTimeout).UnixNano()
+	absTs := time.Now().Add(c.context.options.getMsgTimeout()).UnixNano()
 	item := &pqueue.Item{Value: value, Priority: absTs}
 	err := c.pushInFlightMessage(item)
 	if err != nil {
@@ -360,6 +577,8 @@ func (c *Channel) pushInFlightMessage(item *pqueue.Item) error {
 }
 
 // popInFlightMessage atomically removes a message from the in-flight dictionary
+//
+// a nil client skips the ownership check (for administrative operations)
 func (c *Channel) popInFlightMessage(client Consumer, id nsq.MessageID) (*pqueue.Item, error) {
 	c.Lock()
 	defer c.Unlock()
@@ -369,7 +588,7 @@ func (c *Channel) popInFlightMessage(client Consumer, id nsq.MessageID) (*pqueue
 		return nil, errors.New("ID not in flight")
 	}
 
-	if item.Value.(*inFlightMessage).client != client {
+	if client != nil && item.Value.(*inFlightMessage).client != client {
 		return nil, errors.New("client does not own ID")
 	}
 
@@ -433,35 +652,56 @@ func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
 	heap.Push(&c.deferredPQ, item)
 }
 
+func (c *Channel) removeFromDeferredPQ(item *pqueue.Item) {
+	c.deferredMutex.Lock()
+	defer c.deferredMutex.Unlock()
+
+	if item.Index == -1 {
+		// this item has already been Pop'd off the pqueue
+		return
+	}
+
+	heap.Remove(&c.deferredPQ, item.Index)
+}
+
 // Router handles the muxing of incoming Channel messages, either writing
-// to the in-memory channel or to the backend
+// to the in-memory channel or to the backend of the message's priority level
 func (c *Channel) router() {
 	var msgBuf bytes.Buffer
 	for msg := range c.incomingMsgChan {
+		q := c.queueFor(msg)
 		select {
-		case c.memoryMsgChan <- msg:
+		case q.memoryMsgChan <- msg:
 		default:
-			err := WriteMessageToBackend(&msgBuf, msg, c)
+			err := WriteMessageToBackend(&msgBuf, msg, q)
 			if err != nil {
-				log.Printf("CHANNEL(%s) ERROR: failed to write message to backend - %s", c.name, err.Error())
+				c.log().Errorf("failed to write message to backend - %s", err.Error())
 				// theres not really much we can do at this point, you're certainly
 				// going to lose messages...
 			}
 		}
 	}
 
-	log.Printf("CHANNEL(%s): closing ... router", c.name)
+	c.log().Infof("closing ... router")
 }
 
 // messagePump reads messages from either memory or backend and writes
 // to the client output go channel
 //
+// higher priority levels are always drained first, except that after
+// priorityStarvationLimit consecutive messages while a lower priority level
+// has messages waiting, a lower level is given a turn
+//
 // it is also performs in-flight accounting and initiates the auto-requeue
 // goroutine
 func (c *Channel) messagePump() {
 	var msg *nsq.Message
 	var buf []byte
 	var err error
+	var level int
+	var ok bool
+	var consecutive int
+	starvedTurn := priorityHigh
 
 	for {
 		// do an extra check for closed exit before we select on all the memory/backend/exitChan
@@ -471,16 +711,59 @@ func (c *Channel) messagePump() {
 			goto exit
 		}
 
-		select {
-		case msg = <-c.memoryMsgChan:
-		case buf = <-c.backend.ReadChan():
+		start := priorityHigh
+		if consecutive >= priorityStarvationLimit {
+			// rotate through the lower levels so that none of them starve
+			starvedTurn = starvedTurn%(numPriorities-1) + 1
+			start = starvedTurn
+			consecutive = 0
+		}
+
+		msg, buf, level, ok = c.tryReadPriority(start)
+		if !ok {
+			// nothing is waiting, block until any level has a message
+			// (or a level is created, the nil channels of the others block forever)
+			var memoryChans [numPriorities]chan *nsq.Message
+			var backendChans [numPriorities]chan []byte
+			for l, q := range c.queues() {
+				if q != nil {
+					memoryChans[l] = q.memoryMsgChan
+					backendChans[l] = q.backend.ReadChan()
+				}
+			}
+			msg = nil
+			select {
+			case msg = <-memoryChans[priorityHigh]:
+				level = priorityHigh
+			case buf = <-backendChans[priorityHigh]:
+				level = priorityHigh
+			case msg = <-memoryChans[priorityNormal]:
+				level = priorityNormal
+			case buf = <-backendChans[priorityNormal]:
+				level = priorityNormal
+			case msg = <-memoryChans[priorityLow]:
+				level = priorityLow
+			case buf = <-backendChans[priorityLow]:
+				level = priorityLow
+			case <-c.priorityChan:
+				continue
+			case <-c.exitChan:
+				goto exit
+			}
+		}
+
+		if msg == nil {
 			msg, err = nsq.DecodeMessage(buf)
 			if err != nil {
-				log.Printf("ERROR: failed to decode message - %s", err.Error())
+				c.log().Errorf("failed to decode message - %s", err.Error())
 				continue
 			}
-		case <-c.exitChan:
-			goto exit
+		}
+
+		if c.hasLowerPriorityWaiting(level) {
+			consecutive++
+		} else {
+			consecutive = 0
 		}
 
 		msg.Attempts++
@@ -492,10 +775,46 @@ func (c *Channel) messagePump() {
 	}
 
 exit:
-	log.Printf("CHANNEL(%s): closing ... messagePump", c.name)
+	c.log().Infof("closing ... messagePump")
 	close(c.clientMsgChan)
 }
 
+// tryReadPriority performs a non-blocking read of the first available message
+// checking each priority level (memory then backend) in order, beginning at
+// start and wrapping around
+func (c *Channel) tryReadPriority(start int) (*nsq.Message, []byte, int, bool) {
+	queues := c.queues()
+	for i := 0; i < numPriorities; i++ {
+		level := (start + i) % numPriorities
+		q := queues[level]
+		if q == nil {
+			continue
+		}
+		select {
+		case msg := <-q.memoryMsgChan:
+			return msg, nil, level, true
+		default:
+		}
+		select {
+		case buf := <-q.backend.ReadChan():
+			return nil, buf, level, true
+		default:
+		}
+	}
+	return nil, nil, 0, false
+}
+
+// hasLowerPriorityWaiting returns true if any level below level has queued messages
+func (c *Channel) hasLowerPriorityWaiting(level int) bool {
+	queues := c.queues()
+	for _, q := range queues[level+1:] {
+		if q != nil && q.Depth() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Channel) deferredWorker() {
 	c.pqWorker(&c.deferredPQ, &c.deferredMutex, func(item *pqueue.Item) {
 		msg := item.Value.(*nsq.Message)
@@ -546,6 +865,6 @@ func (c *Channel) pqWorker(pq *pqueue.PriorityQueue, mutex *sync.Mutex, callback
 	}
 
 exit:
-	log.Printf("CHANNEL(%s): closing ... pqueue worker", c.name)
+	c.log().Infof("closing ... pqueue worker")
 	ticker.Stop()
 }
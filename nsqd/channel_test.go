@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 import (
 	"../nsq"
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -16,8 +17,8 @@ func TestPutMessage(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
-	defer nsqd.Exit()
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
 
 	topicName := "test_put_message" + strconv.Itoa(int(time.Now().Unix()))
 	topic := nsqd.GetTopic(topicName)
@@ -37,8 +38,8 @@ func TestPutMessage2Chan(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
-	defer nsqd.Exit()
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
 
 	topicName := "test_put_message_2chan" + strconv.Itoa(int(time.Now().Unix()))
 	topic := nsqd.GetTopic(topicName)
@@ -62,17 +63,17 @@ func TestInFlightWorker(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
-	options.msgTimeout = 300 * time.Millisecond
-	nsqd := NewNSQd(1, options)
-	defer nsqd.Exit()
+	options := NewOptions()
+	options.MsgTimeout = 300 * time.Millisecond
+	nsqd := New(options)
+	defer nsqd.Stop()
 
 	topic := nsqd.GetTopic("topic")
 	channel := topic.GetChannel("channel")
 
 	for i := 0; i < 1000; i++ {
 		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
-		channel.StartInFlightTimeout(msg, NewClientV2(nil))
+		channel.StartInFlightTimeout(msg, NewClientV2(nsqd, nil))
 	}
 
 	assert.Equal(t, len(channel.inFlightMessages), 1000)
@@ -83,3 +84,188 @@ func TestInFlightWorker(t *testing.T) {
 	assert.Equal(t, len(channel.inFlightMessages), 0)
 	assert.Equal(t, len(channel.inFlightPQ), 0)
 }
+
+func TestChannelDeleteMessage(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	topic := nsqd.GetTopic("test_delete_message")
+	channel := topic.GetChannel("channel")
+	client := NewClientV2(nsqd, nil)
+
+	inFlightMsg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	channel.StartInFlightTimeout(inFlightMsg, client)
+	client.SendingMessage()
+	deferredMsg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	channel.StartDeferredTimeout(deferredMsg, time.Hour)
+
+	err := channel.DeleteMessage(inFlightMsg.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(channel.inFlightMessages), 0)
+	assert.Equal(t, len(channel.inFlightPQ), 0)
+	assert.Equal(t, client.InFlightCount, int64(0))
+
+	err = channel.DeleteMessage(deferredMsg.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(channel.deferredMessages), 0)
+	assert.Equal(t, len(channel.deferredPQ), 0)
+
+	err = channel.DeleteMessage(deferredMsg.Id)
+	assert.NotEqual(t, err, nil)
+
+	// the owning client can no longer finish a deleted message
+	err = channel.FinishMessage(client, inFlightMsg.Id)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestChannelForceRequeueMessage(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	topic := nsqd.GetTopic("test_force_requeue_message")
+	channel := topic.GetChannel("channel")
+
+	inFlightMsg := nsq.NewMessage(<-nsqd.idChan, []byte("in-flight"))
+	channel.StartInFlightTimeout(inFlightMsg, NewClientV2(nsqd, nil))
+	deferredMsg := nsq.NewMessage(<-nsqd.idChan, []byte("deferred"))
+	channel.StartDeferredTimeout(deferredMsg, time.Hour)
+
+	// the workers update the in-flight and deferred state concurrently
+	inFlightCount := func() int {
+		channel.inFlightMutex.Lock()
+		defer channel.inFlightMutex.Unlock()
+		return len(channel.inFlightMessages)
+	}
+	deferredCount := func() (int, int) {
+		channel.deferredMutex.Lock()
+		defer channel.deferredMutex.Unlock()
+		return len(channel.deferredMessages), len(channel.deferredPQ)
+	}
+
+	err := channel.ForceRequeueMessage(inFlightMsg.Id, 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, inFlightCount(), 0)
+	outputMsg := <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, inFlightMsg.Id)
+
+	// reschedule the deferred message so that it is requeued by the deferred worker
+	err = channel.ForceRequeueMessage(deferredMsg.Id, 50*time.Millisecond)
+	assert.Equal(t, err, nil)
+	numMessages, numPQ := deferredCount()
+	assert.Equal(t, numMessages, 1)
+	assert.Equal(t, numPQ, 1)
+	outputMsg = <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, deferredMsg.Id)
+	numMessages, _ = deferredCount()
+	assert.Equal(t, numMessages, 0)
+	assert.Equal(t, atomic.LoadUint64(&channel.requeueCount), uint64(2))
+
+	err = channel.ForceRequeueMessage(deferredMsg.Id, 0)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestChannelPriority(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	topicName := "test_channel_priority" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	// the message pump blocks holding this one until it is read
+	channel.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("first")))
+	time.Sleep(25 * time.Millisecond)
+
+	for _, priority := range []string{"low", "normal", "high"} {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte(priority))
+		setMessagePriority(msg, priority)
+		channel.PutMessage(msg)
+	}
+	time.Sleep(25 * time.Millisecond)
+
+	assert.Equal(t, channel.PriorityDepth(), map[string]int64{"high": 1, "normal": 1, "low": 1})
+
+	for _, body := range []string{"first", "high", "normal", "low"} {
+		msg := <-channel.clientMsgChan
+		assert.Equal(t, string(msg.Body), body)
+	}
+}
+
+func TestChannelPriorityLazy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewOptions()
+	options.DataPath, _ = ioutil.TempDir("", "nsq-priority")
+	defer os.RemoveAll(options.DataPath)
+	nsqd := New(options)
+	defer nsqd.Stop()
+
+	topicName := "test_channel_lazy" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("channel")
+	queues := channel.queues()
+	assert.Equal(t, queues[priorityHigh] == nil && queues[priorityLow] == nil, true)
+
+	// the first high priority message creates its queue and wakes up the message pump
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("high"))
+	setMessagePriority(msg, "high")
+	channel.PutMessage(msg)
+	select {
+	case msg := <-channel.clientMsgChan:
+		assert.Equal(t, string(msg.Body), "high")
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the high priority msg")
+	}
+	queues = channel.queues()
+	assert.Equal(t, queues[priorityHigh] != nil && queues[priorityLow] == nil, true)
+
+	// once persisted it is created up front
+	channel.Close()
+	channel = NewChannel(topicName, "channel", nsqd, func(*Channel) {})
+	defer channel.Close()
+	queues = channel.queues()
+	assert.Equal(t, queues[priorityHigh] != nil && queues[priorityLow] == nil, true)
+}
+
+func TestChannelPriorityStarvation(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	topicName := "test_channel_starvation" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	channel.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("first")))
+	time.Sleep(25 * time.Millisecond)
+
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("low"))
+	setMessagePriority(msg, "low")
+	channel.PutMessage(msg)
+	for i := 0; i < 2*priorityStarvationLimit; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("high"))
+		setMessagePriority(msg, "high")
+		channel.PutMessage(msg)
+	}
+	time.Sleep(25 * time.Millisecond)
+
+	lowIndex := -1
+	for i := 0; i < 2*priorityStarvationLimit+2; i++ {
+		msg := <-channel.clientMsgChan
+		if string(msg.Body) == "low" {
+			lowIndex = i
+		}
+	}
+	assert.Equal(t, lowIndex, priorityStarvationLimit+1)
+}
@@ -1,9 +1,8 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"bufio"
-	"log"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -13,6 +12,7 @@ import (
 type ClientV2 struct {
 	net.Conn
 	sync.Mutex
+	context         *NSQd
 	Reader          *bufio.Reader
 	Writer          *bufio.Writer
 	State           int32
@@ -28,15 +28,18 @@ type ClientV2 struct {
 	ExitChan        chan int
 	ShortIdentifier string
 	LongIdentifier  string
+	UserAgent       string
+	MessageHeaders  bool
 }
 
-func NewClientV2(conn net.Conn) *ClientV2 {
+func NewClientV2(context *NSQd, conn net.Conn) *ClientV2 {
 	var identifier string
 	if conn != nil {
 		identifier, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
 	}
 	return &ClientV2{
-		Conn: conn,
+		Conn:    conn,
+		context: context,
 		// ReadyStateChan has a buffer of 1 to guarantee that in the event
 		// there is a race the state update is not lost
 		ReadyStateChan:  make(chan int, 1),
@@ -49,6 +52,10 @@ func NewClientV2(conn net.Conn) *ClientV2 {
 	}
 }
 
+func (c *ClientV2) log() nsq.LogEntry {
+	return c.context.log("client", c.String())
+}
+
 func (c *ClientV2) String() string {
 	return c.RemoteAddr().String()
 }
@@ -58,6 +65,7 @@ func (c *ClientV2) Stats() ClientStats {
 		Version:       "V2",
 		RemoteAddress: c.RemoteAddr().String(),
 		Name:          c.ShortIdentifier,
+		UserAgent:     c.UserAgent,
 		State:         atomic.LoadInt32(&c.State),
 		ReadyCount:    atomic.LoadInt64(&c.ReadyCount),
 		InFlightCount: atomic.LoadInt64(&c.InFlightCount),
@@ -77,10 +85,8 @@ func (c *ClientV2) IsReadyForMessages() bool {
 	lastReadyCount := atomic.LoadInt64(&c.LastReadyCount)
 	inFlightCount := atomic.LoadInt64(&c.InFlightCount)
 
-	if *verbose {
-		log.Printf("[%s] state rdy: %4d lastrdy: %4d inflt: %4d", c,
-			readyCount, lastReadyCount, inFlightCount)
-	}
+	c.log().Debugf("state rdy: %4d lastrdy: %4d inflt: %4d",
+		readyCount, lastReadyCount, inFlightCount)
 
 	if inFlightCount >= lastReadyCount || readyCount <= 0 {
 		return false
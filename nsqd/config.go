@@ -0,0 +1,122 @@
+package nsqd
+
+import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigReloader is implemented by programs that configure an NSQd from a
+// config file, it backs the /config HTTP endpoint
+type ConfigReloader interface {
+	// Config returns the current configuration (ie. keyed by flag name)
+	Config() map[string]interface{}
+
+	// ReloadConfig re-reads the configuration, applying what can be changed at
+	// runtime (see NSQd.SetRuntimeOptions). It returns the names of the options
+	// that were applied and of those that changed but require a restart.
+	ReloadConfig() ([]string, []string, error)
+}
+
+// SetConfigReloader sets the ConfigReloader used by the /config HTTP endpoint
+func (n *NSQd) SetConfigReloader(reloader ConfigReloader) {
+	n.Lock()
+	n.configReloader = reloader
+	n.Unlock()
+}
+
+func (n *NSQd) getConfigReloader() ConfigReloader {
+	n.RLock()
+	defer n.RUnlock()
+	return n.configReloader
+}
+
+// SetRuntimeOptions applies the options that can be changed at runtime:
+// MemQueueSize, MaxBytesPerFile, SyncEvery, MsgTimeout, Verbose, the statsd
+// options and LookupdTCPAddresses (the rest of opts is ignored)
+func (n *NSQd) SetRuntimeOptions(opts *Options) error {
+	if opts.MemQueueSize <= 0 || opts.MaxBytesPerFile <= 0 || opts.SyncEvery <= 0 ||
+		opts.MsgTimeout <= 0 || opts.StatsdInterval <= 0 {
+		return errors.New("queue limits, timeouts and intervals must be positive")
+	}
+
+	o := n.options
+	atomic.StoreInt64(&o.MemQueueSize, opts.MemQueueSize)
+	atomic.StoreInt64(&o.MaxBytesPerFile, opts.MaxBytesPerFile)
+	atomic.StoreInt64(&o.SyncEvery, opts.SyncEvery)
+	atomic.StoreInt64((*int64)(&o.MsgTimeout), int64(opts.MsgTimeout))
+	n.setVerbose(opts.Verbose)
+
+	n.Lock()
+	o.StatsdAddress = opts.StatsdAddress
+	o.StatsdInterval = opts.StatsdInterval
+	n.Unlock()
+	select {
+	case n.statsdChangeChan <- 1:
+	default:
+	}
+
+	n.SetLookupdTCPAddrs(opts.LookupdTCPAddresses)
+
+	return nil
+}
+
+func (n *NSQd) setVerbose(verbose bool) {
+	var v int32
+	if verbose {
+		v = 1
+	}
+	atomic.StoreInt32(&n.verbose, v)
+}
+
+func (n *NSQd) isVerbose() bool {
+	return atomic.LoadInt32(&n.verbose) == 1
+}
+
+// log returns a nsq.LogEntry with fields from alternating key/value pairs (debug
+// messages are logged at the info level when verbose)
+func (n *NSQd) log(keyvals ...interface{}) nsq.LogEntry {
+	logger := nsq.GetLogger()
+	if n.isVerbose() {
+		logger = nsq.VerboseLogger(logger)
+	}
+	return nsq.NewLogEntry(logger, keyvals...)
+}
+
+// getStatsdOptions returns the statsd address and interval
+func (n *NSQd) getStatsdOptions() (string, time.Duration) {
+	n.RLock()
+	defer n.RUnlock()
+	return n.options.StatsdAddress, n.options.StatsdInterval
+}
+
+// GetOptions returns a copy of the current options
+//
+// The options that can be changed at runtime are read via their getters (the
+// rest are never written after New)
+func (n *NSQd) GetOptions() *Options {
+	o := n.options
+	memQueueSize, maxBytesPerFile, syncEvery := o.getQueueOptions()
+	statsdAddress, statsdInterval := n.getStatsdOptions()
+	return &Options{
+		TCPAddress:          o.TCPAddress,
+		HTTPAddress:         o.HTTPAddress,
+		LookupdTCPAddresses: n.GetLookupdTCPAddrs(),
+		WorkerId:            o.WorkerId,
+		DataPath:            o.DataPath,
+		MemQueueSize:        memQueueSize,
+		MaxBytesPerFile:     maxBytesPerFile,
+		SyncEvery:           syncEvery,
+		MsgTimeout:          o.getMsgTimeout(),
+		ClientTimeout:       o.ClientTimeout,
+		Verbose:             n.isVerbose(),
+		DedupWindow:         o.DedupWindow,
+		DedupMaxKeys:        o.DedupMaxKeys,
+		MaxMsgSize:          o.MaxMsgSize,
+		MaxBodySize:         o.MaxBodySize,
+		StatsdAddress:       statsdAddress,
+		StatsdInterval:      statsdInterval,
+		StatsdPrefix:        o.StatsdPrefix,
+	}
+}
@@ -0,0 +1,115 @@
+package nsqd
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupIndex remembers the dedup keys of messages published to a topic for a
+// window of time, so that retried publishes can be acknowledged without being
+// enqueued again.  It is bounded to maxKeys, evicting the oldest keys first.
+//
+// A key is reserved while its publish is pending and only remembered once the
+// publish succeeded (see reserve, commit and cancel).
+type dedupIndex struct {
+	sync.Mutex
+	window  time.Duration
+	maxKeys int
+	keys    map[string]*list.Element
+	order   *list.List // of *dedupEntry, oldest first
+	pending map[string]chan int
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newDedupIndex(window time.Duration, maxKeys int) *dedupIndex {
+	return &dedupIndex{
+		window:  window,
+		maxKeys: maxKeys,
+		keys:    make(map[string]*list.Element),
+		order:   list.New(),
+		pending: make(map[string]chan int),
+	}
+}
+
+// reserve reserves key for a publish, it returns false if key was committed within
+// the window.  The caller must commit (or cancel) a reserved key, concurrent
+// reservations of a pending key wait for that.
+func (d *dedupIndex) reserve(key string, now time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	for {
+		d.expire(now)
+		if _, ok := d.keys[key]; ok {
+			return false
+		}
+
+		doneChan, ok := d.pending[key]
+		if !ok {
+			break
+		}
+		d.Unlock()
+		<-doneChan
+		d.Lock()
+	}
+
+	d.pending[key] = make(chan int)
+	return true
+}
+
+// commit records a reserved key once its publish succeeded
+func (d *dedupIndex) commit(key string, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.release(key)
+	for d.order.Len() >= d.maxKeys {
+		d.removeElement(d.order.Front())
+	}
+	d.keys[key] = d.order.PushBack(&dedupEntry{key, now.Add(d.window)})
+}
+
+// cancel forgets a reserved key (ie. when its publish failed) so that the
+// publish can be retried
+func (d *dedupIndex) cancel(key string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.release(key)
+}
+
+// release wakes the reservations waiting for key
+func (d *dedupIndex) release(key string) {
+	doneChan, ok := d.pending[key]
+	if ok {
+		close(doneChan)
+		delete(d.pending, key)
+	}
+}
+
+func (d *dedupIndex) len() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.order.Len()
+}
+
+// expire removes the keys whose window has passed, they are in order
+// of expiry so this stops at the first that has not
+func (d *dedupIndex) expire(now time.Time) {
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		if e.Value.(*dedupEntry).expires.After(now) {
+			break
+		}
+		d.removeElement(e)
+	}
+}
+
+func (d *dedupIndex) removeElement(e *list.Element) {
+	d.order.Remove(e)
+	delete(d.keys, e.Value.(*dedupEntry).key)
+}
@@ -0,0 +1,75 @@
+package nsqd
+
+import (
+	"github.com/bmizerany/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDedupIndex(t *testing.T) {
+	now := time.Now()
+	d := newDedupIndex(time.Minute, 3)
+
+	assert.Equal(t, d.reserve("a", now), true)
+	d.commit("a", now)
+	assert.Equal(t, d.reserve("a", now), false)
+	assert.Equal(t, d.reserve("b", now.Add(time.Second)), true)
+	d.commit("b", now.Add(time.Second))
+
+	// keys are forgotten once the window passes
+	assert.Equal(t, d.reserve("a", now.Add(time.Minute)), true)
+	d.commit("a", now.Add(time.Minute))
+	assert.Equal(t, d.len(), 2)
+
+	// a failed publish can be retried
+	assert.Equal(t, d.reserve("c", now.Add(time.Minute)), true)
+	d.cancel("c")
+	assert.Equal(t, d.reserve("c", now.Add(time.Minute)), true)
+	d.commit("c", now.Add(time.Minute))
+
+	// the oldest keys are evicted when full
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, d.reserve(strconv.Itoa(i), now.Add(time.Minute)), true)
+		d.commit(strconv.Itoa(i), now.Add(time.Minute))
+	}
+	assert.Equal(t, d.len(), 3)
+	assert.Equal(t, d.reserve("a", now.Add(time.Minute)), true)
+	d.cancel("a")
+	assert.Equal(t, d.reserve("2", now.Add(time.Minute)), false)
+}
+
+func TestDedupIndexPending(t *testing.T) {
+	now := time.Now()
+	d := newDedupIndex(time.Minute, 3)
+
+	reserve := func() chan bool {
+		resultChan := make(chan bool, 1)
+		go func() {
+			resultChan <- d.reserve("a", now)
+		}()
+		return resultChan
+	}
+
+	// a retry waits for the pending publish, and may publish if it failed
+	assert.Equal(t, d.reserve("a", now), true)
+	resultChan := reserve()
+	select {
+	case <-resultChan:
+		t.Fatalf("reserved a pending key")
+	case <-time.After(50 * time.Millisecond):
+	}
+	d.cancel("a")
+	assert.Equal(t, <-resultChan, true)
+
+	// ... or is a duplicate if it succeeded
+	resultChan = reserve()
+	select {
+	case <-resultChan:
+		t.Fatalf("reserved a pending key")
+	case <-time.After(50 * time.Millisecond):
+	}
+	d.commit("a", now)
+	assert.Equal(t, <-resultChan, false)
+	assert.Equal(t, d.len(), 1)
+}
@@ -1,13 +1,13 @@
-package main
+package nsqd
 
 import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path"
 	"runtime"
@@ -76,7 +76,7 @@ func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery
 	// no need to lock here, nothing else could possibly be touching this instance
 	err := d.retrieveMetaData()
 	if err != nil && !os.IsNotExist(err) {
-		log.Printf("ERROR: diskqueue(%s) failed to retrieveMetaData - %s", d.name, err.Error())
+		d.log().Errorf("failed to retrieveMetaData - %s", err.Error())
 	}
 
 	go d.ioLoop()
@@ -84,6 +84,10 @@ func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery
 	return &d
 }
 
+func (d *DiskQueue) log() nsq.LogEntry {
+	return nsq.NewLogEntry(nil, "diskqueue", d.name)
+}
+
 // Depth returns the depth of the queue
 func (d *DiskQueue) Depth() int64 {
 	return atomic.LoadInt64(&d.depth)
@@ -112,7 +116,7 @@ func (d *DiskQueue) Close() error {
 	d.Lock()
 	defer d.Unlock()
 
-	log.Printf("DISKQUEUE(%s): closing", d.name)
+	d.log().Infof("closing diskqueue")
 
 	d.exitFlag = 1
 
@@ -148,7 +152,7 @@ func (d *DiskQueue) Empty() error {
 }
 
 func (d *DiskQueue) doEmpty() error {
-	log.Printf("DISKQUEUE(%s): emptying", d.name)
+	d.log().Infof("emptying diskqueue")
 
 	if d.readFile != nil {
 		d.readFile.Close()
@@ -170,7 +174,7 @@ func (d *DiskQueue) doEmpty() error {
 
 	err := d.sync()
 	if err != nil {
-		log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+		d.log().Errorf("failed to sync - %s", err.Error())
 		return err
 	}
 
@@ -199,7 +203,7 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 			return nil, err
 		}
 
-		log.Printf("DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
+		d.log().Infof("readOne() opened %s", curFileName)
 
 		if d.readPos > 0 {
 			_, err = d.readFile.Seek(d.readPos, 0)
@@ -263,7 +267,7 @@ func (d *DiskQueue) writeOne(data []byte) error {
 			return err
 		}
 
-		log.Printf("DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
+		d.log().Infof("writeOne() opened %s", curFileName)
 
 		if d.writePos > 0 {
 			_, err = d.writeFile.Seek(d.writePos, 0)
@@ -307,7 +311,7 @@ func (d *DiskQueue) writeOne(data []byte) error {
 		// sync every time we start writing to a new file
 		err = d.sync()
 		if err != nil {
-			log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+			d.log().Errorf("failed to sync - %s", err.Error())
 		}
 
 		if d.writeFile != nil {
@@ -388,7 +392,17 @@ func (d *DiskQueue) persistMetaData() error {
 }
 
 func (d *DiskQueue) metaDataFileName() string {
-	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.meta.dat"), d.name)
+	return diskQueueMetaDataFileName(d.name, d.dataPath)
+}
+
+func diskQueueMetaDataFileName(name string, dataPath string) string {
+	return fmt.Sprintf(path.Join(dataPath, "%s.diskqueue.meta.dat"), name)
+}
+
+// diskQueueExists returns true if a DiskQueue with the given name was persisted to dataPath
+func diskQueueExists(name string, dataPath string) bool {
+	_, err := os.Stat(diskQueueMetaDataFileName(name, dataPath))
+	return err == nil
 }
 
 func (d *DiskQueue) fileName(fileNum int64) string {
@@ -415,7 +429,7 @@ func (d *DiskQueue) ioLoop() {
 		if count == d.syncEvery {
 			err := d.sync()
 			if err != nil {
-				log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+				d.log().Errorf("failed to sync - %s", err.Error())
 			}
 			count = 0
 		}
@@ -424,8 +438,8 @@ func (d *DiskQueue) ioLoop() {
 			if d.nextReadPos == d.readPos {
 				dataRead, err = d.readOne()
 				if err != nil {
-					log.Printf("ERROR: reading from diskqueue(%s) at %d of %s - %s",
-						d.name, d.readPos, d.fileName(d.readFileNum), err.Error())
+					d.log().Errorf("reading at %d of %s - %s",
+						d.readPos, d.fileName(d.readFileNum), err.Error())
 					// TODO: we assume that all read errors are recoverable...
 					// it will probably turn out that this is a terrible assumption
 					// as this could certainly result in an infinite busy loop
@@ -453,7 +467,7 @@ func (d *DiskQueue) ioLoop() {
 				// sync every time we start reading from a new file
 				err = d.sync()
 				if err != nil {
-					log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+					d.log().Errorf("failed to sync - %s", err.Error())
 					continue
 				}
 
@@ -461,7 +475,7 @@ func (d *DiskQueue) ioLoop() {
 				fn := d.fileName(oldReadFileNum)
 				err = os.Remove(fn)
 				if err != nil {
-					log.Printf("ERROR: failed to Remove(%s) - %s", fn, err.Error())
+					d.log().Errorf("failed to Remove(%s) - %s", fn, err.Error())
 				}
 			}
 		case <-d.emptyChan:
@@ -474,6 +488,6 @@ func (d *DiskQueue) ioLoop() {
 	}
 
 exit:
-	log.Printf("DISKQUEUE(%s): closing ... ioLoop", d.name)
+	d.log().Infof("closing ... ioLoop")
 	d.exitSyncChan <- 1
 }
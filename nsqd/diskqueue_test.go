@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 import (
 	"github.com/bmizerany/assert"
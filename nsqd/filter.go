@@ -0,0 +1,81 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bitly/go-simplejson"
+	"regexp"
+	"strings"
+)
+
+// MessageFilter decides which messages a Topic copies into a Channel
+type MessageFilter interface {
+	Match(body []byte) bool
+	String() string
+}
+
+// NewMessageFilter parses a filter expression, the supported forms are:
+//
+//     regex:<pattern> - the message body matches the regular expression
+//     json:<field>=<value> - the message body is a JSON object and the
+//         (optionally dotted, ie. "a.b") field's value equals value
+func NewMessageFilter(expr string) (MessageFilter, error) {
+	parts := strings.SplitN(expr, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("filter must be of the form <type>:<expression>")
+	}
+
+	switch parts[0] {
+	case "regex":
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return &regexFilter{expr, re}, nil
+	case "json":
+		kv := strings.SplitN(parts[1], "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, errors.New("json filter must be of the form json:<field>=<value>")
+		}
+		return &jsonFilter{expr, strings.Split(kv[0], "."), kv[1]}, nil
+	}
+
+	return nil, fmt.Errorf("unknown filter type %s", parts[0])
+}
+
+type regexFilter struct {
+	expr string
+	re   *regexp.Regexp
+}
+
+func (f *regexFilter) Match(body []byte) bool {
+	return f.re.Match(body)
+}
+
+func (f *regexFilter) String() string {
+	return f.expr
+}
+
+type jsonFilter struct {
+	expr  string
+	path  []string
+	value string
+}
+
+func (f *jsonFilter) Match(body []byte) bool {
+	js, err := simplejson.NewJson(body)
+	if err != nil {
+		return false
+	}
+
+	v := js.GetPath(f.path...).Interface()
+	if v == nil {
+		return false
+	}
+
+	return fmt.Sprintf("%v", v) == f.value
+}
+
+func (f *jsonFilter) String() string {
+	return f.expr
+}
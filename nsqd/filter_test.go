@@ -0,0 +1,34 @@
+package nsqd
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestMessageFilter(t *testing.T) {
+	filter, err := NewMessageFilter("regex:^abc")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, filter.Match([]byte("abcdef")), true)
+	assert.Equal(t, filter.Match([]byte("defabc")), false)
+	assert.Equal(t, filter.String(), "regex:^abc")
+
+	filter, err = NewMessageFilter("json:user.type=admin")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, filter.Match([]byte(`{"user":{"type":"admin"}}`)), true)
+	assert.Equal(t, filter.Match([]byte(`{"user":{"type":"guest"}}`)), false)
+	assert.Equal(t, filter.Match([]byte(`{"type":"admin"}`)), false)
+	assert.Equal(t, filter.Match([]byte("not json")), false)
+
+	filter, err = NewMessageFilter("json:count=5")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, filter.Match([]byte(`{"count":5}`)), true)
+
+	_, err = NewMessageFilter("regex:(")
+	assert.NotEqual(t, err, nil)
+	_, err = NewMessageFilter("json:novalue")
+	assert.NotEqual(t, err, nil)
+	_, err = NewMessageFilter("unknown:abc")
+	assert.NotEqual(t, err, nil)
+	_, err = NewMessageFilter("abc")
+	assert.NotEqual(t, err, nil)
+}
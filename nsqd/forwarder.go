@@ -0,0 +1,402 @@
+package nsqd
+
+import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"github.com/lhzd863/nsq-0.2.16/util"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	forwarderDialTimeout = 5 * time.Second
+	forwarderIOTimeout   = 5 * time.Second
+	forwarderBackoffUnit = time.Second
+	forwarderMaxBackoff  = 2 * time.Minute
+)
+
+// Forwarder is an internal consumer of a channel (of the same name) on
+// a source topic that publishes every message it receives to a destination
+// topic, either on this nsqd or on a remote nsqd (via TCP).
+//
+// Like a client, it has a maximum number of messages in-flight (its RDY count)
+// and when publishing fails it requeues the message and backs off exponentially.
+type Forwarder struct {
+	sync.Mutex // protects the remote connection
+
+	name        string
+	source      string
+	destination string
+	address     string // remote nsqd TCP address ("" for this nsqd)
+	maxInFlight int64
+	context     *NSQd
+	channel     *Channel
+
+	conn       net.Conn
+	connReader *bufio.Reader
+
+	inFlightCount  int64
+	forwardCount   uint64
+	errorCount     uint64
+	requeueCount   uint64
+	backoffCounter int32
+	backoffUntil   int64 // (unix nano)
+	paused         int32
+	exitFlag       int32
+	createTime     time.Time
+
+	readyStateChan chan int
+	exitChan       chan int
+	waitGroup      util.WaitGroupWrapper
+	deleteCallback func(*Forwarder)
+	deleter        sync.Once
+}
+
+// NewForwarder creates a Forwarder and starts consuming from the channel
+// (which the caller is responsible for creating on the source topic), deleteCallback
+// is called once it is closed by the channel (ie. the source topic or channel was deleted)
+func NewForwarder(name string, source string, destination string, address string, maxInFlight int64,
+	context *NSQd, channel *Channel, deleteCallback func(*Forwarder)) *Forwarder {
+	f := &Forwarder{
+		name:        name,
+		source:      source,
+		destination: destination,
+		address:     address,
+		maxInFlight: maxInFlight,
+		context:     context,
+		channel:     channel,
+		createTime:  time.Now(),
+		// readyStateChan has a buffer of 1 to guarantee that in the event
+		// there is a race the state update is not lost
+		readyStateChan: make(chan int, 1),
+		exitChan:       make(chan int),
+		deleteCallback: deleteCallback,
+	}
+
+	if channel.IsPaused() {
+		f.paused = 1
+	}
+	channel.AddClient(f)
+	f.waitGroup.Wrap(func() { f.messagePump() })
+
+	return f
+}
+
+func (f *Forwarder) log() nsq.LogEntry {
+	return f.context.log("forwarder", f.String())
+}
+
+func (f *Forwarder) String() string {
+	return fmt.Sprintf("%s(%s -> %s)", f.name, f.source, f.destinationString())
+}
+
+func (f *Forwarder) destinationString() string {
+	if f.address == "" {
+		return f.destination
+	}
+	return f.address + "/" + f.destination
+}
+
+// IsReadyForMessages returns true unless the forwarder is paused, backing off
+// or at its maximum number of messages in-flight (only 1 while recovering from
+// a backoff)
+func (f *Forwarder) IsReadyForMessages() bool {
+	if atomic.LoadInt32(&f.paused) == 1 {
+		return false
+	}
+
+	if time.Now().UnixNano() < atomic.LoadInt64(&f.backoffUntil) {
+		return false
+	}
+
+	maxInFlight := f.maxInFlight
+	if atomic.LoadInt32(&f.backoffCounter) > 0 {
+		maxInFlight = 1
+	}
+
+	return atomic.LoadInt64(&f.inFlightCount) < maxInFlight
+}
+
+func (f *Forwarder) tryUpdateReadyState() {
+	// you can always *try* to write to readyStateChan because in the cases
+	// where you cannot the message pump loop would have iterated anyway.
+	select {
+	case f.readyStateChan <- 1:
+	default:
+	}
+}
+
+// Pause implements the Consumer interface
+func (f *Forwarder) Pause() {
+	atomic.StoreInt32(&f.paused, 1)
+	f.tryUpdateReadyState()
+}
+
+// UnPause implements the Consumer interface
+func (f *Forwarder) UnPause() {
+	atomic.StoreInt32(&f.paused, 0)
+	f.tryUpdateReadyState()
+}
+
+// TimedOutMessage implements the Consumer interface
+func (f *Forwarder) TimedOutMessage() {
+	atomic.AddInt64(&f.inFlightCount, -1)
+	f.tryUpdateReadyState()
+}
+
+// Close implements the Consumer interface, it is called when the channel exits and
+// initiates exit (without waiting), the forwarder is then deleted via deleteCallback
+func (f *Forwarder) Close() error {
+	err := f.exit()
+	if err != nil {
+		return err
+	}
+	go f.deleter.Do(func() { f.deleteCallback(f) })
+	return nil
+}
+
+func (f *Forwarder) exit() error {
+	if !atomic.CompareAndSwapInt32(&f.exitFlag, 0, 1) {
+		return errors.New("exiting")
+	}
+	close(f.exitChan)
+	return nil
+}
+
+// Stop closes the forwarder and waits for messages being forwarded to complete
+func (f *Forwarder) Stop() {
+	f.log().Infof("closing forwarder")
+
+	f.exit()
+	f.waitGroup.Wait()
+	f.channel.RemoveClient(f)
+
+	f.Lock()
+	f.closeConn()
+	f.Unlock()
+}
+
+// Stats implements the Consumer interface
+func (f *Forwarder) Stats() ClientStats {
+	remoteAddress := f.address
+	if remoteAddress == "" {
+		remoteAddress = "local"
+	}
+	return ClientStats{
+		Version:       "forwarder",
+		RemoteAddress: remoteAddress,
+		Name:          f.name,
+		ReadyCount:    f.maxInFlight,
+		InFlightCount: atomic.LoadInt64(&f.inFlightCount),
+		MessageCount:  atomic.LoadUint64(&f.forwardCount) + atomic.LoadUint64(&f.requeueCount),
+		FinishCount:   atomic.LoadUint64(&f.forwardCount),
+		RequeueCount:  atomic.LoadUint64(&f.requeueCount),
+		ConnectTime:   f.createTime.Unix(),
+	}
+}
+
+// ForwarderStats returns the forwarder's stats
+func (f *Forwarder) ForwarderStats() ForwarderStats {
+	return ForwarderStats{
+		Name:           f.name,
+		Source:         f.source,
+		Destination:    f.destination,
+		Address:        f.address,
+		MaxInFlight:    f.maxInFlight,
+		InFlightCount:  atomic.LoadInt64(&f.inFlightCount),
+		ForwardCount:   atomic.LoadUint64(&f.forwardCount),
+		ErrorCount:     atomic.LoadUint64(&f.errorCount),
+		RequeueCount:   atomic.LoadUint64(&f.requeueCount),
+		BackoffCounter: atomic.LoadInt32(&f.backoffCounter),
+		Paused:         atomic.LoadInt32(&f.paused) == 1,
+	}
+}
+
+// messagePump receives messages from the channel (as long as we are ready)
+// and forwards each in its own goroutine
+func (f *Forwarder) messagePump() {
+	var clientMsgChan chan *nsq.Message
+	var backoffChan <-chan time.Time
+
+	for {
+		clientMsgChan = nil
+		backoffChan = nil
+		if f.IsReadyForMessages() {
+			clientMsgChan = f.channel.clientMsgChan
+		} else {
+			remaining := atomic.LoadInt64(&f.backoffUntil) - time.Now().UnixNano()
+			if remaining > 0 {
+				backoffChan = time.After(time.Duration(remaining))
+			}
+		}
+
+		select {
+		case <-f.readyStateChan:
+		case <-backoffChan:
+		case msg, ok := <-clientMsgChan:
+			if !ok {
+				goto exit
+			}
+
+			f.channel.StartInFlightTimeout(msg, f)
+			atomic.AddInt64(&f.inFlightCount, 1)
+			f.waitGroup.Wrap(func() { f.forward(msg) })
+		case <-f.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	f.log().Infof("closing ... messagePump")
+}
+
+// forward publishes a message to the destination, finishing it on success
+// and otherwise requeueing it (deferred by the backoff duration)
+func (f *Forwarder) forward(msg *nsq.Message) {
+	err := f.publish(msg)
+	if err != nil {
+		f.log().Errorf("failed to forward msg(%s) - %s", msg.Id, err.Error())
+		atomic.AddUint64(&f.errorCount, 1)
+		delay := f.backoff()
+		err = f.channel.RequeueMessage(f, msg.Id, delay)
+		if err == nil {
+			atomic.AddUint64(&f.requeueCount, 1)
+			atomic.AddInt64(&f.inFlightCount, -1)
+		}
+	} else {
+		f.recoverBackoff()
+		err = f.channel.FinishMessage(f, msg.Id)
+		if err == nil {
+			atomic.AddUint64(&f.forwardCount, 1)
+			atomic.AddInt64(&f.inFlightCount, -1)
+		}
+	}
+	f.tryUpdateReadyState()
+}
+
+// backoff increments the backoff counter and returns the (exponential) backoff duration
+func (f *Forwarder) backoff() time.Duration {
+	counter := atomic.AddInt32(&f.backoffCounter, 1)
+	backoffDuration := forwarderBackoffUnit * time.Duration(math.Pow(2, float64(counter-1)))
+	if backoffDuration > forwarderMaxBackoff {
+		backoffDuration = forwarderMaxBackoff
+		atomic.AddInt32(&f.backoffCounter, -1)
+	}
+	atomic.StoreInt64(&f.backoffUntil, time.Now().Add(backoffDuration).UnixNano())
+	f.log().Infof("backing off for %s", backoffDuration)
+	return backoffDuration
+}
+
+// recoverBackoff decrements the backoff counter after a successful publish
+func (f *Forwarder) recoverBackoff() {
+	for {
+		counter := atomic.LoadInt32(&f.backoffCounter)
+		if counter <= 0 || atomic.CompareAndSwapInt32(&f.backoffCounter, counter, counter-1) {
+			return
+		}
+	}
+}
+
+func (f *Forwarder) publish(msg *nsq.Message) error {
+	if f.address == "" {
+		topic := f.context.GetTopic(f.destination)
+		fwdMsg := nsq.NewMessage(<-f.context.idChan, msg.Body)
+		fwdMsg.Headers = msg.Headers
+		return topic.PutMessage(fwdMsg)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	// an existing connection may have been closed by the remote nsqd
+	// (ie. idle timeout), in which case reconnect and try again
+	reused := f.conn != nil
+	err := f.publishRemote(msg)
+	if err != nil && reused {
+		err = f.publishRemote(msg)
+	}
+	return err
+}
+
+// publishRemote publishes a message over the (lazily established) remote connection,
+// this expects the caller to handle locking
+func (f *Forwarder) publishRemote(msg *nsq.Message) error {
+	var err error
+	var cmd *nsq.Command
+
+	if f.conn == nil {
+		conn, err := net.DialTimeout("tcp", f.address, forwarderDialTimeout)
+		if err != nil {
+			return err
+		}
+		f.log().Infof("connected to %s", f.address)
+		f.conn = conn
+		f.connReader = bufio.NewReader(conn)
+
+		f.conn.SetWriteDeadline(time.Now().Add(forwarderIOTimeout))
+		_, err = f.conn.Write(nsq.MagicV2)
+		if err != nil {
+			f.closeConn()
+			return err
+		}
+	}
+
+	if len(msg.Headers) > 0 {
+		cmd, err = nsq.PublishWithHeaders(f.destination, msg.Headers, msg.Body)
+		if err != nil {
+			return err
+		}
+	} else {
+		cmd = nsq.Publish(f.destination, msg.Body)
+	}
+
+	f.conn.SetDeadline(time.Now().Add(forwarderIOTimeout))
+	err = cmd.Write(f.conn)
+	if err != nil {
+		f.closeConn()
+		return err
+	}
+
+	for {
+		resp, err := nsq.ReadResponse(f.connReader)
+		if err != nil {
+			f.closeConn()
+			return err
+		}
+
+		frameType, data, err := nsq.UnpackResponse(resp)
+		if err != nil {
+			f.closeConn()
+			return err
+		}
+
+		switch {
+		case frameType == nsq.FrameTypeError:
+			f.closeConn()
+			return fmt.Errorf("%s", data)
+		case bytes.Equal(data, []byte("_heartbeat_")):
+			err = nsq.Nop().Write(f.conn)
+			if err != nil {
+				f.closeConn()
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// closeConn expects the caller to handle locking
+func (f *Forwarder) closeConn() {
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+		f.connReader = nil
+	}
+}
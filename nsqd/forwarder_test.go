@@ -0,0 +1,148 @@
+package nsqd
+
+import (
+	"../nsq"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLocalForwarder(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	source := "test_forward_src" + suffix
+	destination := "test_forward_dst" + suffix
+
+	_, err := nsqd.CreateForwarder("fwd", source, source, "", 1)
+	assert.NotEqual(t, err, nil)
+
+	_, err = nsqd.CreateForwarder("fwd", source, destination, "", 1)
+	assert.Equal(t, err, nil)
+
+	_, err = nsqd.CreateForwarder("fwd", source, destination, "", 1)
+	assert.NotEqual(t, err, nil)
+
+	channel := nsqd.GetTopic(destination).GetChannel("ch")
+
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	msg.Headers = map[string]string{"a": "b"}
+	nsqd.GetTopic(source).PutMessage(msg)
+
+	outputMsg := <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Body, msg.Body)
+	assert.Equal(t, outputMsg.Headers, msg.Headers)
+
+	time.Sleep(25 * time.Millisecond)
+	stats := nsqd.getForwarderStats()
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].ForwardCount, uint64(1))
+	assert.Equal(t, stats[0].InFlightCount, int64(0))
+
+	err = nsqd.DeleteExistingForwarder("fwd")
+	assert.Equal(t, err, nil)
+	_, err = nsqd.GetTopic(source).GetExistingChannel("fwd")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestRemoteForwarder(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, _, nsqd := mustStartNSQd(NewOptions())
+	defer nsqd.Stop()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	source := "test_remote_src" + suffix
+	destination := "test_remote_dst" + suffix
+
+	_, err := nsqd.CreateForwarder("remote", source, destination, tcpAddr.String(), 1)
+	assert.Equal(t, err, nil)
+
+	// nothing is listening here so forwarding fails and backs off
+	_, err = nsqd.CreateForwarder("failing", source, destination, "127.0.0.1:1", 1)
+	assert.Equal(t, err, nil)
+
+	channel := nsqd.GetTopic(destination).GetChannel("ch")
+	nsqd.GetTopic(source).PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+
+	outputMsg := <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Body, []byte("test body"))
+
+	time.Sleep(50 * time.Millisecond)
+	stats := nsqd.getForwarderStats()
+	assert.Equal(t, stats[0].Name, "failing")
+	assert.Equal(t, stats[0].ErrorCount, uint64(1))
+	assert.Equal(t, stats[0].RequeueCount, uint64(1))
+	assert.Equal(t, stats[0].BackoffCounter, int32(1))
+	assert.Equal(t, stats[1].Name, "remote")
+	assert.Equal(t, stats[1].ForwardCount, uint64(1))
+
+	failing, _ := nsqd.GetTopic(source).GetExistingChannel("failing")
+	assert.Equal(t, len(failing.deferredMessages), 1)
+}
+
+func TestForwarderCycle(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	a, b, c := "test_cycle_a"+suffix, "test_cycle_b"+suffix, "test_cycle_c"+suffix
+
+	_, err := nsqd.CreateForwarder("a_b", a, b, "", 1)
+	assert.Equal(t, err, nil)
+	_, err = nsqd.CreateForwarder("b_c", b, c, "", 1)
+	assert.Equal(t, err, nil)
+
+	// a -> b -> c -> a
+	_, err = nsqd.CreateForwarder("c_a", c, a, "", 1)
+	assert.NotEqual(t, err, nil)
+	_, err = nsqd.GetTopic(c).GetExistingChannel("c_a")
+	assert.NotEqual(t, err, nil)
+
+	// a remote destination of the same name is not part of the cycle
+	_, err = nsqd.CreateForwarder("c_a", c, a, "127.0.0.1:1", 1)
+	assert.Equal(t, err, nil)
+	_, err = nsqd.CreateForwarder("a_c", a, c, "", 1)
+	assert.Equal(t, err, nil)
+}
+
+func TestForwarderSourceDeleted(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	source := "test_deleted_src" + suffix
+	destination := "test_deleted_dst" + suffix
+
+	_, err := nsqd.CreateForwarder("channel", source, destination, "", 1)
+	assert.Equal(t, err, nil)
+	_, err = nsqd.CreateForwarder("topic", source, destination, "", 1)
+	assert.Equal(t, err, nil)
+
+	// the forwarders are removed once their channel is deleted, with it or its topic
+	nsqd.GetTopic(source).DeleteExistingChannel("channel")
+	time.Sleep(25 * time.Millisecond)
+	stats := nsqd.getForwarderStats()
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].Name, "topic")
+
+	nsqd.DeleteExistingTopic(source)
+	time.Sleep(25 * time.Millisecond)
+	assert.Equal(t, len(nsqd.getForwarderStats()), 0)
+	assert.NotEqual(t, nsqd.DeleteExistingForwarder("topic"), nil)
+}
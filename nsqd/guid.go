@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 // the core algorithm here was borrowed from:
 // Blake Mizerany's `noeqd` https://github.com/bmizerany/noeqd
@@ -30,32 +30,41 @@ const (
 var ErrTimeBackwards = errors.New("time has gone backwards")
 var ErrSequenceExpired = errors.New("sequence expired")
 
-var sequence int64
-var lastTimestamp int64
-
 type GUID int64
 
-func NewGUID(workerId int64) (GUID, error) {
+// guidFactory generates the GUIDs of a single NSQd (it is not safe for concurrent use,
+// see NSQd.idPump)
+type guidFactory struct {
+	workerId      int64
+	sequence      int64
+	lastTimestamp int64
+}
+
+func newGUIDFactory(workerId int64) *guidFactory {
+	return &guidFactory{workerId: workerId}
+}
+
+func (f *guidFactory) NewGUID() (GUID, error) {
 	ts := time.Now().UnixNano() / 1e6
 
-	if ts < lastTimestamp {
+	if ts < f.lastTimestamp {
 		return 0, ErrTimeBackwards
 	}
 
-	if lastTimestamp == ts {
-		sequence = (sequence + 1) & sequenceMask
-		if sequence == 0 {
+	if f.lastTimestamp == ts {
+		f.sequence = (f.sequence + 1) & sequenceMask
+		if f.sequence == 0 {
 			return 0, ErrSequenceExpired
 		}
 	} else {
-		sequence = 0
+		f.sequence = 0
 	}
 
-	lastTimestamp = ts
+	f.lastTimestamp = ts
 
 	id := ((ts - twepoch) << timestampShift) |
-		(workerId << workerIdShift) |
-		sequence
+		(f.workerId << workerIdShift) |
+		f.sequence
 
 	return GUID(id), nil
 }
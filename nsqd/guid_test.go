@@ -0,0 +1,25 @@
+package nsqd
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestGUIDFactory(t *testing.T) {
+	f1 := newGUIDFactory(1)
+	f2 := newGUIDFactory(2)
+
+	// ids are unique across factories with distinct worker ids
+	ids := make(map[GUID]bool)
+	for i := 0; i < 1000; i++ {
+		for _, f := range []*guidFactory{f1, f2} {
+			id, err := f.NewGUID()
+			if err == ErrSequenceExpired {
+				continue
+			}
+			assert.Equal(t, err, nil)
+			assert.Equal(t, ids[id], false)
+			ids[id] = true
+		}
+	}
+}
@@ -1,40 +1,61 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"github.com/lhzd863/nsq-0.2.16/util"
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 )
 
 import httpprof "net/http/pprof"
 
-func httpServer(listener net.Listener) {
-	log.Printf("HTTP: listening on %s", listener.Addr().String())
+// the HTTP header used to supply a dedup key to /put and /mput
+const dedupKeyHttpHeader = "X-NSQ-Dedup-Key"
 
+type httpServer struct {
+	context *NSQd
+}
+
+func serveHttp(context *NSQd, listener net.Listener) {
+	l := context.log("addr", listener.Addr().String())
+	l.Infof("listening for HTTP clients")
+
+	s := &httpServer{context: context}
 	handler := http.NewServeMux()
-	handler.HandleFunc("/ping", pingHandler)
-	handler.HandleFunc("/info", infoHandler)
-	handler.HandleFunc("/put", putHandler)
-	handler.HandleFunc("/mput", mputHandler)
-	handler.HandleFunc("/stats", statsHandler)
-	handler.HandleFunc("/delete_topic", deleteTopicHandler)
-	handler.HandleFunc("/empty_channel", emptyChannelHandler)
-	handler.HandleFunc("/delete_channel", deleteChannelHandler)
-	handler.HandleFunc("/mem_profile", memProfileHandler)
+	handler.HandleFunc("/ping", s.pingHandler)
+	handler.HandleFunc("/info", s.infoHandler)
+	handler.HandleFunc("/put", s.putHandler)
+	handler.HandleFunc("/mput", s.mputHandler)
+	handler.HandleFunc("/stats", s.statsHandler)
+	handler.HandleFunc("/delete_topic", s.deleteTopicHandler)
+	handler.HandleFunc("/empty_channel", s.emptyChannelHandler)
+	handler.HandleFunc("/delete_channel", s.deleteChannelHandler)
+	handler.HandleFunc("/delete_message", s.deleteMessageHandler)
+	handler.HandleFunc("/requeue_message", s.requeueMessageHandler)
+	handler.HandleFunc("/mem_profile", s.memProfileHandler)
 	handler.HandleFunc("/cpu_profile", httpprof.Profile)
-	handler.HandleFunc("/pause_channel", pauseChannelHandler)
-	handler.HandleFunc("/unpause_channel", pauseChannelHandler)
-	handler.HandleFunc("/create_topic", createTopicHandler)
-	handler.HandleFunc("/create_channel", createChannelHandler)
+	handler.HandleFunc("/pause_channel", s.pauseChannelHandler)
+	handler.HandleFunc("/unpause_channel", s.pauseChannelHandler)
+	handler.HandleFunc("/pause_topic", s.pauseTopicHandler)
+	handler.HandleFunc("/unpause_topic", s.pauseTopicHandler)
+	handler.HandleFunc("/create_topic", s.createTopicHandler)
+	handler.HandleFunc("/create_channel", s.createChannelHandler)
+	handler.HandleFunc("/set_topic_retention", s.setTopicRetentionHandler)
+	handler.HandleFunc("/replay_channel", s.replayChannelHandler)
+	handler.HandleFunc("/create_forwarder", s.createForwarderHandler)
+	handler.HandleFunc("/delete_forwarder", s.deleteForwarderHandler)
+	handler.HandleFunc("/config", s.configHandler)
+	handler.HandleFunc("/add_lookupd_peer", s.addLookupdPeerHandler)
+	handler.HandleFunc("/remove_lookupd_peer", s.removeLookupdPeerHandler)
 
 	// these timeouts are absolute per server connection NOT per request
 	// this means that a single persistent connection will only last N seconds
@@ -44,17 +65,19 @@ func httpServer(listener net.Listener) {
 	err := server.Serve(listener)
 	// theres no direct way to detect this error because it is not exposed
 	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: http.Serve() - %s", err.Error())
+		l.Errorf("http.Serve() - %s", err.Error())
 	}
 
-	log.Printf("HTTP: closing %s", listener.Addr().String())
+	l.Infof("closing HTTP listener")
 }
 
-func memProfileHandler(w http.ResponseWriter, req *http.Request) {
-	log.Printf("MEMORY Profiling Enabled")
+func (s *httpServer) memProfileHandler(w http.ResponseWriter, req *http.Request) {
+	s.context.log().Infof("MEMORY Profiling Enabled")
 	f, err := os.Create("nsqd.mprof")
 	if err != nil {
-		log.Fatal(err)
+		s.context.log().Errorf("failed to create mem profile - %s", err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
 	}
 	pprof.WriteHeapProfile(f)
 	f.Close()
@@ -63,12 +86,12 @@ func memProfileHandler(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "OK")
 }
 
-func pingHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Length", "2")
 	io.WriteString(w, "OK")
 }
 
-func infoHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) infoHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", struct {
 		Version string `json:"version"`
 	}{
@@ -76,10 +99,10 @@ func infoHandler(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
-func putHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) putHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -95,9 +118,24 @@ func putHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	topic := nsqd.GetTopic(topicName)
-	msg := nsq.NewMessage(<-nsqd.idChan, reqParams.Body)
-	err = topic.PutMessage(msg)
+	priority, _ := reqParams.Get("priority")
+	_, err = parsePriority(priority)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_PRIORITY", nil)
+		return
+	}
+
+	// the dedup key is supplied via a header (the body is the message)
+	dedupKey := req.Header.Get(dedupKeyHttpHeader)
+	if dedupKey != "" && !nsq.IsValidDedupKey(dedupKey) {
+		util.ApiResponse(w, 500, "INVALID_DEDUP_KEY", nil)
+		return
+	}
+
+	topic := s.context.GetTopic(topicName)
+	msg := nsq.NewMessage(<-s.context.idChan, reqParams.Body)
+	setMessagePriority(msg, priority)
+	_, err = topic.PutMessagesDedup(dedupKey, []*nsq.Message{msg})
 	if err != nil {
 		util.ApiResponse(w, 500, "NOK", nil)
 		return
@@ -107,10 +145,20 @@ func putHandler(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "OK")
 }
 
-func mputHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) mputHandler(w http.ResponseWriter, req *http.Request) {
+	// binary (MPUB framed) and JSON array batches are size limited, the body
+	// is read up to one byte past the limit to detect that it is too big
+	query := req.URL.Query()
+	binaryBatch := query.Get("binary") == "true"
+	jsonBatch := query.Get("json") == "true"
+	maxMsgSize, maxBodySize := s.context.options.MaxMsgSize, s.context.options.MaxBodySize
+	if binaryBatch || jsonBatch {
+		req.Body = ioutil.NopCloser(io.LimitReader(req.Body, maxBodySize+1))
+	}
+
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -126,26 +174,76 @@ func mputHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	topic := nsqd.GetTopic(topicName)
-	for _, block := range bytes.Split(reqParams.Body, []byte("\n")) {
-		if len(block) != 0 {
-			msg := nsq.NewMessage(<-nsqd.idChan, block)
-			err := topic.PutMessage(msg)
-			if err != nil {
-				util.ApiResponse(w, 500, "NOK", nil)
-				return
-			}
+	priority, _ := reqParams.Get("priority")
+	_, err = parsePriority(priority)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_PRIORITY", nil)
+		return
+	}
+
+	// the dedup key is supplied via a header (the body is the batch)
+	dedupKey := req.Header.Get(dedupKeyHttpHeader)
+	if dedupKey != "" && !nsq.IsValidDedupKey(dedupKey) {
+		util.ApiResponse(w, 500, "INVALID_DEDUP_KEY", nil)
+		return
+	}
+
+	// the whole batch is decoded before any of it is published, an invalid
+	// binary/JSON message fails the batch (the response names its index)
+	var bodies [][]byte
+	switch {
+	case binaryBatch && jsonBatch:
+		util.ApiResponse(w, 500, "INVALID_ARG_JSON", nil)
+		return
+	case binaryBatch || jsonBatch:
+		if int64(len(reqParams.Body)) > maxBodySize {
+			util.ApiResponse(w, 500, "BODY_TOO_BIG", nil)
+			return
 		}
+		if binaryBatch {
+			bodies, err = decodeMPUB(reqParams.Body, maxMsgSize)
+		} else {
+			bodies, err = decodeJSONBatch(reqParams.Body, maxMsgSize)
+		}
+	default:
+		bodies = decodeNewlineBatch(reqParams.Body)
+	}
+	if e, ok := err.(*batchMessageError); ok {
+		util.ApiResponse(w, 500, "INVALID_MESSAGE", struct {
+			Index int    `json:"index"`
+			Error string `json:"error"`
+		}{e.Index, e.Err.Error()})
+		return
+	}
+	if err != nil {
+		s.context.log().Errorf("failed to decode /mput body - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_BODY", nil)
+		return
+	}
+
+	messages := make([]*nsq.Message, 0, len(bodies))
+	for _, body := range bodies {
+		msg := nsq.NewMessage(<-s.context.idChan, body)
+		setMessagePriority(msg, priority)
+		messages = append(messages, msg)
+	}
+
+	// the dedup key covers the whole batch
+	topic := s.context.GetTopic(topicName)
+	_, err = topic.PutMessagesDedup(dedupKey, messages)
+	if err != nil {
+		util.ApiResponse(w, 500, "NOK", nil)
+		return
 	}
 
 	w.Header().Set("Content-Length", "2")
 	io.WriteString(w, "OK")
 }
 
-func createTopicHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) createTopicHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -161,14 +259,14 @@ func createTopicHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	nsqd.GetTopic(topicName)
+	s.context.GetTopic(topicName)
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -179,7 +277,7 @@ func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = nsqd.DeleteExistingTopic(topicName)
+	err = s.context.DeleteExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
 		return
@@ -188,10 +286,10 @@ func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func createChannelHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) createChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -202,20 +300,34 @@ func createChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	topic, err := nsqd.GetExistingTopic(topicName)
+	var filter MessageFilter
+	filterExpr, err := reqParams.Get("filter")
+	if err == nil {
+		filter, err = NewMessageFilter(filterExpr)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_FILTER", nil)
+			return
+		}
+	}
+
+	topic, err := s.context.GetExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
 		return
 	}
 
-	topic.GetChannel(channelName)
+	if filter != nil {
+		topic.GetFilteredChannel(channelName, filter)
+	} else {
+		topic.GetChannel(channelName)
+	}
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -226,7 +338,7 @@ func emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	topic, err := nsqd.GetExistingTopic(topicName)
+	topic, err := s.context.GetExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
 		return
@@ -238,7 +350,7 @@ func emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = EmptyQueue(channel)
+	err = channel.Empty()
 	if err != nil {
 		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
 		return
@@ -247,10 +359,10 @@ func emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -261,7 +373,7 @@ func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	topic, err := nsqd.GetExistingTopic(topicName)
+	topic, err := s.context.GetExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
 		return
@@ -276,10 +388,69 @@ func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
+func getMessageIDArg(rp *util.ReqParams) (nsq.MessageID, error) {
+	var id nsq.MessageID
+
+	idStr, err := rp.Get("id")
+	if err != nil {
+		return id, errors.New("MISSING_ARG_ID")
+	}
+
+	if len(idStr) != nsq.MsgIdLength {
+		return id, errors.New("INVALID_ARG_ID")
+	}
+
+	copy(id[:], idStr)
+	return id, nil
+}
+
+func (s *httpServer) deleteMessageHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	id, err := getMessageIDArg(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	topic, err := s.context.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.DeleteMessage(id)
+	if err != nil {
+		util.ApiResponse(w, 404, "MESSAGE_NOT_FOUND", nil)
+		return
+	}
+
+	channel.log().Infof("deleted msg(%s)", id)
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) requeueMessageHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -290,7 +461,66 @@ func pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	topic, err := nsqd.GetExistingTopic(topicName)
+	id, err := getMessageIDArg(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	var timeoutMs int
+	timeoutStr, err := reqParams.Get("timeout")
+	if err == nil {
+		timeoutMs, err = strconv.Atoi(timeoutStr)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_TIMEOUT", nil)
+			return
+		}
+	}
+	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
+
+	if timeoutDuration < 0 || timeoutDuration > maxTimeout {
+		util.ApiResponse(w, 500, "INVALID_ARG_TIMEOUT", nil)
+		return
+	}
+
+	topic, err := s.context.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CHANNEL", nil)
+		return
+	}
+
+	err = channel.ForceRequeueMessage(id, timeoutDuration)
+	if err != nil {
+		util.ApiResponse(w, 404, "MESSAGE_NOT_FOUND", nil)
+		return
+	}
+
+	channel.log().Infof("requeued msg(%s) with timeout %s", id, timeoutDuration)
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	topic, err := s.context.GetExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
 		return
@@ -311,10 +541,287 @@ func pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
-func statsHandler(w http.ResponseWriter, req *http.Request) {
+func (s *httpServer) pauseTopicHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	topic, err := s.context.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	if strings.HasPrefix(req.URL.Path, "/pause") {
+		topic.Pause()
+	} else {
+		topic.UnPause()
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) setTopicRetentionHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	topic, err := s.context.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	var durationMs int64
+	durationStr, err := reqParams.Get("duration")
+	if err == nil {
+		durationMs, err = strconv.ParseInt(durationStr, 10, 64)
+		if err != nil || durationMs < 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_DURATION", nil)
+			return
+		}
+	}
+
+	var maxBytes int64
+	maxBytesStr, err := reqParams.Get("max_bytes")
+	if err == nil {
+		maxBytes, err = strconv.ParseInt(maxBytesStr, 10, 64)
+		if err != nil || maxBytes < 0 {
+			util.ApiResponse(w, 500, "INVALID_ARG_MAX_BYTES", nil)
+			return
+		}
+	}
+
+	err = topic.SetRetention(time.Duration(durationMs)*time.Millisecond, maxBytes)
+	if err != nil {
+		s.context.log("topic", topicName).Errorf("failed to set retention - %s", err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) replayChannelHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	sinceStr, err := reqParams.Get("since")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_SINCE", nil)
+		return
+	}
+	since, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_SINCE", nil)
+		return
+	}
+
+	topic, err := s.context.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	_, err = topic.ReplayChannel(channelName, since)
+	if err == errRetentionNotEnabled {
+		util.ApiResponse(w, 500, "RETENTION_NOT_ENABLED", nil)
+		return
+	} else if err != nil {
+		s.context.log("topic", topicName, "channel", channelName).Errorf("failed to replay channel - %s", err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) createForwarderHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	name, err := reqParams.Get("name")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_NAME", nil)
+		return
+	}
+
+	source, err := reqParams.Get("source")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_SOURCE", nil)
+		return
+	}
+
+	destination, err := reqParams.Get("destination")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_DESTINATION", nil)
+		return
+	}
+
+	address, _ := reqParams.Get("address")
+	if address != "" {
+		_, err = net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_ADDRESS", nil)
+			return
+		}
+	}
+
+	maxInFlight := int64(1)
+	maxInFlightStr, err := reqParams.Get("max_in_flight")
+	if err == nil {
+		maxInFlight, err = strconv.ParseInt(maxInFlightStr, 10, 64)
+		if err != nil {
+			util.ApiResponse(w, 500, "INVALID_ARG_MAX_IN_FLIGHT", nil)
+			return
+		}
+	}
+
+	_, err = s.context.CreateForwarder(name, source, destination, address, maxInFlight)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_FORWARDER", map[string]string{"error": err.Error()})
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) deleteForwarderHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
-		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	name, err := reqParams.Get("name")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_NAME", nil)
+		return
+	}
+
+	err = s.context.DeleteExistingForwarder(name)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_FORWARDER", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) addLookupdPeerHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	address, err := reqParams.Get("address")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_ADDRESS", nil)
+		return
+	}
+
+	_, err = net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_ADDRESS", nil)
+		return
+	}
+
+	err = s.context.AddLookupdPeer(address)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_LOOKUPD_PEER", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func (s *httpServer) removeLookupdPeerHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	address, err := reqParams.Get("address")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_ADDRESS", nil)
+		return
+	}
+
+	err = s.context.RemoveLookupdPeer(address)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_LOOKUPD_PEER", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+// configHandler returns the current configuration (GET) or reloads the config file (POST/PUT)
+func (s *httpServer) configHandler(w http.ResponseWriter, req *http.Request) {
+	reloader := s.context.getConfigReloader()
+	if reloader == nil {
+		util.ApiResponse(w, 500, "NO_CONFIG", nil)
+		return
+	}
+
+	if req.Method != "POST" && req.Method != "PUT" {
+		util.ApiResponse(w, 200, "OK", reloader.Config())
+		return
+	}
+
+	applied, restartRequired, err := reloader.ReloadConfig()
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_CONFIG", map[string]string{"error": err.Error()})
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Applied         []string `json:"applied"`
+		RestartRequired []string `json:"restart_required"`
+	}{applied, restartRequired})
+}
+
+func (s *httpServer) statsHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		s.context.log().Errorf("failed to parse request params - %s", err.Error())
 		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
 		return
 	}
@@ -327,23 +834,36 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, fmt.Sprintf("nsqd v%s\n", util.BINARY_VERSION))
 	}
 
-	stats := nsqd.getStats()
+	stats := s.context.getStats()
+	forwarderStats := s.context.getForwarderStats()
 
 	if jsonFormat {
 		util.ApiResponse(w, 200, "OK", struct {
-			Topics []TopicStats `json:"topics"`
-		}{stats})
+			Topics     []TopicStats     `json:"topics"`
+			Forwarders []ForwarderStats `json:"forwarders"`
+		}{stats, forwarderStats})
 	} else {
 		if len(stats) == 0 {
 			io.WriteString(w, "\nNO_TOPICS\n")
 			return
 		}
 		for _, t := range stats {
-			io.WriteString(w, fmt.Sprintf("\n[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d\n",
+			var pausedPrefix string
+			if t.Paused {
+				pausedPrefix = "*P "
+			}
+			var retained string
+			if t.Retention {
+				retained = fmt.Sprintf(" retained: %d bytes", t.RetainedBytes)
+			}
+			io.WriteString(w, fmt.Sprintf("\n%s[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d dedup-hits: %-5d%s\n",
+				pausedPrefix,
 				t.TopicName,
 				t.Depth,
 				t.BackendDepth,
-				t.MessageCount))
+				t.MessageCount,
+				t.DedupHits,
+				retained))
 			for _, c := range t.Channels {
 				var pausedPrefix string
 				if c.Paused {
@@ -352,7 +872,7 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 					pausedPrefix = "    "
 				}
 				io.WriteString(w,
-					fmt.Sprintf("%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d\n",
+					fmt.Sprintf("%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d filtered: %-5d msgs: %-8d\n",
 						pausedPrefix,
 						c.ChannelName,
 						c.Depth,
@@ -361,6 +881,7 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 						c.DeferredCount,
 						c.RequeueCount,
 						c.TimeoutCount,
+						c.FilteredCount,
 						c.MessageCount))
 				for _, client := range c.Clients {
 					connectTime := time.Unix(client.ConnectTime, 0)
@@ -381,5 +902,23 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 				}
 			}
 		}
+		if len(forwarderStats) > 0 {
+			io.WriteString(w, "\nFORWARDERS\n")
+		}
+		for _, f := range forwarderStats {
+			destination := f.Destination
+			if f.Address != "" {
+				destination = f.Address + "/" + f.Destination
+			}
+			io.WriteString(w, fmt.Sprintf("    [%-25s] %s -> %s inflt: %-4d fwd: %-8d err: %-8d re-q: %-8d backoff: %d\n",
+				f.Name,
+				f.Source,
+				destination,
+				f.InFlightCount,
+				f.ForwardCount,
+				f.ErrorCount,
+				f.RequeueCount,
+				f.BackoffCounter))
+		}
 	}
 }
@@ -1,30 +1,22 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"github.com/lhzd863/nsq-0.2.16/util"
 	"bytes"
 	"encoding/json"
-	"github.com/bitly/go-notify"
-	"log"
+	"errors"
 	"net"
-	"os"
 	"strconv"
 	"time"
 )
 
-func (n *NSQd) lookupLoop() {
-	notifyChannelChan := make(chan interface{})
-	notifyTopicChan := make(chan interface{})
+// lookupLoop registers with the lookupd peers (as hostname) and keeps them up to date
+func (n *NSQd) lookupLoop(hostname string) {
 	syncTopicChan := make(chan *nsq.LookupPeer)
 
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.Fatalf("ERROR: failed to get hostname - %s", err.Error())
-	}
-
-	for _, host := range n.lookupdTCPAddrs {
-		log.Printf("LOOKUP: adding peer %s", host)
+	connect := func(host string) *nsq.LookupPeer {
+		n.log("lookupd", host).Infof("adding lookupd peer")
 		lookupPeer := nsq.NewLookupPeer(host, func(lp *nsq.LookupPeer) {
 			ci := make(map[string]interface{})
 			ci["version"] = util.BINARY_VERSION
@@ -38,15 +30,15 @@ func (n *NSQd) lookupLoop() {
 			}
 			resp, err := lp.Command(cmd)
 			if err != nil {
-				log.Printf("LOOKUPD(%s): ERROR %s - %s", lp, cmd, err.Error())
+				n.log("lookupd", lp.String()).Errorf("%s - %s", cmd, err.Error())
 			} else if bytes.Equal(resp, []byte("E_INVALID")) {
-				log.Printf("LOOKUPD(%s): lookupd returned %s", lp, resp)
+				n.log("lookupd", lp.String()).Errorf("IDENTIFY returned %s", resp)
 			} else {
 				err = json.Unmarshal(resp, &lp.Info)
 				if err != nil {
-					log.Printf("LOOKUPD(%s): ERROR parsing response - %v", lp, resp)
+					n.log("lookupd", lp.String()).Errorf("failed to parse IDENTIFY response %s", resp)
 				} else {
-					log.Printf("LOOKUPD(%s): peer info %+v", lp, lp.Info)
+					n.log("lookupd", lp.String()).Infof("peer info %+v", lp.Info)
 				}
 			}
 
@@ -55,13 +47,10 @@ func (n *NSQd) lookupLoop() {
 			}()
 		})
 		lookupPeer.Command(nil) // start the connection
-		n.lookupPeers = append(n.lookupPeers, lookupPeer)
+		return lookupPeer
 	}
 
-	if len(n.lookupPeers) > 0 {
-		notify.Start("channel_change", notifyChannelChan)
-		notify.Start("topic_change", notifyTopicChan)
-	}
+	n.updateLookupPeers(connect)
 
 	// for announcements, lookupd determines the host automatically
 	ticker := time.Tick(15 * time.Second)
@@ -70,16 +59,15 @@ func (n *NSQd) lookupLoop() {
 		case <-ticker:
 			// send a heartbeat and read a response (read detects closed conns)
 			for _, lookupPeer := range n.lookupPeers {
-				log.Printf("LOOKUPD(%s): sending heartbeat", lookupPeer)
+				n.log("lookupd", lookupPeer.String()).Infof("sending heartbeat")
 				cmd := nsq.Ping()
 				_, err := lookupPeer.Command(cmd)
 				if err != nil {
-					log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+					n.log("lookupd", lookupPeer.String()).Errorf("%s - %s", cmd, err.Error())
 				}
 			}
-		case channelObj := <-notifyChannelChan:
+		case channel := <-n.channelChangeChan:
 			// notify all nsqds that a new channel exists, or that it's removed
-			channel := channelObj.(*Channel)
 			var cmd *nsq.Command
 			if channel.Exiting() == true {
 				cmd = nsq.UnRegister(channel.topicName, channel.name)
@@ -87,15 +75,14 @@ func (n *NSQd) lookupLoop() {
 				cmd = nsq.Register(channel.topicName, channel.name)
 			}
 			for _, lookupPeer := range n.lookupPeers {
-				log.Printf("LOOKUPD(%s): channel %s", lookupPeer, cmd)
+				n.log("lookupd", lookupPeer.String()).Infof("channel %s", cmd)
 				_, err := lookupPeer.Command(cmd)
 				if err != nil {
-					log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+					n.log("lookupd", lookupPeer.String()).Errorf("%s - %s", cmd, err.Error())
 				}
 			}
-		case newTopic := <-notifyTopicChan:
+		case topic := <-n.topicChangeChan:
 			// notify all nsqds that a new topic exists, or that it's removed
-			topic := newTopic.(*Topic)
 			var cmd *nsq.Command
 			if topic.Exiting() == true {
 				cmd = nsq.UnRegister(topic.name, "")
@@ -103,17 +90,37 @@ func (n *NSQd) lookupLoop() {
 				cmd = nsq.Register(topic.name, "")
 			}
 			for _, lookupPeer := range n.lookupPeers {
-				log.Printf("LOOKUPD(%s): topic %s", lookupPeer, cmd)
+				n.log("lookupd", lookupPeer.String()).Infof("topic %s", cmd)
 				_, err := lookupPeer.Command(cmd)
 				if err != nil {
-					log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+					n.log("lookupd", lookupPeer.String()).Errorf("%s - %s", cmd, err.Error())
+				}
+			}
+		case topic := <-n.topicPauseChangeChan:
+			// notify all nsqds that a topic was paused or unpaused
+			var cmd *nsq.Command
+			if topic.IsPaused() {
+				cmd = nsq.Pause(topic.name)
+			} else {
+				cmd = nsq.UnPause(topic.name)
+			}
+			for _, lookupPeer := range n.lookupPeers {
+				n.log("lookupd", lookupPeer.String()).Infof("topic %s", cmd)
+				_, err := lookupPeer.Command(cmd)
+				if err != nil {
+					n.log("lookupd", lookupPeer.String()).Errorf("%s - %s", cmd, err.Error())
 				}
 			}
 		case lookupPeer := <-syncTopicChan:
+			if !n.isLookupPeer(lookupPeer) {
+				// removed since it connected
+				continue
+			}
+
 			commands := make([]*nsq.Command, 0)
 			// build all the commands first so we exit the lock(s) as fast as possible
-			nsqd.RLock()
-			for _, topic := range nsqd.topicMap {
+			n.RLock()
+			for _, topic := range n.topicMap {
 				topic.RLock()
 				if len(topic.channelMap) == 0 {
 					commands = append(commands, nsq.Register(topic.name, ""))
@@ -122,29 +129,170 @@ func (n *NSQd) lookupLoop() {
 						commands = append(commands, nsq.Register(channel.topicName, channel.name))
 					}
 				}
+				if topic.IsPaused() {
+					commands = append(commands, nsq.Pause(topic.name))
+				}
 				topic.RUnlock()
 			}
-			nsqd.RUnlock()
+			n.RUnlock()
 
 			for _, cmd := range commands {
-				log.Printf("LOOKUPD(%s): %s", lookupPeer, cmd)
+				n.log("lookupd", lookupPeer.String()).Infof("sending %s", cmd)
 				_, err := lookupPeer.Command(cmd)
 				if err != nil {
-					log.Printf("LOOKUPD(%s): ERROR %s - %s", lookupPeer, cmd, err.Error())
+					n.log("lookupd", lookupPeer.String()).Errorf("%s - %s", cmd, err.Error())
 					break
 				}
 			}
+		case <-n.lookupdChangeChan:
+			n.updateLookupPeers(connect)
 		case <-n.exitChan:
 			goto exit
 		}
 	}
 
 exit:
-	log.Printf("LOOKUP: closing")
-	if len(n.lookupPeers) > 0 {
-		notify.Stop("channel_change", notifyChannelChan)
-		notify.Stop("topic_change", notifyTopicChan)
+	n.log().Infof("closing lookupLoop")
+}
+
+// SetLookupdTCPAddrs changes the set of lookupd peers at runtime, new peers are
+// connected to (and sent a full sync) and removed peers are sent UNREGISTERs and
+// disconnected
+func (n *NSQd) SetLookupdTCPAddrs(addrs util.StringArray) {
+	n.Lock()
+	n.lookupdTCPAddrs = append(util.StringArray{}, addrs...)
+	n.Unlock()
+	n.notifyLookupdChange()
+}
+
+// AddLookupdPeer adds a lookupd peer at runtime
+func (n *NSQd) AddLookupdPeer(addr string) error {
+	n.Lock()
+	for _, host := range n.lookupdTCPAddrs {
+		if host == addr {
+			n.Unlock()
+			return errors.New("lookupd peer already exists")
+		}
+	}
+	n.lookupdTCPAddrs = append(append(util.StringArray{}, n.lookupdTCPAddrs...), addr)
+	n.Unlock()
+	n.notifyLookupdChange()
+	return nil
+}
+
+// RemoveLookupdPeer removes a lookupd peer at runtime
+func (n *NSQd) RemoveLookupdPeer(addr string) error {
+	n.Lock()
+	addrs := make(util.StringArray, 0, len(n.lookupdTCPAddrs))
+	for _, host := range n.lookupdTCPAddrs {
+		if host != addr {
+			addrs = append(addrs, host)
+		}
+	}
+	if len(addrs) == len(n.lookupdTCPAddrs) {
+		n.Unlock()
+		return errors.New("lookupd peer does not exist")
+	}
+	n.lookupdTCPAddrs = addrs
+	n.Unlock()
+	n.notifyLookupdChange()
+	return nil
+}
+
+// GetLookupdTCPAddrs returns the current set of lookupd peer addresses
+func (n *NSQd) GetLookupdTCPAddrs() []string {
+	n.RLock()
+	defer n.RUnlock()
+	return append([]string{}, n.lookupdTCPAddrs...)
+}
+
+func (n *NSQd) notifyLookupdChange() {
+	// lookupdChangeChan has a buffer of 1, a pending notification already
+	// guarantees that lookupLoop will pick up this change
+	select {
+	case n.lookupdChangeChan <- 1:
+	default:
+	}
+}
+
+// updateLookupPeers connects to the addresses in lookupdTCPAddrs that we are not
+// already peered with and unregisters from (and closes) the peers that are no
+// longer in lookupdTCPAddrs
+func (n *NSQd) updateLookupPeers(connect func(string) *nsq.LookupPeer) {
+	// lookupLoop is the only writer of lookupPeers, so they can be read without locking
+	addrs := n.GetLookupdTCPAddrs()
+	wanted := make(map[string]bool)
+	for _, host := range addrs {
+		wanted[host] = true
+	}
+
+	lookupPeers := make([]*nsq.LookupPeer, 0, len(wanted))
+	removedPeers := make([]*nsq.LookupPeer, 0)
+	for _, lookupPeer := range n.lookupPeers {
+		host := lookupPeer.String()
+		if !wanted[host] {
+			removedPeers = append(removedPeers, lookupPeer)
+			continue
+		}
+		delete(wanted, host)
+		lookupPeers = append(lookupPeers, lookupPeer)
+	}
+
+	// connect outside of the lock, the remaining wanted hosts are new peers
+	for _, host := range addrs {
+		if wanted[host] {
+			delete(wanted, host)
+			lookupPeers = append(lookupPeers, connect(host))
+		}
+	}
+
+	n.Lock()
+	n.lookupPeers = lookupPeers
+	n.Unlock()
+
+	if len(removedPeers) == 0 {
+		return
+	}
+
+	commands := n.unregisterCommands()
+	for _, lookupPeer := range removedPeers {
+		n.log("lookupd", lookupPeer.String()).Infof("removing lookupd peer")
+		for _, cmd := range commands {
+			n.log("lookupd", lookupPeer.String()).Infof("sending %s", cmd)
+			_, err := lookupPeer.Command(cmd)
+			if err != nil {
+				n.log("lookupd", lookupPeer.String()).Errorf("%s - %s", cmd, err.Error())
+				break
+			}
+		}
+		lookupPeer.Close()
+	}
+}
+
+// unregisterCommands builds the commands that remove all of our registrations from a lookupd
+func (n *NSQd) unregisterCommands() []*nsq.Command {
+	commands := make([]*nsq.Command, 0)
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			commands = append(commands, nsq.UnRegister(channel.topicName, channel.name))
+		}
+		commands = append(commands, nsq.UnRegister(topic.name, ""))
+		topic.RUnlock()
+	}
+	n.RUnlock()
+	return commands
+}
+
+// isLookupPeer expects the caller to be lookupLoop (the only writer of lookupPeers)
+func (n *NSQd) isLookupPeer(lookupPeer *nsq.LookupPeer) bool {
+	for _, lp := range n.lookupPeers {
+		if lp == lookupPeer {
+			return true
+		}
 	}
+	return false
 }
 
 func (n *NSQd) lookupHttpAddrs() []string {
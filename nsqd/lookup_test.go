@@ -0,0 +1,118 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/bmizerany/assert"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLookupd accepts a single nsqd connection, responding OK to every command,
+// and sends the commands it receives on cmdChan (closing it on disconnect)
+func fakeLookupd(t *testing.T) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+
+	cmdChan := make(chan string, 100)
+	go func() {
+		defer close(cmdChan)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		magic := make([]byte, 4)
+		_, err = io.ReadFull(reader, magic)
+		if err != nil {
+			return
+		}
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+
+			resp := []byte("OK")
+			if strings.HasPrefix(line, "IDENTIFY") {
+				var size int32
+				binary.Read(reader, binary.BigEndian, &size)
+				io.ReadFull(reader, make([]byte, size))
+				resp = []byte("{}")
+			}
+
+			binary.Write(conn, binary.BigEndian, int32(len(resp)))
+			conn.Write(resp)
+
+			cmdChan <- line
+		}
+	}()
+
+	return listener, cmdChan
+}
+
+// waitForCommand reads commands from cmdChan until cmd is received
+func waitForCommand(t *testing.T, cmdChan chan string, cmd string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-cmdChan:
+			if !ok {
+				t.Fatalf("connection closed waiting for %s", cmd)
+			}
+			if line == cmd {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", cmd)
+		}
+	}
+}
+
+func TestDynamicLookupdPeers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	_, _, nsqd := mustStartNSQd(NewOptions())
+	defer nsqd.Stop()
+
+	topicName := "test_lookupd_peers" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName).GetChannel("ch")
+
+	listener, cmdChan := fakeLookupd(t)
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// a new peer gets a full sync
+	err := nsqd.AddLookupdPeer(addr)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, nsqd.GetLookupdTCPAddrs(), []string{addr})
+	waitForCommand(t, cmdChan, "REGISTER "+topicName+" ch")
+
+	err = nsqd.AddLookupdPeer(addr)
+	assert.NotEqual(t, err, nil)
+
+	// a removed peer is unregistered from before disconnecting
+	err = nsqd.RemoveLookupdPeer(addr)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(nsqd.GetLookupdTCPAddrs()), 0)
+	waitForCommand(t, cmdChan, "UNREGISTER "+topicName+" ch")
+	waitForCommand(t, cmdChan, "UNREGISTER "+topicName)
+	for _ = range cmdChan {
+	}
+
+	err = nsqd.RemoveLookupdPeer(addr)
+	assert.NotEqual(t, err, nil)
+}
@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
@@ -6,10 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/bitly/go-notify"
 	"github.com/bitly/go-simplejson"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path"
@@ -19,9 +17,10 @@ import (
 	"time"
 )
 
+// NSQd is a broker, it is created with New and run with Start (and Stop)
 type NSQd struct {
 	sync.RWMutex
-	options         *nsqdOptions
+	options         *Options
 	workerId        int64
 	topicMap        map[string]*Topic
 	lookupdTCPAddrs util.StringArray
@@ -33,66 +32,142 @@ type NSQd struct {
 	exitChan        chan int
 	waitGroup       util.WaitGroupWrapper
 	lookupPeers     []*nsq.LookupPeer
-}
+	forwarders      map[string]*Forwarder
+	verbose         int32
+	configReloader  ConfigReloader
 
-type nsqdOptions struct {
-	memQueueSize    int64
-	dataPath        string
-	maxBytesPerFile int64
-	syncEvery       int64
-	msgTimeout      time.Duration
-	clientTimeout   time.Duration
-}
+	lookupdChangeChan chan int
+	statsdChangeChan  chan int
 
-func NewNsqdOptions() *nsqdOptions {
-	return &nsqdOptions{
-		memQueueSize:    10000,
-		dataPath:        os.TempDir(),
-		maxBytesPerFile: 104857600,
-		syncEvery:       2500,
-		msgTimeout:      60 * time.Second,
-		clientTimeout:   nsq.DefaultClientTimeout,
-	}
+	// changes that lookupLoop propagates to the lookupd peers
+	channelChangeChan    chan *Channel
+	topicChangeChan      chan *Topic
+	topicPauseChangeChan chan *Topic
 }
 
-func NewNSQd(workerId int64, options *nsqdOptions) *NSQd {
+// New creates an NSQd (a copy of opts is taken)
+func New(opts *Options) *NSQd {
+	options := *opts
+	options.LookupdTCPAddresses = append([]string{}, opts.LookupdTCPAddresses...)
+
 	n := &NSQd{
-		workerId: workerId,
-		options:  options,
-		topicMap: make(map[string]*Topic),
-		idChan:   make(chan nsq.MessageID, 4096),
-		exitChan: make(chan int),
+		workerId:        options.WorkerId,
+		options:         &options,
+		topicMap:        make(map[string]*Topic),
+		forwarders:      make(map[string]*Forwarder),
+		lookupdTCPAddrs: options.LookupdTCPAddresses,
+		idChan:          make(chan nsq.MessageID, 4096),
+		exitChan:        make(chan int),
+		// these have a buffer of 1 so that changes can be signaled without
+		// blocking (and before the loops receiving them have started)
+		lookupdChangeChan:    make(chan int, 1),
+		statsdChangeChan:     make(chan int, 1),
+		channelChangeChan:    make(chan *Channel),
+		topicChangeChan:      make(chan *Topic),
+		topicPauseChangeChan: make(chan *Topic),
 	}
+	n.setVerbose(options.Verbose)
 
 	n.waitGroup.Wrap(func() { n.idPump() })
 
 	return n
 }
 
-func (n *NSQd) Main() {
-	n.waitGroup.Wrap(func() { n.lookupLoop() })
+// Start listens for TCP and HTTP clients and starts registering with lookupd
+// (call LoadMetadata first to restore the topics/channels of a previous run)
+func (n *NSQd) Start() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname - %s", err.Error())
+	}
 
-	tcpListener, err := net.Listen("tcp", n.tcpAddr.String())
+	tcpAddr, err := net.ResolveTCPAddr("tcp", n.options.TCPAddress)
 	if err != nil {
-		log.Fatalf("FATAL: listen (%s) failed - %s", n.tcpAddr, err.Error())
+		return err
+	}
+
+	httpAddr, err := net.ResolveTCPAddr("tcp", n.options.HTTPAddress)
+	if err != nil {
+		return err
+	}
+
+	tcpListener, err := net.Listen("tcp", tcpAddr.String())
+	if err != nil {
+		return fmt.Errorf("listen (%s) failed - %s", tcpAddr, err.Error())
 	}
-	n.tcpListener = tcpListener
-	n.waitGroup.Wrap(func() { util.TcpServer(n.tcpListener, &TcpProtocol{protocols: protocols}) })
 
-	httpListener, err := net.Listen("tcp", n.httpAddr.String())
+	httpListener, err := net.Listen("tcp", httpAddr.String())
 	if err != nil {
-		log.Fatalf("FATAL: listen (%s) failed - %s", n.httpAddr, err.Error())
+		tcpListener.Close()
+		return fmt.Errorf("listen (%s) failed - %s", httpAddr, err.Error())
 	}
+
+	n.Lock()
+	n.tcpListener = tcpListener
+	n.tcpAddr = tcpListener.Addr().(*net.TCPAddr)
 	n.httpListener = httpListener
-	n.waitGroup.Wrap(func() { httpServer(n.httpListener) })
+	n.httpAddr = httpListener.Addr().(*net.TCPAddr)
+	n.Unlock()
+
+	n.waitGroup.Wrap(func() { n.lookupLoop(hostname) })
+	n.waitGroup.Wrap(func() { n.statsdLoop() })
+
+	protocols := map[int32]nsq.Protocol{protocolV2Magic: &ProtocolV2{context: n}}
+	n.waitGroup.Wrap(func() { util.TcpServer(tcpListener, &TcpProtocol{protocols: protocols}) })
+	n.waitGroup.Wrap(func() { serveHttp(n, httpListener) })
+
+	return nil
+}
+
+// TCPAddr returns the address listening for TCP clients (nil until started)
+func (n *NSQd) TCPAddr() *net.TCPAddr {
+	n.RLock()
+	defer n.RUnlock()
+	return n.tcpAddr
+}
+
+// HTTPAddr returns the address listening for HTTP clients (nil until started)
+func (n *NSQd) HTTPAddr() *net.TCPAddr {
+	n.RLock()
+	defer n.RUnlock()
+	return n.httpAddr
+}
+
+// notifyChannelChange, notifyTopicChange and notifyTopicPauseChange post a
+// change to lookupLoop asynchronously (the caller may hold locks lookupLoop needs)
+func (n *NSQd) notifyChannelChange(c *Channel) {
+	go func() {
+		select {
+		case n.channelChangeChan <- c:
+		case <-n.exitChan:
+		}
+	}()
+}
+
+func (n *NSQd) notifyTopicChange(t *Topic) {
+	go func() {
+		select {
+		case n.topicChangeChan <- t:
+		case <-n.exitChan:
+		}
+	}()
+}
+
+func (n *NSQd) notifyTopicPauseChange(t *Topic) {
+	go func() {
+		select {
+		case n.topicPauseChangeChan <- t:
+		case <-n.exitChan:
+		}
+	}()
 }
 
 func (n *NSQd) LoadMetadata() {
-	fn := fmt.Sprintf(path.Join(n.options.dataPath, "nsqd.%d.dat"), n.workerId)
+	fn := fmt.Sprintf(path.Join(n.options.DataPath, "nsqd.%d.dat"), n.workerId)
 	data, err := ioutil.ReadFile(fn)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			log.Printf("ERROR: failed to read channel metadata from %s - %s", fn, err.Error())
+			n.log().Errorf("failed to read channel metadata from %s - %s", fn, err.Error())
 		}
 		return
 	}
@@ -103,13 +178,13 @@ func (n *NSQd) LoadMetadata() {
 	if data[0] == '{' {
 		js, err := simplejson.NewJson(data)
 		if err != nil {
-			log.Printf("ERROR: failed to parse metadata - %s", err.Error())
+			n.log().Errorf("failed to parse metadata - %s", err.Error())
 			return
 		}
 
 		topics, err := js.Get("topics").Array()
 		if err != nil {
-			log.Printf("ERROR: failed to parse metadata - %s", err.Error())
+			n.log().Errorf("failed to parse metadata - %s", err.Error())
 			return
 		}
 
@@ -118,18 +193,32 @@ func (n *NSQd) LoadMetadata() {
 
 			topicName, err := topicJs.Get("name").String()
 			if err != nil {
-				log.Printf("ERROR: failed to parse metadata - %s", err.Error())
+				n.log().Errorf("failed to parse metadata - %s", err.Error())
 				return
 			}
 			if !nsq.IsValidTopicName(topicName) {
-				log.Printf("WARNING: skipping creation of invalid topic %s", topicName)
+				n.log().Warnf("skipping creation of invalid topic %s", topicName)
 				continue
 			}
 			topic := n.GetTopic(topicName)
 
+			paused, _ := topicJs.Get("paused").Bool()
+			if paused {
+				topic.Pause()
+			}
+
+			retentionMs, _ := topicJs.Get("retention_ms").Int64()
+			retentionBytes, _ := topicJs.Get("retention_bytes").Int64()
+			if retentionMs > 0 || retentionBytes > 0 {
+				err := topic.SetRetention(time.Duration(retentionMs)*time.Millisecond, retentionBytes)
+				if err != nil {
+					n.log().Errorf("failed to enable retention for topic %s - %s", topicName, err.Error())
+				}
+			}
+
 			channels, err := topicJs.Get("channels").Array()
 			if err != nil {
-				log.Printf("ERROR: failed to parse metadata - %s", err.Error())
+				n.log().Errorf("failed to parse metadata - %s", err.Error())
 				return
 			}
 
@@ -138,14 +227,26 @@ func (n *NSQd) LoadMetadata() {
 
 				channelName, err := channelJs.Get("name").String()
 				if err != nil {
-					log.Printf("ERROR: failed to parse metadata - %s", err.Error())
+					n.log().Errorf("failed to parse metadata - %s", err.Error())
 					return
 				}
 				if !nsq.IsValidChannelName(channelName) {
-					log.Printf("WARNING: skipping creation of invalid channel %s", channelName)
+					n.log().Warnf("skipping creation of invalid channel %s", channelName)
 					continue
 				}
-				channel := topic.GetChannel(channelName)
+				var channel *Channel
+				filterExpr, _ := channelJs.Get("filter").String()
+				if filterExpr != "" {
+					filter, err := NewMessageFilter(filterExpr)
+					if err != nil {
+						n.log().Warnf("skipping creation of channel %s with invalid filter %s - %s",
+							channelName, filterExpr, err.Error())
+						continue
+					}
+					channel = topic.GetFilteredChannel(channelName, filter)
+				} else {
+					channel = topic.GetChannel(channelName)
+				}
 
 				paused, _ := channelJs.Get("paused").Bool()
 				if paused {
@@ -153,6 +254,21 @@ func (n *NSQd) LoadMetadata() {
 				}
 			}
 		}
+
+		forwarders, _ := js.Get("forwarders").Array()
+		for fi, _ := range forwarders {
+			forwarderJs := js.Get("forwarders").GetIndex(fi)
+
+			name, _ := forwarderJs.Get("name").String()
+			source, _ := forwarderJs.Get("source").String()
+			destination, _ := forwarderJs.Get("destination").String()
+			address, _ := forwarderJs.Get("address").String()
+			maxInFlight, _ := forwarderJs.Get("max_in_flight").Int64()
+			_, err := n.CreateForwarder(name, source, destination, address, maxInFlight)
+			if err != nil {
+				n.log().Warnf("skipping creation of forwarder %s - %s", name, err.Error())
+			}
+		}
 	} else {
 		// TODO: remove this in the next release
 		// old line oriented, : separated, format
@@ -161,7 +277,7 @@ func (n *NSQd) LoadMetadata() {
 				parts := strings.SplitN(line, ":", 2)
 
 				if !nsq.IsValidTopicName(parts[0]) {
-					log.Printf("WARNING: skipping creation of invalid topic %s", parts[0])
+					n.log().Warnf("skipping creation of invalid topic %s", parts[0])
 					continue
 				}
 				topic := n.GetTopic(parts[0])
@@ -170,7 +286,7 @@ func (n *NSQd) LoadMetadata() {
 					continue
 				}
 				if !nsq.IsValidChannelName(parts[1]) {
-					log.Printf("WARNING: skipping creation of invalid channel %s", parts[1])
+					n.log().Warnf("skipping creation of invalid channel %s", parts[1])
 					continue
 				}
 				topic.GetChannel(parts[1])
@@ -182,22 +298,34 @@ func (n *NSQd) LoadMetadata() {
 func (n *NSQd) PersistMetadata() {
 	// persist metadata about what topics/channels we have
 	// so that upon restart we can get back to the same state
-	fileName := fmt.Sprintf(path.Join(n.options.dataPath, "nsqd.%d.dat"), n.workerId)
-	log.Printf("NSQ: persisting topic/channel metadata to %s", fileName)
+	fileName := fmt.Sprintf(path.Join(n.options.DataPath, "nsqd.%d.dat"), n.workerId)
+	n.log().Infof("persisting topic/channel metadata to %s", fileName)
 
 	js := make(map[string]interface{})
 	topics := make([]interface{}, 0)
 	for _, topic := range n.topicMap {
+		if topic.ephemeralTopic {
+			continue
+		}
 		topicData := make(map[string]interface{})
 		topicData["name"] = topic.name
+		topicData["paused"] = topic.IsPaused()
 		channels := make([]interface{}, 0)
 		topic.Lock()
+		if topic.retention != nil {
+			maxAge, maxBytes := topic.retention.Limits()
+			topicData["retention_ms"] = int64(maxAge / time.Millisecond)
+			topicData["retention_bytes"] = maxBytes
+		}
 		for _, channel := range topic.channelMap {
 			channel.Lock()
 			if !channel.ephemeralChannel {
 				channelData := make(map[string]interface{})
 				channelData["name"] = channel.name
 				channelData["paused"] = channel.IsPaused()
+				if filter := channel.Filter(); filter != nil {
+					channelData["filter"] = filter.String()
+				}
 				channels = append(channels, channelData)
 			}
 			channel.Unlock()
@@ -206,25 +334,36 @@ func (n *NSQd) PersistMetadata() {
 		topicData["channels"] = channels
 		topics = append(topics, topicData)
 	}
+	forwarders := make([]interface{}, 0)
+	for _, forwarder := range n.forwarders {
+		forwarderData := make(map[string]interface{})
+		forwarderData["name"] = forwarder.name
+		forwarderData["source"] = forwarder.source
+		forwarderData["destination"] = forwarder.destination
+		forwarderData["address"] = forwarder.address
+		forwarderData["max_in_flight"] = forwarder.maxInFlight
+		forwarders = append(forwarders, forwarderData)
+	}
 	js["version"] = util.BINARY_VERSION
 	js["topics"] = topics
+	js["forwarders"] = forwarders
 
 	data, err := json.Marshal(&js)
 	if err != nil {
-		log.Printf("ERROR: failed to marshal JSON metadata - %s", err.Error())
+		n.log().Errorf("failed to marshal JSON metadata - %s", err.Error())
 		return
 	}
 
 	tmpFileName := fileName + ".tmp"
 	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Printf("ERROR: failed to open temporary metadata file %s - %s", tmpFileName, err.Error())
+		n.log().Errorf("failed to open temporary metadata file %s - %s", tmpFileName, err.Error())
 		return
 	}
 
 	_, err = f.Write(data)
 	if err != nil {
-		log.Printf("ERROR: failed to write to temporary metadata file %s - %s", tmpFileName, err.Error())
+		n.log().Errorf("failed to write to temporary metadata file %s - %s", tmpFileName, err.Error())
 		f.Close()
 		return
 	}
@@ -233,11 +372,12 @@ func (n *NSQd) PersistMetadata() {
 
 	err = os.Rename(tmpFileName, fileName)
 	if err != nil {
-		log.Printf("ERROR: failed to rename temporary metadata file %s to %s - %s", tmpFileName, fileName, err.Error())
+		n.log().Errorf("failed to rename temporary metadata file %s to %s - %s", tmpFileName, fileName, err.Error())
 	}
 }
 
-func (n *NSQd) Exit() {
+// Stop closes the listeners, persists metadata and closes all topics
+func (n *NSQd) Stop() {
 	if n.tcpListener != nil {
 		n.tcpListener.Close()
 	}
@@ -248,7 +388,20 @@ func (n *NSQd) Exit() {
 
 	n.Lock()
 	n.PersistMetadata()
-	log.Printf("NSQ: closing topics")
+	forwarders := make([]*Forwarder, 0, len(n.forwarders))
+	for _, forwarder := range n.forwarders {
+		forwarders = append(forwarders, forwarder)
+	}
+	n.Unlock()
+
+	// forwarders publish to (local) topics so they must be stopped
+	// first (and without holding the lock)
+	for _, forwarder := range forwarders {
+		forwarder.Stop()
+	}
+
+	n.Lock()
+	n.log().Infof("closing topics")
 	for _, topic := range n.topicMap {
 		topic.Close()
 	}
@@ -269,19 +422,23 @@ func (n *NSQd) GetTopic(topicName string) *Topic {
 		n.Unlock()
 		return t
 	} else {
-		t = NewTopic(topicName, n.options)
+		deleteCallback := func(t *Topic) {
+			n.deleteUnusedTopic(t)
+		}
+		t = NewTopic(topicName, n, deleteCallback)
 		n.topicMap[topicName] = t
-		log.Printf("TOPIC(%s): created", t.name)
+		t.log().Infof("created topic")
 
 		// release our global nsqd lock, and switch to a more granular topic lock while we init our
 		// channels from lookupd. This blocks concurrent PutMessages to this topic.
 		t.Lock()
 		defer t.Unlock()
+		lookupHttpAddrs := n.lookupHttpAddrs()
 		n.Unlock()
 		// if using lookupd, make a blocking call to get the topics, and immediately create them.
 		// this makes sure that any message received is buffered to the right channels
-		if len(n.lookupPeers) > 0 {
-			channelNames, _ := util.GetChannelsForTopic(t.name, n.lookupHttpAddrs())
+		if len(lookupHttpAddrs) > 0 {
+			channelNames, _ := util.GetChannelsForTopic(t.name, lookupHttpAddrs)
 			for _, channelName := range channelNames {
 				t.getOrCreateChannel(channelName)
 			}
@@ -313,7 +470,7 @@ func (n *NSQd) DeleteExistingTopic(topicName string) error {
 	// not defered so that we can continue while the topic async closes
 	n.Unlock()
 
-	log.Printf("TOPIC(%s): deleting", topic.name)
+	topic.log().Infof("deleting topic")
 
 	// delete empties all channels and the topic itself before closing
 	// (so that we dont leave any messages around)
@@ -321,20 +478,158 @@ func (n *NSQd) DeleteExistingTopic(topicName string) error {
 
 	// since we are explicitly deleting a topic (not just at system exit time)
 	// de-register this from the lookupd
-	go notify.Post("topic_change", topic)
+	n.notifyTopicChange(topic)
+
+	return nil
+}
+
+// deleteUnusedTopic deletes an ephemeral topic marked as deleting (see
+// Topic.deleteIfUnused) unless it was unmarked (or replaced) in the meantime
+func (n *NSQd) deleteUnusedTopic(t *Topic) {
+	n.Lock()
+	t.Lock()
+	unused := t.deleting && n.topicMap[t.name] == t
+	if unused {
+		delete(n.topicMap, t.name)
+	}
+	t.Unlock()
+	n.Unlock()
+	if !unused {
+		return
+	}
+
+	t.log().Infof("deleting topic")
+
+	t.Delete()
+
+	n.notifyTopicChange(t)
+}
+
+// CreateForwarder creates a Forwarder that consumes the source topic (via a
+// channel of the same name) and publishes to the destination topic on this
+// nsqd (address "") or the remote nsqd at the TCP address
+func (n *NSQd) CreateForwarder(name string, source string, destination string, address string,
+	maxInFlight int64) (*Forwarder, error) {
+	if !nsq.IsValidChannelName(name) || strings.HasSuffix(name, "#ephemeral") {
+		return nil, errors.New("invalid forwarder name")
+	}
+	if !nsq.IsValidTopicName(source) {
+		return nil, errors.New("invalid source topic")
+	}
+	if !nsq.IsValidTopicName(destination) || (address == "" && destination == source) {
+		return nil, errors.New("invalid destination topic")
+	}
+	if maxInFlight <= 0 || maxInFlight > nsq.MaxReadyCount {
+		return nil, errors.New("invalid max in-flight")
+	}
+
+	n.RLock()
+	err := n.checkNewForwarder(name, source, destination, address)
+	n.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	channel := n.GetTopic(source).GetChannel(name)
+
+	n.Lock()
+	defer n.Unlock()
+	err = n.checkNewForwarder(name, source, destination, address)
+	if err != nil {
+		return nil, err
+	}
+	deleteCallback := func(f *Forwarder) {
+		n.removeForwarder(f)
+	}
+	forwarder := NewForwarder(name, source, destination, address, maxInFlight, n, channel, deleteCallback)
+	n.forwarders[name] = forwarder
+	forwarder.log().Infof("created forwarder")
+
+	return forwarder, nil
+}
+
+// checkNewForwarder returns an error if the forwarder already exists or if it would
+// forward messages back to its source topic (via other forwarders on this nsqd),
+// this expects the caller to handle locking
+func (n *NSQd) checkNewForwarder(name string, source string, destination string, address string) error {
+	_, ok := n.forwarders[name]
+	if ok {
+		return errors.New("forwarder already exists")
+	}
+	if address == "" && n.forwardsTo(destination, source) {
+		return errors.New("forwarder would create a cycle")
+	}
+	return nil
+}
+
+// forwardsTo returns true if messages published to the topic from reach the topic to
+// via forwarders on this nsqd, this expects the caller to handle locking
+func (n *NSQd) forwardsTo(from string, to string) bool {
+	visited := make(map[string]bool)
+	pending := []string{from}
+	for len(pending) > 0 {
+		topicName := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if topicName == to {
+			return true
+		}
+		if visited[topicName] {
+			continue
+		}
+		visited[topicName] = true
+		for _, forwarder := range n.forwarders {
+			if forwarder.address == "" && forwarder.source == topicName {
+				pending = append(pending, forwarder.destination)
+			}
+		}
+	}
+	return false
+}
+
+// removeForwarder removes (and stops) a Forwarder that was closed by its channel,
+// ie. its source topic or channel was deleted
+func (n *NSQd) removeForwarder(forwarder *Forwarder) {
+	n.Lock()
+	if n.forwarders[forwarder.name] == forwarder {
+		delete(n.forwarders, forwarder.name)
+	}
+	n.Unlock()
+
+	forwarder.log().Infof("source channel closed, removing forwarder")
+	forwarder.Stop()
+}
+
+// DeleteExistingForwarder stops a Forwarder and deletes its channel
+func (n *NSQd) DeleteExistingForwarder(name string) error {
+	n.Lock()
+	forwarder, ok := n.forwarders[name]
+	if !ok {
+		n.Unlock()
+		return errors.New("forwarder does not exist")
+	}
+	delete(n.forwarders, name)
+	n.Unlock()
+
+	forwarder.Stop()
+
+	topic, err := n.GetExistingTopic(forwarder.source)
+	if err == nil {
+		topic.DeleteExistingChannel(forwarder.name)
+	}
 
 	return nil
 }
 
 func (n *NSQd) idPump() {
+	factory := newGUIDFactory(n.workerId)
 	lastError := time.Now()
 	for {
-		id, err := NewGUID(n.workerId)
+		id, err := factory.NewGUID()
 		if err != nil {
 			now := time.Now()
 			if now.Sub(lastError) > time.Second {
 				// only print the error once/second
-				log.Printf("ERROR: %s", err.Error())
+				n.log().Errorf("failed to generate message id - %s", err.Error())
 				lastError = now
 			}
 			runtime.Gosched()
@@ -348,5 +643,5 @@ func (n *NSQd) idPump() {
 	}
 
 exit:
-	log.Printf("ID: closing")
+	n.log().Infof("closing idPump")
 }
@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 import (
 	"../nsq"
@@ -18,17 +18,17 @@ func TestStartup(t *testing.T) {
 	iterations := 300
 	doneExitChan := make(chan int)
 
-	options := NewNsqdOptions()
-	options.memQueueSize = 100
-	options.maxBytesPerFile = 10240
-	mustStartNSQd(options)
+	options := NewOptions()
+	options.MemQueueSize = 100
+	options.MaxBytesPerFile = 10240
+	_, _, nsqd := mustStartNSQd(options)
 
 	topicName := "nsqd_test" + strconv.Itoa(int(time.Now().Unix()))
 
 	exitChan := make(chan int)
 	go func() {
 		<-exitChan
-		nsqd.Exit()
+		nsqd.Stop()
 		doneExitChan <- 1
 	}()
 
@@ -61,14 +61,14 @@ func TestStartup(t *testing.T) {
 
 	// start up a new nsqd w/ the same folder
 
-	options = NewNsqdOptions()
-	options.memQueueSize = 100
-	options.maxBytesPerFile = 10240
-	mustStartNSQd(options)
+	options = NewOptions()
+	options.MemQueueSize = 100
+	options.MaxBytesPerFile = 10240
+	_, _, nsqd = mustStartNSQd(options)
 
 	go func() {
 		<-exitChan
-		nsqd.Exit()
+		nsqd.Stop()
 		doneExitChan <- 1
 	}()
 
@@ -103,9 +103,9 @@ func TestEphemeralChannel(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
-	options.memQueueSize = 100
-	mustStartNSQd(options)
+	options := NewOptions()
+	options.MemQueueSize = 100
+	_, _, nsqd := mustStartNSQd(options)
 
 	topicName := "ephemeral_test" + strconv.Itoa(int(time.Now().Unix()))
 	doneExitChan := make(chan int)
@@ -113,7 +113,7 @@ func TestEphemeralChannel(t *testing.T) {
 	exitChan := make(chan int)
 	go func() {
 		<-exitChan
-		nsqd.Exit()
+		nsqd.Stop()
 		doneExitChan <- 1
 	}()
 
@@ -135,3 +135,54 @@ func TestEphemeralChannel(t *testing.T) {
 	exitChan <- 1
 	<-doneExitChan
 }
+
+func TestMultipleInstances(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	_, httpAddr1, nsqd1 := mustStartNSQd(NewOptions())
+	defer nsqd1.Stop()
+	options := NewOptions()
+	options.WorkerId = 1
+	_, httpAddr2, nsqd2 := mustStartNSQd(options)
+	defer nsqd2.Stop()
+
+	assert.NotEqual(t, httpAddr1.Port, httpAddr2.Port)
+
+	topicName := "multiple_test" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd1.GetTopic(topicName)
+
+	_, err := nsqd1.GetExistingTopic(topicName)
+	assert.Equal(t, err, nil)
+	_, err = nsqd2.GetExistingTopic(topicName)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestRuntimeOptions(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	// the options are read while they are changed at runtime
+	doneChan := make(chan int)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			opts := nsqd.GetOptions()
+			opts.MemQueueSize = int64(i)
+			opts.MsgTimeout = time.Duration(i) * time.Millisecond
+			nsqd.SetRuntimeOptions(opts)
+		}
+		close(doneChan)
+	}()
+	for i := 0; i < 100; i++ {
+		opts := nsqd.GetOptions()
+		assert.Equal(t, opts.DataPath, os.TempDir())
+	}
+	<-doneChan
+
+	opts := nsqd.GetOptions()
+	assert.Equal(t, opts.MemQueueSize, int64(100))
+	assert.Equal(t, opts.MsgTimeout, 100*time.Millisecond)
+}
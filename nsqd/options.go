@@ -0,0 +1,84 @@
+package nsqd
+
+import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Options configures an NSQd, see NewOptions for the defaults
+type Options struct {
+	// <addr>:<port> to listen on for TCP/HTTP clients (use port 0 for a
+	// random port, see NSQd.TCPAddr and NSQd.HTTPAddr for the bound address)
+	TCPAddress  string
+	HTTPAddress string
+
+	// lookupd TCP addresses to register with
+	LookupdTCPAddresses []string
+
+	// unique identifier for this worker (part of message IDs and the metadata file name),
+	// instances in the same process or sharing a DataPath need distinct WorkerIds
+	WorkerId int64
+
+	// path to store disk-backed messages and metadata
+	DataPath string
+
+	// the following options can be changed at runtime (see NSQd.SetRuntimeOptions),
+	// changes to the queue limits only apply to topics/channels created afterwards
+	MemQueueSize    int64
+	MaxBytesPerFile int64
+	SyncEvery       int64
+	MsgTimeout      time.Duration
+	ClientTimeout   time.Duration
+	Verbose         bool
+
+	// how long (and how many, per topic) dedup keys supplied at publish time are
+	// remembered for, a message whose key was seen within the window is
+	// acknowledged but not enqueued (a DedupWindow of 0 disables dedup)
+	DedupWindow  time.Duration
+	DedupMaxKeys int
+
+	// the maximum size of a message (an HPUB body, including its headers) and of a
+	// request body in the binary and JSON batch modes of /mput
+	MaxMsgSize  int64
+	MaxBodySize int64
+
+	// UDP <addr>:<port> of a statsd daemon ("" to disable) and the interval
+	// between pushing stats, the prefix defaults to "nsq.<hostname>_<http port>."
+	StatsdAddress  string
+	StatsdInterval time.Duration
+	StatsdPrefix   string
+}
+
+// NewOptions returns the default Options
+func NewOptions() *Options {
+	return &Options{
+		TCPAddress:      "0.0.0.0:4150",
+		HTTPAddress:     "0.0.0.0:4151",
+		DataPath:        os.TempDir(),
+		MemQueueSize:    10000,
+		MaxBytesPerFile: 104857600,
+		SyncEvery:       2500,
+		MsgTimeout:      nsq.DefaultMsgTimeout,
+		ClientTimeout:   nsq.DefaultClientTimeout,
+		DedupWindow:     5 * time.Minute,
+		DedupMaxKeys:    100000,
+		MaxMsgSize:      1048576,
+		MaxBodySize:     5242880,
+		StatsdInterval:  30 * time.Second,
+	}
+}
+
+// getQueueOptions returns the MemQueueSize, MaxBytesPerFile and SyncEvery
+// options (which can be changed at runtime)
+func (o *Options) getQueueOptions() (int64, int64, int64) {
+	return atomic.LoadInt64(&o.MemQueueSize),
+		atomic.LoadInt64(&o.MaxBytesPerFile),
+		atomic.LoadInt64(&o.SyncEvery)
+}
+
+// getMsgTimeout returns the MsgTimeout option (which can be changed at runtime)
+func (o *Options) getMsgTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&o.MsgTimeout)))
+}
@@ -0,0 +1,87 @@
+package nsqd
+
+import (
+	"fmt"
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"github.com/lhzd863/nsq-0.2.16/util/pqueue"
+)
+
+// Channel priority levels, lower values are delivered first
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+// the number of consecutive higher priority messages a Channel will deliver
+// while a lower priority level has messages waiting before giving it a turn
+const priorityStarvationLimit = 16
+
+// parsePriority returns the priority level for the given name ("" is normal)
+func parsePriority(name string) (int, error) {
+	if name == "" {
+		return priorityNormal, nil
+	}
+	for level, levelName := range priorityNames {
+		if name == levelName {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid priority %s", name)
+}
+
+// messagePriority returns the priority level selected by the message's
+// nsq.PriorityHeader (invalid values are treated as normal)
+func messagePriority(msg *nsq.Message) int {
+	level, err := parsePriority(msg.Headers[nsq.PriorityHeader])
+	if err != nil {
+		return priorityNormal
+	}
+	return level
+}
+
+// setMessagePriority selects the priority level for a message being published
+func setMessagePriority(msg *nsq.Message, name string) error {
+	level, err := parsePriority(name)
+	if err != nil {
+		return err
+	}
+	if level == priorityNormal {
+		return nil
+	}
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string)
+	}
+	msg.Headers[nsq.PriorityHeader] = priorityNames[level]
+	return nil
+}
+
+// priorityQueue is the memory/backend pair for a single priority level
+// of a Channel (and implements the Queue interface)
+type priorityQueue struct {
+	memoryMsgChan chan *nsq.Message
+	backend       BackendQueue
+}
+
+func (q *priorityQueue) MemoryChan() chan *nsq.Message {
+	return q.memoryMsgChan
+}
+
+func (q *priorityQueue) BackendQueue() BackendQueue {
+	return q.backend
+}
+
+func (q *priorityQueue) InFlight() map[nsq.MessageID]*pqueue.Item {
+	return nil
+}
+
+func (q *priorityQueue) Deferred() map[nsq.MessageID]*pqueue.Item {
+	return nil
+}
+
+func (q *priorityQueue) Depth() int64 {
+	return int64(len(q.memoryMsgChan)) + q.backend.Depth()
+}
@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync/atomic"
 	"time"
@@ -16,27 +15,23 @@ import (
 
 const maxTimeout = time.Hour
 
+// BigEndian client byte sequence "  V2"
+var protocolV2Magic = int32(binary.BigEndian.Uint32(nsq.MagicV2))
+
 type ProtocolV2 struct {
 	nsq.Protocol
-}
-
-func init() {
-	// BigEndian client byte sequence "  V2"
-	var magicInt int32
-	buf := bytes.NewBuffer([]byte(nsq.MagicV2))
-	binary.Read(buf, binary.BigEndian, &magicInt)
-	protocols[magicInt] = &ProtocolV2{}
+	context *NSQd
 }
 
 func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 	var err error
 	var line []byte
 
-	client := NewClientV2(conn)
+	client := NewClientV2(p.context, conn)
 	atomic.StoreInt32(&client.State, nsq.StateInit)
 
 	for {
-		client.SetReadDeadline(time.Now().Add(nsqd.options.clientTimeout))
+		client.SetReadDeadline(time.Now().Add(p.context.options.ClientTimeout))
 		// ReadSlice does not allocate new space for the data each request
 		// ie. the returned slice is only valid until the next call to it
 		line, err = client.Reader.ReadSlice('\n')
@@ -52,13 +47,11 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 		}
 		params := bytes.Split(line, []byte(" "))
 
-		if *verbose {
-			log.Printf("PROTOCOL(V2): [%s] %s", client, params[0])
-		}
+		client.log().Debugf("received %s", params[0])
 
 		response, err := p.Exec(client, params)
 		if err != nil {
-			log.Printf("ERROR: CLIENT(%s) - %s", client, err.(*nsq.ClientErr).Description())
+			client.log().Errorf("%s", err.(*nsq.ClientErr).Description())
 			err = p.Send(client, nsq.FrameTypeError, []byte(err.Error()))
 			if err != nil {
 				break
@@ -74,7 +67,7 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 		}
 	}
 
-	log.Printf("PROTOCOL(V2): [%s] exiting ioloop", client)
+	client.log().Infof("exiting ioloop")
 	// TODO: gracefully send clients the close signal
 	conn.Close()
 	close(client.ExitChan)
@@ -83,13 +76,16 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 }
 
 func (p *ProtocolV2) SendMessage(client *ClientV2, msg *nsq.Message, buf *bytes.Buffer) error {
-	if *verbose {
-		log.Printf("PROTOCOL(V2): writing msg(%s) to client(%s) - %s",
-			msg.Id, client, msg.Body)
-	}
+	client.log().Debugf("writing msg(%s) - %s", msg.Id, msg.Body)
 
 	buf.Reset()
-	err := msg.Write(buf)
+	var err error
+	if client.MessageHeaders {
+		err = msg.Write(buf)
+	} else {
+		// clients that have not opted in receive the original format (without headers)
+		err = msg.WriteFormat(buf, nsq.MsgFormatV1)
+	}
 	if err != nil {
 		return err
 	}
@@ -154,6 +150,8 @@ func (p *ProtocolV2) Exec(client *ClientV2, params [][]byte) ([]byte, error) {
 		return p.PUB(client, params)
 	case bytes.Equal(params[0], []byte("MPUB")):
 		return p.MPUB(client, params)
+	case bytes.Equal(params[0], []byte("HPUB")):
+		return p.HPUB(client, params)
 	}
 	return nil, nsq.NewClientErr("E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -174,7 +172,7 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 	// the pathological case of a channel on a low volume topic
 	// with >1 clients having >1 RDY counts
 	flusher := time.NewTicker(5 * time.Millisecond)
-	heartbeat := time.NewTicker(nsqd.options.clientTimeout / 2)
+	heartbeat := time.NewTicker(p.context.options.ClientTimeout / 2)
 	flushed := true
 
 	for {
@@ -214,7 +212,7 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 		case <-heartbeat.C:
 			err = p.Send(client, nsq.FrameTypeResponse, []byte("_heartbeat_"))
 			if err != nil {
-				log.Printf("PROTOCOL(V2): error sending heartbeat - %s", err.Error())
+				client.log().Errorf("error sending heartbeat - %s", err.Error())
 			}
 		case msg, ok := <-clientMsgChan:
 			if !ok {
@@ -232,12 +230,12 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 	}
 
 exit:
-	log.Printf("PROTOCOL(V2): [%s] exiting messagePump", client)
+	client.log().Infof("exiting messagePump")
 	heartbeat.Stop()
 	flusher.Stop()
 	client.Channel.RemoveClient(client)
 	if err != nil {
-		log.Printf("PROTOCOL(V2): messagePump error - %s", err.Error())
+		client.log().Errorf("messagePump error - %s", err.Error())
 	}
 }
 
@@ -262,8 +260,11 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 
 	// body is a json structure with producer information
 	clientInfo := struct {
-		ShortId string `json:"short_id"`
-		LongId  string `json:"long_id"`
+		ShortId            string `json:"short_id"`
+		LongId             string `json:"long_id"`
+		UserAgent          string `json:"user_agent"`
+		MessageHeaders     bool   `json:"message_headers"`
+		FeatureNegotiation bool   `json:"feature_negotiation"`
 	}{}
 	err = json.Unmarshal(body, &clientInfo)
 	if err != nil {
@@ -272,8 +273,32 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 
 	client.ShortIdentifier = clientInfo.ShortId
 	client.LongIdentifier = clientInfo.LongId
+	client.UserAgent = clientInfo.UserAgent
+	client.MessageHeaders = clientInfo.MessageHeaders
 
-	return nil, nil
+	// older clients do not expect a response
+	if !clientInfo.FeatureNegotiation {
+		return nil, nil
+	}
+
+	resp, err := json.Marshal(struct {
+		MaxRdyCount       int64  `json:"max_rdy_count"`
+		Version           string `json:"version"`
+		HeartbeatInterval int64  `json:"heartbeat_interval"`
+		MsgTimeout        int64  `json:"msg_timeout"`
+		MessageHeaders    bool   `json:"message_headers"`
+	}{
+		MaxRdyCount:       nsq.MaxReadyCount,
+		Version:           util.BINARY_VERSION,
+		HeartbeatInterval: int64(p.context.options.ClientTimeout / 2 / time.Millisecond),
+		MsgTimeout:        int64(p.context.options.getMsgTimeout() / time.Millisecond),
+		MessageHeaders:    client.MessageHeaders,
+	})
+	if err != nil {
+		return nil, nsq.NewClientErr("E_INVALID", err.Error())
+	}
+
+	return resp, nil
 }
 
 func (p *ProtocolV2) SUB(client *ClientV2, params [][]byte) ([]byte, error) {
@@ -301,7 +326,7 @@ func (p *ProtocolV2) SUB(client *ClientV2, params [][]byte) ([]byte, error) {
 		client.LongIdentifier = string(params[4])
 	}
 
-	topic := nsqd.GetTopic(topicName)
+	topic := p.context.GetTopic(topicName)
 	channel := topic.GetChannel(channelName)
 	channel.AddClient(client)
 
@@ -318,7 +343,7 @@ func (p *ProtocolV2) RDY(client *ClientV2, params [][]byte) ([]byte, error) {
 
 	if state == nsq.StateClosing {
 		// just ignore ready changes on a closing channel
-		log.Printf("PROTOCOL(V2): ignoring RDY after CLS in state ClientStateV2Closing")
+		client.log().Infof("ignoring RDY after CLS in state ClientStateV2Closing")
 		return nil, nil
 	}
 
@@ -336,10 +361,10 @@ func (p *ProtocolV2) RDY(client *ClientV2, params [][]byte) ([]byte, error) {
 	}
 
 	if count < 0 {
-		log.Printf("ERROR: client(%s) sent invalid ready count %d < 0", client, count)
+		client.log().Errorf("sent invalid ready count %d < 0", count)
 		count = 0
 	} else if count > nsq.MaxReadyCount {
-		log.Printf("ERROR: client(%s) sent invalid ready count %d > %d", client, count, nsq.MaxReadyCount)
+		client.log().Errorf("sent invalid ready count %d > %d", count, nsq.MaxReadyCount)
 		count = nsq.MaxReadyCount
 	}
 
@@ -435,6 +460,14 @@ func (p *ProtocolV2) PUB(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, nsq.NewClientErr("E_BAD_TOPIC", fmt.Sprintf("topic name '%s' is not valid", topicName))
 	}
 
+	var dedupKey string
+	if len(params) > 2 {
+		dedupKey = string(params[2])
+		if !nsq.IsValidDedupKey(dedupKey) {
+			return nil, nsq.NewClientErr("E_BAD_DEDUP_KEY", fmt.Sprintf("dedup key '%s' is not valid", dedupKey))
+		}
+	}
+
 	err = binary.Read(client.Reader, binary.BigEndian, &bodyLen)
 	if err != nil {
 		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
@@ -446,9 +479,9 @@ func (p *ProtocolV2) PUB(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
 	}
 
-	topic := nsqd.GetTopic(topicName)
-	msg := nsq.NewMessage(<-nsqd.idChan, messageBody)
-	err = topic.PutMessage(msg)
+	topic := p.context.GetTopic(topicName)
+	msg := nsq.NewMessage(<-p.context.idChan, messageBody)
+	_, err = topic.PutMessagesDedup(dedupKey, []*nsq.Message{msg})
 	if err != nil {
 		return nil, nsq.NewClientErr("E_PUT_FAILED", err.Error())
 	}
@@ -456,11 +489,9 @@ func (p *ProtocolV2) PUB(client *ClientV2, params [][]byte) ([]byte, error) {
 	return []byte("OK"), nil
 }
 
-func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
+func (p *ProtocolV2) HPUB(client *ClientV2, params [][]byte) ([]byte, error) {
 	var err error
 	var bodyLen int32
-	var numMessages int32
-	var messageSize int32
 
 	if len(params) < 2 {
 		return nil, nsq.NewClientErr("E_MISSING_PARAMS", "insufficient number of parameters")
@@ -475,6 +506,10 @@ func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
 	if err != nil {
 		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
 	}
+	maxMsgSize := p.context.options.MaxMsgSize
+	if bodyLen <= 0 || (maxMsgSize > 0 && int64(bodyLen) > maxMsgSize) {
+		return nil, nsq.NewClientErr("E_BAD_BODY", fmt.Sprintf("invalid body size %d", bodyLen))
+	}
 
 	body := make([]byte, bodyLen)
 	_, err = io.ReadFull(client.Reader, body)
@@ -482,30 +517,92 @@ func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
 	}
 
+	// the body is the header section followed by the (non-empty) message body
 	buf := bytes.NewBuffer(body)
-	err = binary.Read(buf, binary.BigEndian, &numMessages)
+	headers, err := nsq.ReadHeaders(buf)
 	if err != nil {
 		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
 	}
+	if buf.Len() == 0 {
+		return nil, nsq.NewClientErr("E_BAD_BODY", "empty message body")
+	}
 
-	topic := nsqd.GetTopic(topicName)
-	for i := int32(0); i < numMessages; i++ {
-		err = binary.Read(buf, binary.BigEndian, &messageSize)
-		if err != nil {
-			return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
-		}
+	_, err = parsePriority(headers[nsq.PriorityHeader])
+	if err != nil {
+		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
+	}
 
-		msgBody := make([]byte, messageSize)
-		_, err = io.ReadFull(buf, msgBody)
-		if err != nil {
-			return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
+	dedupKey := headers[nsq.DedupKeyHeader]
+	if dedupKey != "" && !nsq.IsValidDedupKey(dedupKey) {
+		return nil, nsq.NewClientErr("E_BAD_DEDUP_KEY", fmt.Sprintf("dedup key '%s' is not valid", dedupKey))
+	}
+
+	topic := p.context.GetTopic(topicName)
+	msg := nsq.NewMessage(<-p.context.idChan, buf.Bytes())
+	if len(headers) > 0 {
+		msg.Headers = headers
+	}
+	_, err = topic.PutMessagesDedup(dedupKey, []*nsq.Message{msg})
+	if err != nil {
+		return nil, nsq.NewClientErr("E_PUT_FAILED", err.Error())
+	}
+
+	return []byte("OK"), nil
+}
+
+func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
+	var err error
+	var bodyLen int32
+
+	if len(params) < 2 {
+		return nil, nsq.NewClientErr("E_MISSING_PARAMS", "insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !nsq.IsValidTopicName(topicName) {
+		return nil, nsq.NewClientErr("E_BAD_TOPIC", fmt.Sprintf("topic name '%s' is not valid", topicName))
+	}
+
+	var dedupKey string
+	if len(params) > 2 {
+		dedupKey = string(params[2])
+		if !nsq.IsValidDedupKey(dedupKey) {
+			return nil, nsq.NewClientErr("E_BAD_DEDUP_KEY", fmt.Sprintf("dedup key '%s' is not valid", dedupKey))
 		}
+	}
 
-		msg := nsq.NewMessage(<-nsqd.idChan, msgBody)
-		err := topic.PutMessage(msg)
-		if err != nil {
-			return nil, nsq.NewClientErr("E_PUT_FAILED", err.Error())
+	err = binary.Read(client.Reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, body)
+	if err != nil {
+		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
+	}
+
+	// the whole batch is decoded before any of it is published, an invalid
+	// message fails the batch (the error detail names its index)
+	bodies, err := decodeMPUB(body, 0)
+	if err != nil {
+		if e, ok := err.(*batchMessageError); ok {
+			return nil, nsq.NewClientErrDetail("E_BAD_BODY", fmt.Sprintf("message %d", e.Index),
+				"MPUB invalid "+e.Error())
 		}
+		return nil, nsq.NewClientErr("E_BAD_BODY", err.Error())
+	}
+
+	messages := make([]*nsq.Message, 0, len(bodies))
+	for _, msgBody := range bodies {
+		messages = append(messages, nsq.NewMessage(<-p.context.idChan, msgBody))
+	}
+
+	// the dedup key covers the whole batch
+	topic := p.context.GetTopic(topicName)
+	_, err = topic.PutMessagesDedup(dedupKey, messages)
+	if err != nil {
+		return nil, nsq.NewClientErr("E_PUT_FAILED", err.Error())
 	}
 
 	return []byte("OK"), nil
@@ -1,9 +1,10 @@
-package main
+package nsqd
 
 import (
 	"../nsq"
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"github.com/bmizerany/assert"
 	"io/ioutil"
 	"log"
@@ -12,19 +13,23 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func mustStartNSQd(options *nsqdOptions) (*net.TCPAddr, *net.TCPAddr) {
-	tcpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	httpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	nsqd = NewNSQd(1, options)
-	nsqd.tcpAddr = tcpAddr
-	nsqd.httpAddr = httpAddr
-	nsqd.Main()
-	return nsqd.tcpListener.Addr().(*net.TCPAddr), nsqd.httpListener.Addr().(*net.TCPAddr)
+func mustStartNSQd(options *Options) (*net.TCPAddr, *net.TCPAddr, *NSQd) {
+	options.TCPAddress = "127.0.0.1:0"
+	options.HTTPAddress = "127.0.0.1:0"
+	options.WorkerId = 1
+	nsqd := New(options)
+	err := nsqd.Start()
+	if err != nil {
+		panic(err)
+	}
+	return nsqd.TCPAddr(), nsqd.HTTPAddr(), nsqd
 }
 
 func mustConnectNSQd(tcpAddr *net.TCPAddr) (net.Conn, error) {
@@ -43,7 +48,7 @@ func TestChannelTopicNames(t *testing.T) {
 	assert.Equal(t, nsq.IsValidChannelName("test#ephemeral"), true)
 	assert.Equal(t, nsq.IsValidTopicName("test"), true)
 	assert.Equal(t, nsq.IsValidTopicName("test-with_period."), true)
-	assert.Equal(t, nsq.IsValidTopicName("test#ephemeral"), false)
+	assert.Equal(t, nsq.IsValidTopicName("test#ephemeral"), true)
 	assert.Equal(t, nsq.IsValidTopicName("test:ephemeral"), false)
 }
 
@@ -52,10 +57,10 @@ func TestBasicV2(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
-	options.clientTimeout = 60 * time.Second
-	tcpAddr, _ := mustStartNSQd(options)
-	defer nsqd.Exit()
+	options := NewOptions()
+	options.ClientTimeout = 60 * time.Second
+	tcpAddr, _, nsqd := mustStartNSQd(options)
+	defer nsqd.Stop()
 
 	topicName := "test_v2" + strconv.Itoa(int(time.Now().Unix()))
 	topic := nsqd.GetTopic(topicName)
@@ -87,10 +92,10 @@ func TestMultipleConsumerV2(t *testing.T) {
 
 	msgChan := make(chan *nsq.Message)
 
-	options := NewNsqdOptions()
-	options.clientTimeout = 60 * time.Second
-	tcpAddr, _ := mustStartNSQd(options)
-	defer nsqd.Exit()
+	options := NewOptions()
+	options.ClientTimeout = 60 * time.Second
+	tcpAddr, _, nsqd := mustStartNSQd(options)
+	defer nsqd.Stop()
 
 	topicName := "test_multiple_v2" + strconv.Itoa(int(time.Now().Unix()))
 	topic := nsqd.GetTopic(topicName)
@@ -133,10 +138,10 @@ func TestClientTimeout(t *testing.T) {
 
 	topicName := "test_client_timeout_v2" + strconv.Itoa(int(time.Now().Unix()))
 
-	options := NewNsqdOptions()
-	options.clientTimeout = 50 * time.Millisecond
-	tcpAddr, _ := mustStartNSQd(options)
-	defer nsqd.Exit()
+	options := NewOptions()
+	options.ClientTimeout = 50 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQd(options)
+	defer nsqd.Stop()
 
 	conn, err := mustConnectNSQd(tcpAddr)
 	assert.Equal(t, err, nil)
@@ -169,10 +174,10 @@ func TestClientHeartbeat(t *testing.T) {
 
 	topicName := "test_hb_v2" + strconv.Itoa(int(time.Now().Unix()))
 
-	options := NewNsqdOptions()
-	options.clientTimeout = 100 * time.Millisecond
-	tcpAddr, _ := mustStartNSQd(options)
-	defer nsqd.Exit()
+	options := NewOptions()
+	options.ClientTimeout = 100 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQd(options)
+	defer nsqd.Stop()
 
 	conn, err := mustConnectNSQd(tcpAddr)
 	assert.Equal(t, err, nil)
@@ -205,8 +210,8 @@ func TestPausing(t *testing.T) {
 
 	topicName := "test_pause_v2" + strconv.Itoa(int(time.Now().Unix()))
 
-	tcpAddr, _ := mustStartNSQd(NewNsqdOptions())
-	defer nsqd.Exit()
+	tcpAddr, _, nsqd := mustStartNSQd(NewOptions())
+	defer nsqd.Stop()
 
 	conn, err := mustConnectNSQd(tcpAddr)
 	assert.Equal(t, err, nil)
@@ -264,12 +269,262 @@ func TestPausing(t *testing.T) {
 	assert.Equal(t, msg.Body, []byte("test body3"))
 }
 
+func TestIdentifyFeatureNegotiationV2(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, _, nsqd := mustStartNSQd(NewOptions())
+	defer nsqd.Stop()
+
+	topicName := "test_identify_v2" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	cmd, err := nsq.Identify(map[string]interface{}{
+		"short_id":            "test",
+		"user_agent":          "test/1.0",
+		"message_headers":     true,
+		"feature_negotiation": true,
+	})
+	assert.Equal(t, err, nil)
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	var negotiated map[string]interface{}
+	err = json.Unmarshal(data, &negotiated)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, negotiated["max_rdy_count"], float64(nsq.MaxReadyCount))
+	assert.Equal(t, negotiated["heartbeat_interval"], float64(nsq.DefaultClientTimeout/2/time.Millisecond))
+	assert.Equal(t, negotiated["message_headers"], true)
+
+	err = nsq.Subscribe(topicName, "ch").Write(conn)
+	assert.Equal(t, err, nil)
+
+	// the user agent is reported in the client stats
+	var userAgent string
+	for i := 0; i < 100 && userAgent == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		for _, topic := range nsqd.getStats() {
+			if topic.TopicName == topicName && len(topic.Channels) == 1 &&
+				len(topic.Channels[0].Clients) == 1 {
+				userAgent = topic.Channels[0].Clients[0].UserAgent
+			}
+		}
+	}
+	assert.Equal(t, userAgent, "test/1.0")
+}
+
+func TestMessageHeadersV2(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, _, nsqd := mustStartNSQd(NewOptions())
+	defer nsqd.Stop()
+
+	topicName := "test_headers_v2" + strconv.Itoa(int(time.Now().Unix()))
+	headers := map[string]string{"content-type": "application/json"}
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	cmd, err := nsq.Identify(map[string]interface{}{"message_headers": true})
+	assert.Equal(t, err, nil)
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+
+	err = nsq.Subscribe(topicName, "ch").Write(conn)
+	assert.Equal(t, err, nil)
+
+	// a client that has not opted in to message headers
+	legacyConn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	err = nsq.Subscribe(topicName, "legacy").Write(legacyConn)
+	assert.Equal(t, err, nil)
+
+	// SUB has no response, wait for both channels so that they receive the message
+	topic := nsqd.GetTopic(topicName)
+	for i := 0; i < 100; i++ {
+		_, err1 := topic.GetExistingChannel("ch")
+		_, err2 := topic.GetExistingChannel("legacy")
+		if err1 == nil && err2 == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cmd, err = nsq.PublishWithHeaders(topicName, headers, []byte("test body"))
+	assert.Equal(t, err, nil)
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+
+	resp, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err = nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	assert.Equal(t, data[0], nsq.MsgFormatV2)
+	msgOut, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Body, []byte("test body"))
+	assert.Equal(t, msgOut.Headers, headers)
+
+	err = nsq.Ready(1).Write(legacyConn)
+	assert.Equal(t, err, nil)
+
+	resp, err = nsq.ReadResponse(legacyConn)
+	assert.Equal(t, err, nil)
+	frameType, data, err = nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	assert.Equal(t, data[0], nsq.MsgFormatV1)
+	msgOut, err = nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgOut.Body, []byte("test body"))
+	assert.Equal(t, len(msgOut.Headers), 0)
+}
+
+func TestDedupV2(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, _, nsqd := mustStartNSQd(NewOptions())
+	defer nsqd.Stop()
+
+	topicName := "test_dedup_v2" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	mpub, err := nsq.MultiPublishWithDedupKey(topicName, "key2", [][]byte{[]byte("a"), []byte("b")})
+	assert.Equal(t, err, nil)
+	hpub, err := nsq.PublishWithHeaders(topicName, map[string]string{nsq.DedupKeyHeader: "key3"}, []byte("c"))
+	assert.Equal(t, err, nil)
+
+	// retried publishes are acknowledged without being enqueued
+	for i := 0; i < 2; i++ {
+		for _, cmd := range []*nsq.Command{nsq.PublishWithDedupKey(topicName, "key1", []byte("test body")), mpub, hpub} {
+			err = cmd.Write(conn)
+			assert.Equal(t, err, nil)
+
+			resp, err := nsq.ReadResponse(conn)
+			assert.Equal(t, err, nil)
+			frameType, data, err := nsq.UnpackResponse(resp)
+			assert.Equal(t, frameType, nsq.FrameTypeResponse)
+			assert.Equal(t, data, []byte("OK"))
+		}
+	}
+
+	topic := nsqd.GetTopic(topicName)
+	assert.Equal(t, topic.Depth(), int64(4))
+	assert.Equal(t, atomic.LoadUint64(&topic.dedupHits), uint64(3))
+
+	err = nsq.PublishWithDedupKey(topicName, strings.Repeat("k", nsq.MaxDedupKeyLength+1), []byte("test body")).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, data, []byte("E_BAD_DEDUP_KEY"))
+}
+
+func TestMPubAtomicV2(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, _, nsqd := mustStartNSQd(NewOptions())
+	defer nsqd.Stop()
+
+	topicName := "test_mpub_atomic_v2" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	// the size of the 3rd message overruns the batch
+	cmd, err := nsq.MultiPublish(topicName, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	assert.Equal(t, err, nil)
+	cmd.Body[4+2*5+3] = 2
+
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, data, []byte("E_BAD_BODY message 2"))
+	clientErr := nsq.ParseClientErr(data, "")
+	assert.Equal(t, clientErr.Err, "E_BAD_BODY")
+	assert.Equal(t, clientErr.Detail, "message 2")
+	assert.Equal(t, topic.Depth(), int64(0))
+
+	// nothing is published to an exiting topic
+	topic.Close()
+	err = topic.PutMessages([]*nsq.Message{nsq.NewMessage(<-nsqd.idChan, []byte("a"))})
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, topic.messageCount, uint64(0))
+}
+
+func TestHPUBInvalidSizeV2(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewOptions()
+	options.MaxMsgSize = 100
+	tcpAddr, _, nsqd := mustStartNSQd(options)
+	defer nsqd.Stop()
+
+	topicName := "test_hpub_size_v2" + strconv.Itoa(int(time.Now().Unix()))
+
+	// only headers
+	emptyBody, err := nsq.PublishWithHeaders(topicName, map[string]string{"a": "b"}, nil)
+	assert.Equal(t, err, nil)
+	var emptyBodyCmd bytes.Buffer
+	emptyBody.Write(&emptyBodyCmd)
+
+	for _, cmd := range [][]byte{
+		[]byte("HPUB " + topicName + "\n\xff\xff\xff\xff"), // negative size
+		[]byte("HPUB " + topicName + "\n\x00\x00\x00\x65"), // larger than MaxMsgSize
+		emptyBodyCmd.Bytes(),
+	} {
+		conn, err := mustConnectNSQd(tcpAddr)
+		assert.Equal(t, err, nil)
+
+		_, err = conn.Write(cmd)
+		assert.Equal(t, err, nil)
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, frameType, nsq.FrameTypeError)
+		assert.Equal(t, data, []byte("E_BAD_BODY"))
+		conn.Close()
+	}
+
+	topic, err := nsqd.GetExistingTopic(topicName)
+	if err == nil {
+		assert.Equal(t, topic.Depth(), int64(0))
+	}
+}
+
 func TestEmptyCommand(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	tcpAddr, _ := mustStartNSQd(NewNsqdOptions())
-	defer nsqd.Exit()
+	tcpAddr, _, nsqd := mustStartNSQd(NewOptions())
+	defer nsqd.Stop()
 	
 	conn, err := mustConnectNSQd(tcpAddr)
 	assert.Equal(t, err, nil)
@@ -284,8 +539,10 @@ func BenchmarkProtocolV2Exec(b *testing.B) {
 	b.StopTimer()
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
-	p := &ProtocolV2{}
-	c := NewClientV2(nil)
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+	p := &ProtocolV2{context: nsqd}
+	c := NewClientV2(nsqd, nil)
 	params := [][]byte{[]byte("NOP")}
 	b.StartTimer()
 
@@ -299,9 +556,9 @@ func benchmarkProtocolV2Pub(b *testing.B, size int) {
 	b.StopTimer()
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
-	options := NewNsqdOptions()
-	options.memQueueSize = int64(b.N)
-	tcpAddr, _ := mustStartNSQd(options)
+	options := NewOptions()
+	options.MemQueueSize = int64(b.N)
+	tcpAddr, _, nsqd := mustStartNSQd(options)
 	msg := make([]byte, size)
 	batchSize := 200
 	batch := make([][]byte, 0)
@@ -348,7 +605,7 @@ func benchmarkProtocolV2Pub(b *testing.B, size int) {
 	wg.Wait()
 
 	b.StopTimer()
-	nsqd.Exit()
+	nsqd.Stop()
 }
 
 func BenchmarkProtocolV2Pub256(b *testing.B)  { benchmarkProtocolV2Pub(b, 256) }
@@ -370,9 +627,9 @@ func benchmarkProtocolV2Sub(b *testing.B, size int) {
 	b.StopTimer()
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
-	options := NewNsqdOptions()
-	options.memQueueSize = int64(b.N)
-	tcpAddr, _ := mustStartNSQd(options)
+	options := NewOptions()
+	options.MemQueueSize = int64(b.N)
+	tcpAddr, _, nsqd := mustStartNSQd(options)
 	msg := make([]byte, size)
 	topicName := "bench_v2_sub" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
 	topic := nsqd.GetTopic(topicName)
@@ -399,7 +656,7 @@ func benchmarkProtocolV2Sub(b *testing.B, size int) {
 	wg.Wait()
 
 	b.StopTimer()
-	nsqd.Exit()
+	nsqd.Stop()
 }
 
 func subWorker(n int, workers int, tcpAddr *net.TCPAddr, topicName string, rdyChan chan int, goChan chan int) {
@@ -470,9 +727,9 @@ func benchmarkProtocolV2MultiSub(b *testing.B, num int) {
 	log.SetOutput(ioutil.Discard)
 	log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
-	options.memQueueSize = int64(b.N)
-	tcpAddr, _ := mustStartNSQd(options)
+	options := NewOptions()
+	options.MemQueueSize = int64(b.N)
+	tcpAddr, _, nsqd := mustStartNSQd(options)
 	msg := make([]byte, 256)
 	b.SetBytes(int64(len(msg) * num))
 
@@ -503,7 +760,7 @@ func benchmarkProtocolV2MultiSub(b *testing.B, num int) {
 	wg.Wait()
 
 	b.StopTimer()
-	nsqd.Exit()
+	nsqd.Stop()
 }
 
 func BenchmarkProtocolV2MultiSub1(b *testing.B) { benchmarkProtocolV2MultiSub(b, 1) }
@@ -1,10 +1,9 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"github.com/lhzd863/nsq-0.2.16/util/pqueue"
 	"bytes"
-	"log"
 )
 
 // BackendQueue represents the behavior for the secondary message
@@ -73,7 +72,7 @@ func FlushQueue(q Queue) error {
 		case msg := <-q.MemoryChan():
 			err := WriteMessageToBackend(&msgBuf, msg, q)
 			if err != nil {
-				log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to write message to backend - %s", err.Error())
 			}
 		default:
 			goto finish
@@ -85,7 +84,7 @@ finish:
 		msg := item.Value.(*inFlightMessage).msg
 		err := WriteMessageToBackend(&msgBuf, msg, q)
 		if err != nil {
-			log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to write message to backend - %s", err.Error())
 		}
 	}
 
@@ -93,7 +92,7 @@ finish:
 		msg := item.Value.(*nsq.Message)
 		err := WriteMessageToBackend(&msgBuf, msg, q)
 		if err != nil {
-			log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+			nsq.NewLogEntry(nil).Errorf("failed to write message to backend - %s", err.Error())
 		}
 	}
 
@@ -0,0 +1,442 @@
+package nsqd
+
+import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+	"github.com/lhzd863/nsq-0.2.16/util"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the number of segments a RetentionLog with a maximum age rolls through per
+// retention period (so that expired data is removed in reasonably sized chunks)
+const retentionSegmentsPerPeriod = 10
+
+// how often segments are expired besides when a message is appended (so that the
+// segments of an idle topic expire too)
+const retentionExpireInterval = time.Second
+
+var errRetentionNotEnabled = errors.New("retention not enabled")
+
+// RetentionLog appends a Topic's message stream to a rotating log of segment
+// files on disk so that channels can be replayed from a point in time.
+//
+// Segments are removed once they are older than maxAge or the log exceeds
+// maxBytes (a value of 0 disables either limit).
+type RetentionLog struct {
+	sync.Mutex
+
+	name               string
+	dataPath           string
+	maxAge             time.Duration
+	maxBytes           int64
+	maxBytesPerSegment int64
+
+	segments  []*retentionSegment
+	writeFile *os.File
+	writeBuf  bytes.Buffer
+
+	exitChan  chan int
+	exitOnce  sync.Once
+	waitGroup util.WaitGroupWrapper
+}
+
+type retentionSegment struct {
+	num     int64
+	size    int64
+	firstTs int64 // (unix) timestamp of the first message
+	lastTs  int64 // (unix) timestamp of the last message
+}
+
+// NewRetentionLog instantiates a new instance of RetentionLog, picking up any
+// segments previously retained for name
+func NewRetentionLog(name string, dataPath string, maxAge time.Duration, maxBytes int64,
+	maxBytesPerSegment int64) (*RetentionLog, error) {
+	r := &RetentionLog{
+		name:               name,
+		dataPath:           dataPath,
+		maxAge:             maxAge,
+		maxBytes:           maxBytes,
+		maxBytesPerSegment: maxBytesPerSegment,
+		exitChan:           make(chan int),
+	}
+
+	fileNames, err := filepath.Glob(path.Join(dataPath, name+".retention.*.dat"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileName := range fileNames {
+		var num int64
+		suffix := strings.TrimPrefix(path.Base(fileName), name+".retention.")
+		_, err := fmt.Sscanf(suffix, "%d.dat", &num)
+		if err != nil {
+			continue
+		}
+
+		segment, err := r.loadSegment(num)
+		if err != nil {
+			r.log().Errorf("failed to load segment %s - %s", fileName, err.Error())
+			continue
+		}
+		r.segments = append(r.segments, segment)
+	}
+	sort.Sort(retentionSegments(r.segments))
+
+	r.waitGroup.Wrap(func() { r.expireLoop() })
+
+	return r, nil
+}
+
+func (r *RetentionLog) log() nsq.LogEntry {
+	return nsq.NewLogEntry(nil, "retention", r.name)
+}
+
+// loadSegment reads the metadata of an existing segment file
+func (r *RetentionLog) loadSegment(num int64) (*retentionSegment, error) {
+	f, err := os.Open(r.fileName(num))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	segment := &retentionSegment{
+		num:    num,
+		size:   fi.Size(),
+		lastTs: fi.ModTime().Unix(),
+	}
+
+	if segment.size > 0 {
+		msg, err := readRetainedMessage(bufio.NewReader(f))
+		if err != nil {
+			return nil, err
+		}
+		segment.firstTs = msg.Timestamp
+	}
+
+	return segment, nil
+}
+
+// SetLimits updates the maximum age/size of the log
+func (r *RetentionLog) SetLimits(maxAge time.Duration, maxBytes int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.maxAge = maxAge
+	r.maxBytes = maxBytes
+	r.expire()
+}
+
+// Limits returns the maximum age/size of the log
+func (r *RetentionLog) Limits() (time.Duration, int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.maxAge, r.maxBytes
+}
+
+// Append writes a message to the end of the log
+//
+// The size prefixed message is written at once, a failed write is truncated so that
+// the segment doesn't end with a partial message
+func (r *RetentionLog) Append(msg *nsq.Message) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.writeFile == nil || r.shouldRoll(msg.Timestamp) {
+		err := r.roll()
+		if err != nil {
+			return err
+		}
+	}
+
+	// reserve the size prefix, it is filled in once the message is encoded
+	var size [4]byte
+	r.writeBuf.Reset()
+	r.writeBuf.Write(size[:])
+	err := msg.Write(&r.writeBuf)
+	if err != nil {
+		return err
+	}
+	record := r.writeBuf.Bytes()
+	binary.BigEndian.PutUint32(record, uint32(len(record)-len(size)))
+
+	segment := r.segments[len(r.segments)-1]
+	_, err = r.writeFile.Write(record)
+	if err != nil {
+		r.truncate(segment)
+		return err
+	}
+
+	segment.size += int64(len(record))
+	if segment.firstTs == 0 {
+		segment.firstTs = msg.Timestamp
+	}
+	segment.lastTs = msg.Timestamp
+
+	r.expire()
+
+	return nil
+}
+
+// truncate discards a partially written message from the end of segment (the one
+// currently being written), failing that the segment is closed so that the next
+// Append rolls to a new one
+func (r *RetentionLog) truncate(segment *retentionSegment) {
+	err := r.writeFile.Truncate(segment.size)
+	if err == nil {
+		_, err = r.writeFile.Seek(segment.size, 0)
+	}
+	if err != nil {
+		r.log().Errorf("failed to truncate segment %d - %s", segment.num, err.Error())
+		r.writeFile.Close()
+		r.writeFile = nil
+	}
+}
+
+// shouldRoll returns true if the current segment is full (by size or, when
+// a maximum age is set, by the span of time it covers)
+func (r *RetentionLog) shouldRoll(ts int64) bool {
+	segment := r.segments[len(r.segments)-1]
+	if r.maxBytesPerSegment > 0 && segment.size >= r.maxBytesPerSegment {
+		return true
+	}
+	if r.maxAge > 0 && segment.firstTs > 0 {
+		span := time.Duration(ts-segment.firstTs) * time.Second
+		if span >= r.maxAge/retentionSegmentsPerPeriod {
+			return true
+		}
+	}
+	return false
+}
+
+// roll closes the current segment and opens a new one
+func (r *RetentionLog) roll() error {
+	if r.writeFile != nil {
+		r.writeFile.Sync()
+		r.writeFile.Close()
+		r.writeFile = nil
+	}
+
+	var num int64
+	if len(r.segments) > 0 {
+		num = r.segments[len(r.segments)-1].num + 1
+	}
+
+	f, err := os.OpenFile(r.fileName(num), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	r.log().Infof("writing to segment %s", f.Name())
+
+	r.writeFile = f
+	r.segments = append(r.segments, &retentionSegment{num: num})
+
+	return nil
+}
+
+// expire removes the oldest segments that are past the age/size limits
+// (the segment currently being written is always kept)
+func (r *RetentionLog) expire() {
+	var totalBytes int64
+	for _, segment := range r.segments {
+		totalBytes += segment.size
+	}
+
+	minTs := time.Now().Add(-r.maxAge).Unix()
+	for len(r.segments) > 1 {
+		oldest := r.segments[0]
+		expired := r.maxAge > 0 && oldest.lastTs < minTs
+		oversized := r.maxBytes > 0 && totalBytes > r.maxBytes
+		if !expired && !oversized {
+			break
+		}
+
+		err := os.Remove(r.fileName(oldest.num))
+		if err != nil && !os.IsNotExist(err) {
+			r.log().Errorf("failed to remove segment %d - %s", oldest.num, err.Error())
+			break
+		}
+		totalBytes -= oldest.size
+		r.segments = r.segments[1:]
+	}
+}
+
+// expireLoop expires segments every retentionExpireInterval until the log is closed
+func (r *RetentionLog) expireLoop() {
+	ticker := time.NewTicker(retentionExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Lock()
+			r.expire()
+			r.Unlock()
+		case <-r.exitChan:
+			return
+		}
+	}
+}
+
+// Size returns the number of bytes retained
+func (r *RetentionLog) Size() int64 {
+	r.Lock()
+	defer r.Unlock()
+
+	var size int64
+	for _, segment := range r.segments {
+		size += segment.size
+	}
+	return size
+}
+
+// snapshot returns a copy of the current segment metadata, bounding a
+// subsequent replay to the messages appended so far
+func (r *RetentionLog) snapshot() []retentionSegment {
+	r.Lock()
+	defer r.Unlock()
+
+	segments := make([]retentionSegment, 0, len(r.segments))
+	for _, segment := range r.segments {
+		segments = append(segments, *segment)
+	}
+	return segments
+}
+
+// replay calls fn (in order) for every message in a snapshot of segments with
+// a timestamp of at least since, stopping at the first error
+func (r *RetentionLog) replay(segments []retentionSegment, since int64, fn func(*nsq.Message) error) error {
+	for _, segment := range segments {
+		if segment.lastTs < since || segment.size == 0 {
+			continue
+		}
+
+		err := r.replaySegment(segment, since, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RetentionLog) replaySegment(segment retentionSegment, since int64, fn func(*nsq.Message) error) error {
+	f, err := os.Open(r.fileName(segment.num))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// expired while we were replaying
+			r.log().Infof("segment %d expired before replay", segment.num)
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(io.LimitReader(f, segment.size))
+	for {
+		msg, err := readRetainedMessage(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// a partial message left by a failed write (see Append)
+			r.log().Errorf("segment %d ends with a partial message", segment.num)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Timestamp < since {
+			continue
+		}
+
+		err = fn(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close stops expiring segments and closes the segment currently being written
+func (r *RetentionLog) Close() error {
+	r.exitOnce.Do(func() { close(r.exitChan) })
+	r.waitGroup.Wait()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.writeFile == nil {
+		return nil
+	}
+
+	err := r.writeFile.Sync()
+	r.writeFile.Close()
+	r.writeFile = nil
+	return err
+}
+
+// Delete closes the log and removes all of its segments
+func (r *RetentionLog) Delete() error {
+	r.Close()
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, segment := range r.segments {
+		err := os.Remove(r.fileName(segment.num))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	r.segments = nil
+
+	return nil
+}
+
+func (r *RetentionLog) fileName(num int64) string {
+	return fmt.Sprintf(path.Join(r.dataPath, "%s.retention.%06d.dat"), r.name, num)
+}
+
+// readRetainedMessage reads a single size prefixed message
+func readRetainedMessage(reader io.Reader) (*nsq.Message, error) {
+	var msgSize int32
+
+	err := binary.Read(reader, binary.BigEndian, &msgSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgSize <= 0 {
+		return nil, errors.New("invalid message size")
+	}
+
+	buf := make([]byte, msgSize)
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return nsq.DecodeMessage(buf)
+}
+
+type retentionSegments []*retentionSegment
+
+func (s retentionSegments) Len() int           { return len(s) }
+func (s retentionSegments) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s retentionSegments) Less(i, j int) bool { return s[i].num < s[j].num }
@@ -0,0 +1,144 @@
+package nsqd
+
+import (
+	"../nsq"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetentionLogReplay(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dataPath, err := ioutil.TempDir("", "nsq-retention")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dataPath)
+
+	// tiny segments so that every message rolls
+	r, err := NewRetentionLog("test_retention", dataPath, 0, 0, 1)
+	assert.Equal(t, err, nil)
+
+	var id nsq.MessageID
+	for i := 0; i < 5; i++ {
+		msg := nsq.NewMessage(id, []byte(strconv.Itoa(i)))
+		msg.Timestamp = int64(1000 + i)
+		err := r.Append(msg)
+		assert.Equal(t, err, nil)
+	}
+	assert.Equal(t, len(r.segments), 5)
+
+	bodies := make([]string, 0)
+	err = r.replay(r.snapshot(), 1002, func(msg *nsq.Message) error {
+		bodies = append(bodies, string(msg.Body))
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, bodies, []string{"2", "3", "4"})
+
+	// re-opening picks up the existing segments
+	size := r.Size()
+	r.Close()
+	r, err = NewRetentionLog("test_retention", dataPath, 0, 0, 1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Size(), size)
+	assert.Equal(t, r.segments[0].firstTs, int64(1000))
+
+	// enforcing a size limit removes the oldest segments
+	r.SetLimits(0, size/5+1)
+	assert.Equal(t, len(r.segments), 1)
+
+	err = r.Delete()
+	assert.Equal(t, err, nil)
+	files, _ := ioutil.ReadDir(dataPath)
+	assert.Equal(t, len(files), 0)
+}
+
+func TestRetentionLogExpire(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dataPath, err := ioutil.TempDir("", "nsq-retention")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dataPath)
+
+	r, err := NewRetentionLog("test_retention", dataPath, time.Hour, 0, 1)
+	assert.Equal(t, err, nil)
+	defer r.Close()
+
+	var id nsq.MessageID
+	old := nsq.NewMessage(id, []byte("old"))
+	old.Timestamp = time.Now().Add(-2 * time.Hour).Unix()
+	r.Append(old)
+	r.Append(nsq.NewMessage(id, []byte("new")))
+	r.Append(nsq.NewMessage(id, []byte("newer")))
+
+	assert.Equal(t, len(r.segments), 2)
+	assert.Equal(t, r.segments[0].firstTs > old.Timestamp, true)
+}
+
+func TestRetentionLogExpireIdle(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dataPath, err := ioutil.TempDir("", "nsq-retention")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dataPath)
+
+	r, err := NewRetentionLog("test_retention", dataPath, time.Hour, 0, 1)
+	assert.Equal(t, err, nil)
+	defer r.Close()
+
+	// the first segment expires a second from now, without further appends
+	var id nsq.MessageID
+	msg := nsq.NewMessage(id, []byte("expiring"))
+	msg.Timestamp = time.Now().Add(-time.Hour).Unix() + 1
+	r.Append(msg)
+	r.Append(nsq.NewMessage(id, []byte("new")))
+	assert.Equal(t, len(r.snapshot()), 2)
+
+	for i := 0; i < 50 && len(r.snapshot()) == 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, len(r.snapshot()), 1)
+}
+
+func TestRetentionLogFailedAppend(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dataPath, err := ioutil.TempDir("", "nsq-retention")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dataPath)
+
+	r, err := NewRetentionLog("test_retention", dataPath, 0, 0, 0)
+	assert.Equal(t, err, nil)
+	defer r.Close()
+
+	var id nsq.MessageID
+	err = r.Append(nsq.NewMessage(id, []byte("0")))
+	assert.Equal(t, err, nil)
+
+	// a failed write doesn't leave a partial message behind, the next append
+	// rolls to a new segment
+	r.Lock()
+	r.writeFile.Close()
+	r.Unlock()
+	err = r.Append(nsq.NewMessage(id, []byte("lost")))
+	assert.NotEqual(t, err, nil)
+	err = r.Append(nsq.NewMessage(id, []byte("1")))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(r.snapshot()), 2)
+
+	bodies := make([]string, 0)
+	err = r.replay(r.snapshot(), 0, func(msg *nsq.Message) error {
+		bodies = append(bodies, string(msg.Body))
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, bodies, []string{"0", "1"})
+}
@@ -1,50 +1,75 @@
-package main
+package nsqd
 
 import (
 	"sort"
+	"sync/atomic"
 )
 
 type TopicStats struct {
-	TopicName    string         `json:"topic_name"`
-	Channels     []ChannelStats `json:"channels"`
-	Depth        int64          `json:"depth"`
-	BackendDepth int64          `json:"backend_depth"`
-	MessageCount uint64         `json:"message_count"`
+	TopicName     string         `json:"topic_name"`
+	Channels      []ChannelStats `json:"channels"`
+	Depth         int64          `json:"depth"`
+	BackendDepth  int64          `json:"backend_depth"`
+	MessageCount  uint64         `json:"message_count"`
+	DedupHits     uint64         `json:"dedup_hits"`
+	Paused        bool           `json:"paused"`
+	Retention     bool           `json:"retention"`
+	RetainedBytes int64          `json:"retained_bytes"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	var retainedBytes int64
+	if t.retention != nil {
+		retainedBytes = t.retention.Size()
+	}
+
 	return TopicStats{
-		TopicName:    t.name,
-		Channels:     channels,
-		Depth:        t.Depth(),
-		BackendDepth: t.backend.Depth(),
-		MessageCount: t.messageCount,
+		TopicName:     t.name,
+		Channels:      channels,
+		Depth:         t.Depth(),
+		BackendDepth:  t.backend.Depth(),
+		MessageCount:  t.messageCount,
+		DedupHits:     atomic.LoadUint64(&t.dedupHits),
+		Paused:        t.IsPaused(),
+		Retention:     t.retention != nil,
+		RetainedBytes: retainedBytes,
 	}
 }
 
 type ChannelStats struct {
-	ChannelName   string        `json:"channel_name"`
-	Depth         int64         `json:"depth"`
-	BackendDepth  int64         `json:"backend_depth"`
-	InFlightCount int           `json:"in_flight_count"`
-	DeferredCount int           `json:"deferred_count"`
-	MessageCount  uint64        `json:"message_count"`
-	RequeueCount  uint64        `json:"requeue_count"`
-	TimeoutCount  uint64        `json:"timeout_count"`
-	Clients       []ClientStats `json:"clients"`
-	Paused        bool          `json:"paused"`
+	ChannelName   string           `json:"channel_name"`
+	Depth         int64            `json:"depth"`
+	BackendDepth  int64            `json:"backend_depth"`
+	PriorityDepth map[string]int64 `json:"priority_depth"`
+	InFlightCount int              `json:"in_flight_count"`
+	DeferredCount int              `json:"deferred_count"`
+	MessageCount  uint64           `json:"message_count"`
+	RequeueCount  uint64           `json:"requeue_count"`
+	TimeoutCount  uint64           `json:"timeout_count"`
+	FilteredCount uint64           `json:"filtered_count"`
+	Filter        string           `json:"filter"`
+	Clients       []ClientStats    `json:"clients"`
+	Paused        bool             `json:"paused"`
 }
 
 func NewChannelStats(c *Channel, clients []ClientStats) ChannelStats {
+	var filter string
+	if f := c.Filter(); f != nil {
+		filter = f.String()
+	}
+
 	return ChannelStats{
 		ChannelName:   c.name,
 		Depth:         c.Depth(),
-		BackendDepth:  c.backend.Depth(),
+		BackendDepth:  c.BackendDepth(),
+		PriorityDepth: c.PriorityDepth(),
 		InFlightCount: len(c.inFlightMessages),
 		DeferredCount: len(c.deferredMessages),
 		MessageCount:  c.messageCount,
 		RequeueCount:  c.requeueCount,
 		TimeoutCount:  c.timeoutCount,
+		FilteredCount: atomic.LoadUint64(&c.filteredCount),
+		Filter:        filter,
 		Clients:       clients,
 		Paused:        c.IsPaused(),
 	}
@@ -54,6 +79,7 @@ type ClientStats struct {
 	Version       string `json:"version"`
 	RemoteAddress string `json:"remote_address"`
 	Name          string `json:"name"`
+	UserAgent     string `json:"user_agent"`
 	State         int32  `json:"state"`
 	ReadyCount    int64  `json:"ready_count"`
 	InFlightCount int64  `json:"in_flight_count"`
@@ -63,6 +89,20 @@ type ClientStats struct {
 	ConnectTime   int64  `json:"connect_ts"`
 }
 
+type ForwarderStats struct {
+	Name           string `json:"name"`
+	Source         string `json:"source"`
+	Destination    string `json:"destination"`
+	Address        string `json:"address"`
+	MaxInFlight    int64  `json:"max_in_flight"`
+	InFlightCount  int64  `json:"in_flight_count"`
+	ForwardCount   uint64 `json:"forward_count"`
+	ErrorCount     uint64 `json:"error_count"`
+	RequeueCount   uint64 `json:"requeue_count"`
+	BackoffCounter int32  `json:"backoff_counter"`
+	Paused         bool   `json:"paused"`
+}
+
 type Topics []*Topic
 
 func (t Topics) Len() int      { return len(t) }
@@ -89,10 +129,10 @@ func (n *NSQd) getStats() []TopicStats {
 	n.RLock()
 	defer n.RUnlock()
 
-	realTopics := make([]*Topic, len(nsqd.topicMap))
-	topics := make([]TopicStats, len(nsqd.topicMap))
+	realTopics := make([]*Topic, len(n.topicMap))
+	topics := make([]TopicStats, len(n.topicMap))
 	topic_index := 0
-	for _, t := range nsqd.topicMap {
+	for _, t := range n.topicMap {
 		realTopics[topic_index] = t
 		topic_index++
 	}
@@ -127,3 +167,21 @@ func (n *NSQd) getStats() []TopicStats {
 
 	return topics
 }
+
+func (n *NSQd) getForwarderStats() []ForwarderStats {
+	n.RLock()
+	defer n.RUnlock()
+
+	names := make([]string, 0, len(n.forwarders))
+	for name, _ := range n.forwarders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	forwarders := make([]ForwarderStats, 0, len(names))
+	for _, name := range names {
+		forwarders = append(forwarders, n.forwarders[name].ForwarderStats())
+	}
+
+	return forwarders
+}
@@ -1,28 +1,53 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/util"
 	"fmt"
-	"log"
+	"os"
+	"strings"
 	"time"
 )
 
-func statsdLoop(addr string, prefix string, interval int) {
+// statsdLoop periodically pushes stats to the configured statsd daemon,
+// the address and interval can be changed at runtime (see SetRuntimeOptions)
+func (n *NSQd) statsdLoop() {
+	prefix := n.options.StatsdPrefix
+	if prefix == "" {
+		hostname, _ := os.Hostname()
+		underHostname := fmt.Sprintf("%s_%d", strings.Replace(hostname, ".", "_", -1), n.HTTPAddr().Port)
+		prefix = fmt.Sprintf("nsq.%s.", underHostname)
+	}
+
 	lastStats := make([]TopicStats, 0)
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	addr, interval := n.getStatsdOptions()
+	ticker := time.NewTicker(interval)
 	for {
 		select {
+		case <-n.exitChan:
+			goto exit
+		case <-n.statsdChangeChan:
+			var newInterval time.Duration
+			addr, newInterval = n.getStatsdOptions()
+			if newInterval != interval {
+				interval = newInterval
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
 		case <-ticker.C:
+			if addr == "" {
+				continue
+			}
+
 			statsd := util.NewStatsdClient(addr, prefix)
 			err := statsd.CreateSocket()
 			if err != nil {
-				log.Printf("ERROR: failed to create UDP socket to statsd(%s)", statsd)
+				n.log("statsd", addr).Errorf("failed to create UDP socket")
 				continue
 			}
 
-			log.Printf("STATSD: pushing stats to %s", statsd)
+			n.log("statsd", addr).Infof("pushing stats")
 
-			stats := nsqd.getStats()
+			stats := n.getStats()
 			for _, topic := range stats {
 				// try to find the topic in the last collection
 				lastTopic := TopicStats{}
@@ -36,6 +61,9 @@ func statsdLoop(addr string, prefix string, interval int) {
 				stat := fmt.Sprintf("topic.%s.message_count", topic.TopicName)
 				statsd.Incr(stat, int(diff))
 
+				stat = fmt.Sprintf("topic.%s.dedup_hits", topic.TopicName)
+				statsd.Incr(stat, int(topic.DedupHits-lastTopic.DedupHits))
+
 				stat = fmt.Sprintf("topic.%s.depth", topic.TopicName)
 				statsd.Gauge(stat, int(topic.Depth))
 
@@ -61,6 +89,11 @@ func statsdLoop(addr string, prefix string, interval int) {
 					stat = fmt.Sprintf("topic.%s.channel.%s.backend_depth", topic.TopicName, channel.ChannelName)
 					statsd.Gauge(stat, int(channel.BackendDepth))
 
+					for priority, depth := range channel.PriorityDepth {
+						stat = fmt.Sprintf("topic.%s.channel.%s.priority_depth.%s", topic.TopicName, channel.ChannelName, priority)
+						statsd.Gauge(stat, int(depth))
+					}
+
 					diff = uint64(channel.InFlightCount - lastChannel.InFlightCount)
 					stat = fmt.Sprintf("topic.%s.channel.%s.in_flight_count", topic.TopicName, channel.ChannelName)
 					statsd.Incr(stat, int(diff))
@@ -77,6 +110,10 @@ func statsdLoop(addr string, prefix string, interval int) {
 					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
 					statsd.Incr(stat, int(diff))
 
+					diff = channel.FilteredCount - lastChannel.FilteredCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.filtered_count", topic.TopicName, channel.ChannelName)
+					statsd.Incr(stat, int(diff))
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
 					statsd.Gauge(stat, len(channel.Clients))
 				}
@@ -86,5 +123,7 @@ func statsdLoop(addr string, prefix string, interval int) {
 			statsd.Close()
 		}
 	}
+
+exit:
 	ticker.Stop()
 }
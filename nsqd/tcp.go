@@ -1,9 +1,8 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"github.com/lhzd863/nsq-0.2.16/util"
-	"log"
 	"net"
 )
 
@@ -13,26 +12,27 @@ type TcpProtocol struct {
 }
 
 func (p *TcpProtocol) Handle(clientConn net.Conn) {
-	log.Printf("TCP: new client(%s)", clientConn.RemoteAddr())
+	l := nsq.NewLogEntry(nil, "client", clientConn.RemoteAddr().String())
+	l.Infof("new TCP client")
 
 	protocolMagic, err := nsq.ReadMagic(clientConn)
 	if err != nil {
-		log.Printf("ERROR: failed to read protocol version - %s", err.Error())
+		l.Errorf("failed to read protocol version - %s", err.Error())
 		return
 	}
 
-	log.Printf("CLIENT(%s): desired protocol %d", clientConn.RemoteAddr(), protocolMagic)
+	l.Infof("desired protocol %d", protocolMagic)
 
 	prot, ok := p.protocols[protocolMagic]
 	if !ok {
 		nsq.SendFramedResponse(clientConn, nsq.FrameTypeError, []byte("E_BAD_PROTOCOL"))
-		log.Printf("ERROR: client(%s) bad protocol version %d", clientConn.RemoteAddr(), protocolMagic)
+		l.Errorf("bad protocol version %d", protocolMagic)
 		return
 	}
 
 	err = prot.IOLoop(clientConn)
 	if err != nil {
-		log.Printf("ERROR: client(%s) - %s", clientConn.RemoteAddr(), err.Error())
+		l.Errorf("%s", err.Error())
 		return
 	}
 }
@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
@@ -6,10 +6,10 @@ import (
 	"github.com/lhzd863/nsq-0.2.16/util/pqueue"
 	"bytes"
 	"errors"
-	"github.com/bitly/go-notify"
-	"log"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Topic struct {
@@ -24,29 +24,62 @@ type Topic struct {
 	waitGroup          util.WaitGroupWrapper
 	exitFlag           int32
 	messageCount       uint64
-	options            *nsqdOptions
+	context            *NSQd
+	paused             int32
+	pauseChan          chan int
+	retention          *RetentionLog // protected by the Topic's lock
+	ephemeralTopic     bool
+	deleteCallback     func(*Topic)
+	deleting           bool // protected by the Topic's lock, see deleteIfUnused
+	dedup              *dedupIndex
+	dedupHits          uint64
+}
+
+func isEphemeralTopicName(topicName string) bool {
+	return strings.HasSuffix(topicName, "#ephemeral")
 }
 
 // Topic constructor
-func NewTopic(topicName string, options *nsqdOptions) *Topic {
+//
+// Ephemeral topics (named with a #ephemeral suffix) are memory-only and are deleted
+// (via deleteCallback) once their last channel is deleted while the topic is empty
+func NewTopic(topicName string, context *NSQd, deleteCallback func(*Topic)) *Topic {
+	memQueueSize, maxBytesPerFile, syncEvery := context.options.getQueueOptions()
 	topic := &Topic{
 		name:               topicName,
 		channelMap:         make(map[string]*Channel),
-		backend:            NewDiskQueue(topicName, options.dataPath, options.maxBytesPerFile, options.syncEvery),
 		incomingMsgChan:    make(chan *nsq.Message, 1),
-		memoryMsgChan:      make(chan *nsq.Message, options.memQueueSize),
-		options:            options,
+		memoryMsgChan:      make(chan *nsq.Message, memQueueSize),
+		context:            context,
 		exitChan:           make(chan int),
 		messagePumpStarter: new(sync.Once),
+		// pauseChan has a buffer of 1 to guarantee that in the event
+		// there is a race the state update is not lost
+		pauseChan:      make(chan int, 1),
+		deleteCallback: deleteCallback,
+	}
+	if isEphemeralTopicName(topicName) {
+		topic.ephemeralTopic = true
+		topic.backend = NewDummyBackendQueue()
+	} else {
+		topic.backend = NewDiskQueue(topicName, context.options.DataPath, maxBytesPerFile, syncEvery)
+	}
+
+	if context.options.DedupWindow > 0 && context.options.DedupMaxKeys > 0 {
+		topic.dedup = newDedupIndex(context.options.DedupWindow, context.options.DedupMaxKeys)
 	}
 
 	topic.waitGroup.Wrap(func() { topic.router() })
 
-	go notify.Post("topic_change", topic)
+	context.notifyTopicChange(topic)
 
 	return topic
 }
 
+func (t *Topic) log() nsq.LogEntry {
+	return t.context.log("topic", t.name)
+}
+
 func (t *Topic) MemoryChan() chan *nsq.Message {
 	return t.memoryMsgChan
 }
@@ -84,15 +117,29 @@ func (t *Topic) getOrCreateChannel(channelName string) *Channel {
 		deleteCallback := func(c *Channel) {
 			t.DeleteExistingChannel(c.name)
 		}
-		channel = NewChannel(t.name, channelName, t.options, deleteCallback)
+		channel = NewChannel(t.name, channelName, t.context, deleteCallback)
 		t.channelMap[channelName] = channel
-		log.Printf("TOPIC(%s): new channel(%s)", t.name, channel.name)
+		// the topic is kept for the new channel (see deleteIfUnused)
+		t.deleting = false
+		channel.log().Infof("new channel")
 		// start the topic message pump lazily using a `once` on the first channel creation
 		t.messagePumpStarter.Do(func() { t.waitGroup.Wrap(func() { t.messagePump() }) })
 	}
 	return channel
 }
 
+// GetFilteredChannel performs a thread safe operation
+// to return a pointer to a Channel object (potentially new)
+// for the given Topic that only receives messages matching filter
+// (replacing any existing filter, nil removes it)
+func (t *Topic) GetFilteredChannel(channelName string, filter MessageFilter) *Channel {
+	t.Lock()
+	defer t.Unlock()
+	channel := t.getOrCreateChannel(channelName)
+	channel.setFilter(filter)
+	return channel
+}
+
 func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
 	t.RLock()
 	defer t.RUnlock()
@@ -115,7 +162,7 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 	// not defered so that we can continue while the channel async closes
 	t.Unlock()
 
-	log.Printf("TOPIC(%s): deleting channel %s", t.name, channel.name)
+	channel.log().Infof("deleting channel")
 
 	// delete empties the channel before closing
 	// (so that we dont leave any messages around)
@@ -123,11 +170,29 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 
 	// since we are explicitly deleting a channel (not just at system exit time)
 	// de-register this from the lookupd
-	go notify.Post("channel_change", channel)
+	t.context.notifyChannelChange(channel)
+
+	t.Lock()
+	t.deleteIfUnused()
+	t.Unlock()
 
 	return nil
 }
 
+// deleteIfUnused marks an ephemeral topic without channels as deleting once it is
+// empty and deletes it asynchronously (via deleteCallback, which is expected to
+// skip the deletion when the topic is no longer marked, ie. a channel was created
+// in the meantime)
+//
+// this expects the caller to hold the Topic's lock
+func (t *Topic) deleteIfUnused() {
+	if !t.ephemeralTopic || t.deleting || len(t.channelMap) > 0 || t.Depth() > 0 {
+		return
+	}
+	t.deleting = true
+	go t.deleteCallback(t)
+}
+
 // PutMessage writes to the appropriate incoming message channel
 func (t *Topic) PutMessage(msg *nsq.Message) error {
 	t.RLock()
@@ -140,16 +205,202 @@ func (t *Topic) PutMessage(msg *nsq.Message) error {
 	return nil
 }
 
+// PutMessages writes msgs to the incoming message channel, either all of them
+// or (when the topic is exiting) none
+func (t *Topic) PutMessages(msgs []*nsq.Message) error {
+	t.RLock()
+	defer t.RUnlock()
+	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		return errors.New("exiting")
+	}
+	for _, msg := range msgs {
+		t.incomingMsgChan <- msg
+	}
+	atomic.AddUint64(&t.messageCount, uint64(len(msgs)))
+	return nil
+}
+
+// PutMessagesDedup writes msgs unless dedupKey was already used to publish to
+// this topic within the dedup window (see Options.DedupWindow), in which case they
+// are dropped (and counted as a dedup hit).  It returns whether msgs were written
+// (see PutMessages, it is all or nothing).
+//
+// The key is only remembered once msgs were written, a concurrent publish with the
+// same key waits for the outcome (and is a dedup hit unless this publish failed).
+//
+// An empty dedupKey (or a disabled dedup window) always writes msgs.
+func (t *Topic) PutMessagesDedup(dedupKey string, msgs []*nsq.Message) (bool, error) {
+	dedup := dedupKey != "" && t.dedup != nil
+	if dedup && !t.dedup.reserve(dedupKey, time.Now()) {
+		atomic.AddUint64(&t.dedupHits, 1)
+		return false, nil
+	}
+
+	err := t.PutMessages(msgs)
+	if err != nil {
+		if dedup {
+			// allow the publish to be retried
+			t.dedup.cancel(dedupKey)
+		}
+		return false, err
+	}
+	if dedup {
+		t.dedup.commit(dedupKey, time.Now())
+	}
+	return true, nil
+}
+
 func (t *Topic) Depth() int64 {
 	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
 }
 
+// Pause stops the messagePump from copying messages into channels, messages
+// continue to accumulate in the topic's memory/backend queue
+func (t *Topic) Pause() {
+	t.doPause(true)
+}
+
+// UnPause resumes copying messages into channels
+func (t *Topic) UnPause() {
+	t.doPause(false)
+}
+
+func (t *Topic) doPause(pause bool) {
+	if pause {
+		atomic.StoreInt32(&t.paused, 1)
+	} else {
+		atomic.StoreInt32(&t.paused, 0)
+	}
+
+	// you can always *try* to write to pauseChan because in the cases
+	// where you cannot the message pump loop would have iterated anyway.
+	select {
+	case t.pauseChan <- 1:
+	default:
+	}
+
+	t.context.notifyTopicPauseChange(t)
+}
+
+func (t *Topic) IsPaused() bool {
+	return atomic.LoadInt32(&t.paused) == 1
+}
+
+// SetRetention enables retaining the topic's message stream on disk for up
+// to maxAge and/or maxBytes (0 disables either limit, both disables retention
+// and removes anything retained)
+func (t *Topic) SetRetention(maxAge time.Duration, maxBytes int64) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ephemeralTopic {
+		return errors.New("ephemeral topics cannot be retained")
+	}
+
+	if maxAge == 0 && maxBytes == 0 {
+		if t.retention == nil {
+			return nil
+		}
+		t.log().Infof("disabling retention")
+		err := t.retention.Delete()
+		t.retention = nil
+		return err
+	}
+
+	t.log().Infof("retaining messages for %s / %d bytes", maxAge, maxBytes)
+	if t.retention != nil {
+		t.retention.SetLimits(maxAge, maxBytes)
+		return nil
+	}
+
+	_, maxBytesPerFile, _ := t.context.options.getQueueOptions()
+	retention, err := NewRetentionLog(t.name, t.context.options.DataPath, maxAge, maxBytes, maxBytesPerFile)
+	if err != nil {
+		return err
+	}
+	t.retention = retention
+
+	return nil
+}
+
+// ReplayChannel feeds the named channel (created if necessary) every retained
+// message with a timestamp of at least since (unix time).
+//
+// An existing channel is rewound, any messages it has queued are discarded first
+// (in-flight and deferred messages are unaffected).  The replay happens asynchronously,
+// messages published after this call are delivered as usual.
+//
+// Replayed messages are given new IDs (a retained message may still be in flight).
+func (t *Topic) ReplayChannel(channelName string, since int64) (*Channel, error) {
+	t.Lock()
+	if t.retention == nil {
+		t.Unlock()
+		return nil, errRetentionNotEnabled
+	}
+
+	// holding the lock blocks messagePump so that the channel receives every
+	// message either from the snapshot or the topic, but not both
+	channel := t.getOrCreateChannel(channelName)
+	err := channel.Empty()
+	if err != nil {
+		t.Unlock()
+		return nil, err
+	}
+	retention := t.retention
+	segments := retention.snapshot()
+	t.Unlock()
+
+	channel.log().Infof("replaying channel from %d", since)
+	go t.replay(channel, retention, segments, since)
+
+	return channel, nil
+}
+
+func (t *Topic) replay(channel *Channel, retention *RetentionLog, segments []retentionSegment, since int64) {
+	var count int64
+
+	err := retention.replay(segments, since, func(msg *nsq.Message) error {
+		if t.Exiting() {
+			return errors.New("exiting")
+		}
+
+		filter := channel.Filter()
+		if filter != nil && !filter.Match(msg.Body) {
+			atomic.AddUint64(&channel.filteredCount, 1)
+			return nil
+		}
+
+		// the retained message may still be in flight (or deferred) in the channel,
+		// the copy needs a fresh ID to not be dropped as a duplicate
+		var id nsq.MessageID
+		select {
+		case id = <-t.context.idChan:
+		case <-t.exitChan:
+			return errors.New("exiting")
+		}
+		replayMsg := nsq.NewMessage(id, msg.Body)
+		replayMsg.Timestamp = msg.Timestamp
+		replayMsg.Headers = msg.Headers
+
+		count++
+		return channel.PutMessage(replayMsg)
+	})
+	if err != nil {
+		channel.log().Errorf("failed to replay channel after %d messages - %s", count, err.Error())
+		return
+	}
+
+	channel.log().Infof("replayed %d messages to channel", count)
+}
+
 // messagePump selects over the in-memory and backend queue and
 // writes messages to every channel for this topic
 func (t *Topic) messagePump() {
 	var msg *nsq.Message
 	var buf []byte
 	var err error
+	var memoryMsgChan chan *nsq.Message
+	var backendChan chan []byte
 
 	for {
 		// do an extra check for exit before we select on all the memory/backend/exitChan
@@ -159,14 +410,25 @@ func (t *Topic) messagePump() {
 			goto exit
 		}
 
+		if t.IsPaused() {
+			// leave messages in the topic until we are unpaused
+			memoryMsgChan = nil
+			backendChan = nil
+		} else {
+			memoryMsgChan = t.memoryMsgChan
+			backendChan = t.backend.ReadChan()
+		}
+
 		select {
-		case msg = <-t.memoryMsgChan:
-		case buf = <-t.backend.ReadChan():
+		case msg = <-memoryMsgChan:
+		case buf = <-backendChan:
 			msg, err = nsq.DecodeMessage(buf)
 			if err != nil {
-				log.Printf("ERROR: failed to decode message - %s", err.Error())
+				t.log().Errorf("failed to decode message - %s", err.Error())
 				continue
 			}
+		case <-t.pauseChan:
+			continue
 		case <-t.exitChan:
 			goto exit
 		}
@@ -187,21 +449,42 @@ func (t *Topic) messagePump() {
 			goto exit
 		}
 
+		if t.retention != nil {
+			err := t.retention.Append(msg)
+			if err != nil {
+				t.log().Errorf("failed to retain msg(%s) - %s", msg.Id, err.Error())
+			}
+		}
+
 		for _, channel := range t.channelMap {
+			filter := channel.Filter()
+			if filter != nil && !filter.Match(msg.Body) {
+				atomic.AddUint64(&channel.filteredCount, 1)
+				continue
+			}
 			// copy the message because each channel
 			// needs a unique instance
 			chanMsg := nsq.NewMessage(msg.Id, msg.Body)
 			chanMsg.Timestamp = msg.Timestamp
+			chanMsg.Headers = msg.Headers
 			err := channel.PutMessage(chanMsg)
 			if err != nil {
-				log.Printf("TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s", t.name, msg.Id, channel.name, err.Error())
+				channel.log().Errorf("failed to put msg(%s) to channel - %s", msg.Id, err.Error())
 			}
 		}
 		t.RUnlock()
+
+		// an ephemeral topic that had messages left when its last channel was
+		// deleted is deleted once it drains
+		if t.ephemeralTopic && t.Depth() == 0 {
+			t.Lock()
+			t.deleteIfUnused()
+			t.Unlock()
+		}
 	}
 
 exit:
-	log.Printf("TOPIC(%s): closing ... messagePump", t.name)
+	t.log().Infof("closing ... messagePump")
 }
 
 // router handles muxing of Topic messages including
@@ -214,14 +497,14 @@ func (t *Topic) router() {
 		default:
 			err := WriteMessageToBackend(&msgBuf, msg, t)
 			if err != nil {
-				log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+				t.log().Errorf("failed to write message to backend - %s", err.Error())
 				// theres not really much we can do at this point, you're certainly
 				// going to lose messages...
 			}
 		}
 	}
 
-	log.Printf("TOPIC(%s): closing ... router", t.name)
+	t.log().Infof("closing ... router")
 }
 
 // Delete empties the topic and all its channels and closes
@@ -238,7 +521,7 @@ func (t *Topic) exit(deleted bool) error {
 		return errors.New("exiting")
 	}
 
-	log.Printf("TOPIC(%s): closing", t.name)
+	t.log().Infof("closing topic")
 
 	// initiate exit
 	atomic.StoreInt32(&t.exitFlag, 1)
@@ -251,6 +534,14 @@ func (t *Topic) exit(deleted bool) error {
 	// synchronize the close of router() and messagePump()
 	t.waitGroup.Wait()
 
+	if t.retention != nil {
+		if deleted {
+			t.retention.Delete()
+		} else {
+			t.retention.Close()
+		}
+	}
+
 	if deleted {
 		// empty the queue (deletes the backend files, too)
 		EmptyQueue(t)
@@ -267,13 +558,13 @@ func (t *Topic) exit(deleted bool) error {
 			err := channel.Close()
 			if err != nil {
 				// we need to continue regardless of error to close all the channels
-				log.Printf("ERROR: channel(%s) close - %s", channel.name, err.Error())
+				channel.log().Errorf("failed to close channel - %s", err.Error())
 			}
 		}
 
 		// write anything leftover to disk
 		if len(t.memoryMsgChan) > 0 {
-			log.Printf("TOPIC(%s): flushing %d memory messages to backend", t.name, len(t.memoryMsgChan))
+			t.log().Infof("flushing %d memory messages to backend", len(t.memoryMsgChan))
 		}
 		FlushQueue(t)
 	}
@@ -1,4 +1,4 @@
-package main
+package nsqd
 
 import (
 	"../nsq"
@@ -16,8 +16,8 @@ func TestGetTopic(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
-	defer nsqd.Exit()
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
 
 	topic1 := nsqd.GetTopic("test")
 	assert.NotEqual(t, nil, topic1)
@@ -35,8 +35,8 @@ func TestGetChannel(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
-	defer nsqd.Exit()
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
 
 	topic := nsqd.GetTopic("test")
 
@@ -54,8 +54,8 @@ func TestDeletes(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
-	defer nsqd.Exit()
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
 
 	topic := nsqd.GetTopic("test")
 
@@ -79,8 +79,8 @@ func TestDeleteLast(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
-	defer nsqd.Exit()
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
 
 	topic := nsqd.GetTopic("test")
 
@@ -103,10 +103,10 @@ func BenchmarkTopicPut(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 	topicName := "bench_topic_put" + strconv.Itoa(b.N)
-	options := NewNsqdOptions()
-	options.memQueueSize = int64(b.N)
-	nsqd := NewNSQd(1, options)
-	defer nsqd.Exit()
+	options := NewOptions()
+	options.MemQueueSize = int64(b.N)
+	nsqd := New(options)
+	defer nsqd.Stop()
 	b.StartTimer()
 
 	for i := 0; i <= b.N; i++ {
@@ -122,10 +122,10 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 	defer log.SetOutput(os.Stdout)
 	topicName := "bench_topic_to_channel_put" + strconv.Itoa(b.N)
 	channelName := "bench"
-	options := NewNsqdOptions()
-	options.memQueueSize = int64(b.N)
-	nsqd := NewNSQd(1, options)
-	defer nsqd.Exit()
+	options := NewOptions()
+	options.MemQueueSize = int64(b.N)
+	nsqd := New(options)
+	defer nsqd.Stop()
 	channel := nsqd.GetTopic(topicName).GetChannel(channelName)
 	b.StartTimer()
 
@@ -142,3 +142,199 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		runtime.Gosched()
 	}
 }
+
+func TestPauseTopic(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	topic := nsqd.GetTopic("test_pause_topic")
+	channel := topic.GetChannel("ch")
+
+	topic.Pause()
+	assert.Equal(t, topic.IsPaused(), true)
+
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	err := topic.PutMessage(msg)
+	assert.Equal(t, err, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	// the message accumulates in the topic while paused
+	assert.Equal(t, topic.Depth(), int64(1))
+	assert.Equal(t, channel.Depth(), int64(0))
+
+	topic.UnPause()
+	assert.Equal(t, topic.IsPaused(), false)
+
+	outputMsg := <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msg.Id)
+	assert.Equal(t, topic.Depth(), int64(0))
+}
+
+func TestFilteredChannel(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	filter, _ := NewMessageFilter("regex:^keep")
+	topic := nsqd.GetTopic("test_filtered_channel")
+	filtered := topic.GetFilteredChannel("filtered", filter)
+	unfiltered := topic.GetChannel("unfiltered")
+
+	dropMsg := nsq.NewMessage(<-nsqd.idChan, []byte("drop me"))
+	topic.PutMessage(dropMsg)
+	keepMsg := nsq.NewMessage(<-nsqd.idChan, []byte("keep me"))
+	topic.PutMessage(keepMsg)
+
+	outputMsg := <-filtered.clientMsgChan
+	assert.Equal(t, outputMsg.Id, keepMsg.Id)
+	assert.Equal(t, filtered.filteredCount, uint64(1))
+
+	outputMsg = <-unfiltered.clientMsgChan
+	assert.Equal(t, outputMsg.Id, dropMsg.Id)
+	outputMsg = <-unfiltered.clientMsgChan
+	assert.Equal(t, outputMsg.Id, keepMsg.Id)
+	assert.Equal(t, unfiltered.filteredCount, uint64(0))
+}
+
+func TestReplayChannel(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := NewOptions()
+	options.DataPath, _ = ioutil.TempDir("", "nsq-replay")
+	defer os.RemoveAll(options.DataPath)
+	nsqd := New(options)
+	defer nsqd.Stop()
+
+	topicName := "test_replay_channel" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	_, err := topic.ReplayChannel("replay", 0)
+	assert.Equal(t, err, errRetentionNotEnabled)
+
+	err = topic.SetRetention(time.Hour, 0)
+	assert.Equal(t, err, nil)
+
+	channel := topic.GetChannel("ch")
+	var inFlightMsg *nsq.Message
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte(strconv.Itoa(i))))
+		msg := <-channel.clientMsgChan
+		channel.StartInFlightTimeout(msg, nil)
+		if i == 2 {
+			// the last one is still in flight during the replays
+			inFlightMsg = msg
+			continue
+		}
+		channel.FinishMessage(nil, msg.Id)
+	}
+
+	// a new channel receives everything retained
+	replay, err := topic.ReplayChannel("replay", 0)
+	assert.Equal(t, err, nil)
+	for i := 0; i < 3; i++ {
+		msg := <-replay.clientMsgChan
+		assert.Equal(t, string(msg.Body), strconv.Itoa(i))
+	}
+
+	// and an existing channel can be rewound
+	_, err = topic.ReplayChannel("ch", time.Now().Add(-time.Minute).Unix())
+	assert.Equal(t, err, nil)
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-channel.clientMsgChan:
+			assert.Equal(t, string(msg.Body), strconv.Itoa(i))
+			assert.Equal(t, channel.StartInFlightTimeout(msg, nil), nil)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for replayed msg %d", i)
+		}
+	}
+	assert.Equal(t, channel.FinishMessage(nil, inFlightMsg.Id), nil)
+}
+
+func TestEphemeralTopic(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	topicName := "test_ephemeral_topic#ephemeral"
+	topic := nsqd.GetTopic(topicName)
+	assert.Equal(t, topic.ephemeralTopic, true)
+	_, ok := topic.backend.(*DummyBackendQueue)
+	assert.Equal(t, ok, true)
+	assert.NotEqual(t, topic.SetRetention(time.Minute, 0), nil)
+
+	channel1 := topic.GetChannel("ch1")
+	channel2 := topic.GetChannel("ch2")
+
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+	<-channel1.clientMsgChan
+	<-channel2.clientMsgChan
+
+	// the topic remains until its last channel is deleted
+	err := topic.DeleteExistingChannel("ch1")
+	assert.Equal(t, err, nil)
+	time.Sleep(10 * time.Millisecond)
+	_, err = nsqd.GetExistingTopic(topicName)
+	assert.Equal(t, err, nil)
+
+	// nor while it isn't empty
+	topic.Pause()
+	topic.PutMessage(nsq.NewMessage(<-nsqd.idChan, []byte("test body")))
+	for i := 0; i < 100 && topic.Depth() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, topic.Depth(), int64(1))
+	err = topic.DeleteExistingChannel("ch2")
+	assert.Equal(t, err, nil)
+	time.Sleep(10 * time.Millisecond)
+	_, err = nsqd.GetExistingTopic(topicName)
+	assert.Equal(t, err, nil)
+
+	channel3 := topic.GetChannel("ch3")
+	topic.UnPause()
+	<-channel3.clientMsgChan
+	assert.Equal(t, topic.Depth(), int64(0))
+
+	err = topic.DeleteExistingChannel("ch3")
+	assert.Equal(t, err, nil)
+	for i := 0; i < 100; i++ {
+		_, err = nsqd.GetExistingTopic(topicName)
+		if err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, topic.Exiting(), true)
+}
+
+func TestEphemeralTopicNewChannel(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd := New(NewOptions())
+	defer nsqd.Stop()
+
+	// a channel created while the topic is marked as deleting keeps it
+	topicName := "test_ephemeral_new_channel#ephemeral"
+	topic := nsqd.GetTopic(topicName)
+	topic.Lock()
+	topic.deleting = true
+	topic.Unlock()
+	topic.GetChannel("ch")
+	nsqd.deleteUnusedTopic(topic)
+
+	existing, err := nsqd.GetExistingTopic(topicName)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, existing, topic)
+	assert.Equal(t, topic.Exiting(), false)
+}
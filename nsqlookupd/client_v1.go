@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"net"
 )
 
@@ -23,6 +24,12 @@ func NewClientV1(conn net.Conn) *ClientV1 {
 	}
 }
 
+// log returns a nsq.LogEntry with the client address and fields from alternating
+// key/value pairs
+func (c *ClientV1) log(keyvals ...interface{}) nsq.LogEntry {
+	return nsq.NewLogEntry(nil, "client", c.String()).With(keyvals...)
+}
+
 func (c *ClientV1) String() string {
 	return c.RemoteAddr().String()
 }
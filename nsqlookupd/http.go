@@ -4,14 +4,14 @@ import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"github.com/lhzd863/nsq-0.2.16/util"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"strings"
 )
 
 func httpServer(listener net.Listener) {
-	log.Printf("HTTP: listening on %s", listener.Addr().String())
+	l := nsq.NewLogEntry(nil, "addr", listener.Addr().String())
+	l.Infof("listening for HTTP clients")
 
 	handler := http.NewServeMux()
 	handler.HandleFunc("/ping", pingHandler)
@@ -31,10 +31,10 @@ func httpServer(listener net.Listener) {
 	err := server.Serve(listener)
 	// theres no direct way to detect this error because it is not exposed
 	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		log.Printf("ERROR: http.Serve() - %s", err.Error())
+		l.Errorf("http.Serve() - %s", err.Error())
 	}
 
-	log.Printf("HTTP: closing %s", listener.Addr().String())
+	l.Infof("closing HTTP listener")
 }
 
 func pingHandler(w http.ResponseWriter, req *http.Request) {
@@ -114,7 +114,7 @@ func createTopicHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	log.Printf("DB: adding topic(%s)", topicName)
+	nsq.NewLogEntry(nil, "topic", topicName).Infof("adding topic registration")
 	key := Registration{"topic", topicName, ""}
 	lookupd.DB.AddRegistration(key)
 
@@ -136,13 +136,18 @@ func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 
 	registrations := lookupd.DB.FindRegistrations("channel", topicName, "*")
 	for _, registration := range registrations {
-		log.Printf("DB: removing channel(%s) from topic(%s)", registration.SubKey, topicName)
+		nsq.NewLogEntry(nil, "topic", topicName, "channel", registration.SubKey).Infof("removing channel registration")
 		lookupd.DB.RemoveRegistration(*registration)
 	}
 
 	registrations = lookupd.DB.FindRegistrations("topic", topicName, "")
 	for _, registration := range registrations {
-		log.Printf("DB: removing topic(%s)", topicName)
+		nsq.NewLogEntry(nil, "topic", topicName).Infof("removing topic registration")
+		lookupd.DB.RemoveRegistration(*registration)
+	}
+
+	registrations = lookupd.DB.FindRegistrations("paused_topic", topicName, "")
+	for _, registration := range registrations {
 		lookupd.DB.RemoveRegistration(*registration)
 	}
 
@@ -162,11 +167,12 @@ func createChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	log.Printf("DB: adding channel(%s) in topic(%s)", channelName, topicName)
+	l := nsq.NewLogEntry(nil, "topic", topicName, "channel", channelName)
+	l.Infof("adding channel registration")
 	key := Registration{"channel", topicName, channelName}
 	lookupd.DB.AddRegistration(key)
 
-	log.Printf("DB: adding topic(%s)", topicName)
+	l.Infof("adding topic registration")
 	key = Registration{"topic", topicName, ""}
 	lookupd.DB.AddRegistration(key)
 
@@ -192,7 +198,7 @@ func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	log.Printf("DB: removing channel(%s) from topic(%s)", channelName, topicName)
+	nsq.NewLogEntry(nil, "topic", topicName, "channel", channelName).Infof("removing channel registration")
 	for _, registration := range registrations {
 		lookupd.DB.RemoveRegistration(*registration)
 	}
@@ -202,23 +208,26 @@ func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 
 // note: we can't embed the *Producer here because embeded objects are ignored for json marshalling
 type producerTopic struct {
-	Address  string   `json:"address"`
-	TcpPort  int      `json:"tcp_port"`
-	HttpPort int      `json:"http_port"`
-	Version  string   `json:"version"`
-	Topics   []string `json:"topics"`
+	Address      string   `json:"address"`
+	TcpPort      int      `json:"tcp_port"`
+	HttpPort     int      `json:"http_port"`
+	Version      string   `json:"version"`
+	Topics       []string `json:"topics"`
+	PausedTopics []string `json:"paused_topics"`
 }
 
 func nodesHandler(w http.ResponseWriter, req *http.Request) {
 	producers := lookupd.DB.FindProducers("client", "", "")
 	producerTopics := make([]*producerTopic, len(producers))
 	for i, p := range producers {
+		registrations := lookupd.DB.LookupRegistrations(p)
 		producerTopics[i] = &producerTopic{
-			Address:  p.Address,
-			TcpPort:  p.TcpPort,
-			HttpPort: p.HttpPort,
-			Version:  p.Version,
-			Topics:   lookupd.DB.LookupRegistrations(p).Filter("topic", "*", "").Keys(),
+			Address:      p.Address,
+			TcpPort:      p.TcpPort,
+			HttpPort:     p.HttpPort,
+			Version:      p.Version,
+			Topics:       registrations.Filter("topic", "*", "").Keys(),
+			PausedTopics: registrations.Filter("paused_topic", "*", "").Keys(),
 		}
 	}
 
@@ -47,7 +47,7 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 
 		response, err := p.Exec(client, reader, params)
 		if err != nil {
-			log.Printf("ERROR: CLIENT(%s) - %s", client, err.(*nsq.ClientErr).Description())
+			client.log().Errorf("%s", err.(*nsq.ClientErr).Description())
 			_, err = nsq.SendResponse(client, []byte(err.Error()))
 			if err != nil {
 				break
@@ -63,7 +63,7 @@ func (p *LookupProtocolV1) IOLoop(conn net.Conn) error {
 		}
 	}
 
-	log.Printf("CLIENT(%s): closing", client)
+	client.log().Infof("closing client")
 	if client.Producer != nil {
 		lookupd.DB.Remove(Registration{"client", "", ""}, client.Producer)
 		registrations := lookupd.DB.LookupRegistrations(client.Producer)
@@ -84,6 +84,10 @@ func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params [
 		return p.REGISTER(client, reader, params[1:])
 	case "UNREGISTER":
 		return p.UNREGISTER(client, reader, params[1:])
+	case "PAUSE":
+		return p.PAUSE(client, reader, params[1:])
+	case "UNPAUSE":
+		return p.UNPAUSE(client, reader, params[1:])
 	}
 	return nil, nsq.NewClientErr("E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -121,11 +125,11 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 	}
 
 	if channel != "" {
-		log.Printf("DB: client(%s) added registration for channel:%s in topic:%s", client, channel, topic)
+		client.log("topic", topic, "channel", channel).Infof("added channel registration")
 		key := Registration{"channel", topic, channel}
 		lookupd.DB.Add(key, client.Producer)
 	}
-	log.Printf("DB: client(%s) added registration for topic:%s", client, topic)
+	client.log("topic", topic).Infof("added topic registration")
 	key := Registration{"topic", topic, ""}
 	lookupd.DB.Add(key, client.Producer)
 
@@ -143,15 +147,62 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 	}
 
 	if channel != "" {
-		log.Printf("DB: client(%s) removed registration for channel:%s in topic:%s", client, channel, topic)
+		client.log("topic", topic, "channel", channel).Infof("removed channel registration")
 		key := Registration{"channel", topic, channel}
 		producers := lookupd.DB.Remove(key, client.Producer)
 		// for ephemeral channels, remove the channel as well if it has no producers
 		if producers == 0 && strings.HasSuffix(channel, "#ephemeral") {
 			lookupd.DB.RemoveRegistration(key)
 		}
+	} else {
+		client.log("topic", topic).Infof("removed paused registration")
+		key := Registration{"paused_topic", topic, ""}
+		lookupd.DB.Remove(key, client.Producer)
+		// for ephemeral topics, remove the topic (when it has no producers) as well
+		if strings.HasSuffix(topic, "#ephemeral") {
+			client.log("topic", topic).Infof("removed topic registration")
+			key = Registration{"topic", topic, ""}
+			producers := lookupd.DB.Remove(key, client.Producer)
+			if producers == 0 {
+				lookupd.DB.RemoveRegistration(key)
+			}
+		}
+	}
+
+	return []byte("OK"), nil
+}
+
+func (p *LookupProtocolV1) PAUSE(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.Producer == nil {
+		return nil, nsq.NewClientErr("E_INVALID", "client must IDENTIFY")
 	}
 
+	topic, _, err := getTopicChan(params)
+	if err != nil {
+		return nil, err
+	}
+
+	client.log("topic", topic).Infof("added paused registration")
+	key := Registration{"paused_topic", topic, ""}
+	lookupd.DB.Add(key, client.Producer)
+
+	return []byte("OK"), nil
+}
+
+func (p *LookupProtocolV1) UNPAUSE(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.Producer == nil {
+		return nil, nsq.NewClientErr("E_INVALID", "client must IDENTIFY")
+	}
+
+	topic, _, err := getTopicChan(params)
+	if err != nil {
+		return nil, err
+	}
+
+	client.log("topic", topic).Infof("removed paused registration")
+	key := Registration{"paused_topic", topic, ""}
+	lookupd.DB.Remove(key, client.Producer)
+
 	return []byte("OK"), nil
 }
 
@@ -185,8 +236,7 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 
 	client.Producer = &producer
 	lookupd.DB.Add(Registration{"client", "", ""}, client.Producer)
-	log.Printf("CLIENT(%s) registered TCP:%d HTTP:%d address:%s",
-		client.RemoteAddr(),
+	client.log().Infof("registered TCP:%d HTTP:%d address:%s",
 		producer.TcpPort,
 		producer.HttpPort,
 		producer.Address)
@@ -203,7 +253,7 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 	data["address"] = hostname
 	response, err := json.Marshal(data)
 	if err != nil {
-		log.Printf("ERROR: marshaling %v", data)
+		client.log().Errorf("failed to marshal %v", data)
 		return []byte("OK"), nil
 	}
 	return response, nil
@@ -213,7 +263,7 @@ func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, erro
 	if client.Producer != nil {
 		// we could get a PING before other commands on the same client connection
 		now := time.Now()
-		log.Printf("CLIENT(%s): pinged (last ping %s)", client.Producer.producerId, now.Sub(client.Producer.LastUpdate))
+		client.log().Infof("pinged (last ping %s)", now.Sub(client.Producer.LastUpdate))
 		client.Producer.LastUpdate = now
 	}
 	return []byte("OK"), nil
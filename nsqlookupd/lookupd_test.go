@@ -130,3 +130,88 @@ func TestBasicLookupd(t *testing.T) {
 	assert.Equal(t, len(returnedProducers), 0)
 
 }
+
+func TestPausedTopicLookupd(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, httpAddr := mustStartLookupd()
+	defer lookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	topicName := "pausedtopic"
+	ci := make(map[string]interface{})
+	ci["version"] = "fake-version"
+	ci["tcp_port"] = 5000
+	ci["http_port"] = 5555
+	ci["address"] = "ip.address"
+	cmd, _ := nsq.Identify(ci)
+	err := cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	err = nsq.Register(topicName, "").Write(conn)
+	assert.Equal(t, err, nil)
+	err = nsq.Pause(topicName).Write(conn)
+	assert.Equal(t, err, nil)
+
+	time.Sleep(10 * time.Millisecond)
+
+	endpoint := fmt.Sprintf("http://%s/nodes", httpAddr)
+	data, err := nsq.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	pausedTopics, err := data.Get("producers").GetIndex(0).Get("paused_topics").StringArray()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pausedTopics, []string{topicName})
+
+	err = nsq.UnPause(topicName).Write(conn)
+	assert.Equal(t, err, nil)
+
+	time.Sleep(10 * time.Millisecond)
+
+	data, err = nsq.ApiRequest(endpoint)
+	assert.Equal(t, err, nil)
+	pausedTopics, err = data.Get("producers").GetIndex(0).Get("paused_topics").StringArray()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(pausedTopics), 0)
+
+	conn.Close()
+}
+
+func TestEphemeralTopicLookupd(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	tcpAddr, _ := mustStartLookupd()
+	defer lookupd.Exit()
+
+	conn := mustConnectLookupd(t, tcpAddr)
+	topicName := "ephemeraltopic#ephemeral"
+	ci := make(map[string]interface{})
+	ci["version"] = "fake-version"
+	ci["tcp_port"] = 5000
+	ci["http_port"] = 5555
+	ci["address"] = "ip.address"
+	cmd, _ := nsq.Identify(ci)
+	err := cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	err = nsq.Register(topicName, "ch#ephemeral").Write(conn)
+	assert.Equal(t, err, nil)
+
+	time.Sleep(10 * time.Millisecond)
+
+	topics := lookupd.DB.FindRegistrations("topic", topicName, "")
+	assert.Equal(t, len(topics), 1)
+
+	err = nsq.UnRegister(topicName, "ch#ephemeral").Write(conn)
+	assert.Equal(t, err, nil)
+	err = nsq.UnRegister(topicName, "").Write(conn)
+	assert.Equal(t, err, nil)
+
+	time.Sleep(10 * time.Millisecond)
+
+	topics = lookupd.DB.FindRegistrations("topic", topicName, "")
+	assert.Equal(t, len(topics), 0)
+	channels := lookupd.DB.FindRegistrations("channel", topicName, "*")
+	assert.Equal(t, len(channels), 0)
+
+	conn.Close()
+}
@@ -15,7 +15,9 @@ var (
 	showVersion = flag.Bool("version", false, "print version string")
 	tcpAddress  = flag.String("tcp-address", "0.0.0.0:4160", "<addr>:<port> to listen on for TCP clients")
 	httpAddress = flag.String("http-address", "0.0.0.0:4161", "<addr>:<port> to listen on for HTTP clients")
-	debugMode   = flag.Bool("debug", false, "enable debug mode")
+	debugMode   = flag.Bool("debug", false, "enable debug mode (same as --log-level=debug)")
+	logLevel    = flag.String("log-level", "info", "log level (debug, info, warn or error)")
+	logFormat   = flag.String("log-format", "text", "log format (text or json)")
 )
 
 var protocols = map[int32]nsq.Protocol{}
@@ -29,6 +31,14 @@ func main() {
 		return
 	}
 
+	if *debugMode {
+		*logLevel = "debug"
+	}
+	_, err := util.SetupLogging(*logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
+
 	signalChan := make(chan os.Signal, 1)
 	exitChan := make(chan int)
 	go func() {
@@ -47,7 +57,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	log.Printf("nsqlookupd v%s", util.BINARY_VERSION)
+	nsq.NewLogEntry(nil).Infof("nsqlookupd v%s", util.BINARY_VERSION)
 
 	lookupd = NewNSQLookupd()
 	lookupd.tcpAddr = tcpAddr
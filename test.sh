@@ -9,14 +9,14 @@ if [ "$HOME" == "/home/travis" ]; then
     cd ~/builds/$GITHUB_USER/nsq
 fi
 
-for dir in nsqd nsqlookupd util/pqueue; do
+for dir in nsqd apps/nsqd nsqlookupd util/pqueue; do
     echo "testing $dir"
     pushd $dir >/dev/null
     go test -test.v -timeout 15s
     popd >/dev/null
 done
 
-pushd nsqd >/dev/null
+pushd apps/nsqd >/dev/null
 go build
 rm -f *.dat
 echo "starting nsqd --data-path=/tmp"
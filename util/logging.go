@@ -0,0 +1,21 @@
+package util
+
+import (
+	"github.com/lhzd863/nsq-0.2.16/nsq"
+)
+
+// SetupLogging replaces the nsq package Logger, used by the daemons, with one
+// configured from their --log-level (debug, info, warn or error) and --log-format
+// (text or json) flags
+func SetupLogging(level string, format string) (*nsq.StdLogger, error) {
+	lvl, err := nsq.ParseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	logger, err := nsq.NewLogger(nil, lvl, format)
+	if err != nil {
+		return nil, err
+	}
+	nsq.SetLogger(logger)
+	return logger, nil
+}
@@ -4,7 +4,6 @@ import (
 	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"sync"
 )
@@ -17,14 +16,14 @@ func GetChannelsForTopic(topic string, lookupdHTTPAddrs []string) ([]string, err
 	for _, addr := range lookupdHTTPAddrs {
 		wg.Add(1)
 		endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", addr, url.QueryEscape(topic))
-		log.Printf("LOOKUPD: querying %s", endpoint)
+		nsq.NewLogEntry(nil).Infof("querying lookupd %s", endpoint)
 		go func(endpiont string) {
 			data, err := nsq.ApiRequest(endpoint)
 			lock.Lock()
 			defer lock.Unlock()
 			defer wg.Done()
 			if err != nil {
-				log.Printf("ERROR: lookupd %s - %s", endpoint, err.Error())
+				nsq.NewLogEntry(nil).Errorf("failed to query lookupd %s - %s", endpoint, err.Error())
 				return
 			}
 			success = true
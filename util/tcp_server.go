@@ -1,7 +1,7 @@
 package util
 
 import (
-	"log"
+	"github.com/lhzd863/nsq-0.2.16/nsq"
 	"net"
 	"runtime"
 	"strings"
@@ -12,24 +12,25 @@ type TcpHandler interface {
 }
 
 func TcpServer(listener net.Listener, handler TcpHandler) {
-	log.Printf("TCP: listening on %s", listener.Addr().String())
+	l := nsq.NewLogEntry(nil, "addr", listener.Addr().String())
+	l.Infof("listening for TCP clients")
 
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				log.Printf("NOTICE: temporary Accept() failure - %s", err.Error())
+				l.Warnf("temporary Accept() failure - %s", err.Error())
 				runtime.Gosched()
 				continue
 			}
 			// theres no direct way to detect this error because it is not exposed
 			if !strings.Contains(err.Error(), "use of closed network connection") {
-				log.Printf("ERROR: listener.Accept() - %s", err.Error())
+				l.Errorf("listener.Accept() - %s", err.Error())
 			}
 			break
 		}
 		go handler.Handle(clientConn)
 	}
 
-	log.Printf("TCP: closing %s", listener.Addr().String())
+	l.Infof("closing TCP listener")
 }